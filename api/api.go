@@ -0,0 +1,201 @@
+// Package api serves a local HTTP/JSON API to read and control the
+// PiVoyager, over a unix socket or TCP. All requests go through a single
+// device.Device, whose lock serialises them with other pivoyager
+// processes.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_ADDRESS     = "unix:/run/pivoyager.sock"
+	DEFAULT_SOCKET_MODE = 0660
+	MAX_BODY            = 64 << 10
+)
+
+// Source provides the latest sample of the PiVoyager, such as a
+// monitor.Monitor.
+type Source interface {
+	Latest() (monitor.Sample, bool)
+}
+
+type Server struct {
+	Device *device.Device
+	// Token, if not empty, must be sent by clients as a bearer token, in an
+	// "Authorization: Bearer <token>" header.
+	Token string
+	// Battery is the model estimating the state of charge, or
+	// battery.DefaultModel() if nil.
+	Battery *battery.Model
+	// Rates, learned by the daemon, estimate the runtime left from a single
+	// reading.
+	Rates battery.Rates
+	// Health, if not nil, tracks the health of the battery. Otherwise, the
+	// health saved by the daemon in HealthFile is served.
+	Health     *battery.Tracker
+	HealthFile string
+	// Source, if not nil, provides the samples of a monitor, whose state of
+	// charge is smoothed over time and preferred to a single reading while
+	// younger than MaxAge.
+	Source Source
+	MaxAge time.Duration
+	Logger *log.Logger
+
+	mux *http.ServeMux
+}
+
+func New(dev *device.Device, token string) *Server {
+	s := &Server{Device: dev, Token: token, mux: http.NewServeMux()}
+
+	s.mux.HandleFunc("/", s.notFound)
+	s.mux.HandleFunc("/status", s.status)
+	s.mux.HandleFunc("/snapshot", s.snapshot)
+	s.mux.HandleFunc("/battery", s.battery)
+	s.mux.HandleFunc("/battery/health", s.batteryHealth)
+	s.mux.HandleFunc("/time", s.rtc)
+	s.mux.HandleFunc("/alarm", s.alarm)
+	s.mux.HandleFunc("/config", s.config)
+	s.mux.HandleFunc("/enable", s.enable)
+	s.mux.HandleFunc("/disable", s.disable)
+	s.mux.HandleFunc("/clear", s.clearFlags)
+	s.mux.HandleFunc("/watchdog", s.timer(device.CONF_I2C_WD|device.CONF_PIN_WD, device.CONF_I2C_WD, (*device.Device).Watchdog, (*device.Device).SetWatchdog))
+	s.mux.HandleFunc("/wakeup", s.timer(device.CONF_WAKE_AFTER|device.CONF_WAKE_ALARM|device.CONF_WAKE_POWER|device.CONF_WAKE_BUTTON, device.CONF_WAKE_AFTER, (*device.Device).Wakeup, (*device.Device).SetWakeup))
+	s.mux.HandleFunc("/low-battery-timer", s.timer(device.CONF_LBO_SHUTDOWN, device.CONF_LBO_SHUTDOWN, (*device.Device).LowBatteryTimer, (*device.Device).SetLowBatteryTimer))
+	return s
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.Token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.Token)) == 1
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pivoyager"`)
+		writeError(w, http.StatusUnauthorized, errors.New("Missing or invalid token"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+/* Responses */
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, &errorResponse{err.Error()})
+}
+
+// deviceError reports a failure to talk to the PiVoyager.
+func (s *Server) deviceError(w http.ResponseWriter, r *http.Request, err error) {
+	s.logf("%s %s: %s", r.Method, r.URL.Path, err)
+	writeError(w, http.StatusBadGateway, err)
+}
+
+// readJSON decodes the body of r into v, replying with an error and
+// returning false if it is invalid.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(io.LimitReader(r.Body, MAX_BODY))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+// allow replies with an error and returns false if the method of r is not
+// one of methods.
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method %s not allowed", r.Method))
+	return false
+}
+
+/* Listening */
+
+// Listen listens on addr, which is either "unix:<path>" or a path starting
+// with '/' for a unix socket, created with the permissions mode, or a TCP
+// address such as "127.0.0.1:8080".
+func Listen(addr string, mode os.FileMode) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr && !strings.HasPrefix(addr, "/") {
+		return net.Listen("tcp", addr)
+	}
+	// Remove the socket left by a previous run, but nothing else.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// ListenAndServe serves the API on addr, as described by Listen, until ctx
+// is cancelled.
+func (s *Server) ListenAndServe(ctx context.Context, addr string, mode os.FileMode) error {
+	ln, err := Listen(addr, mode)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	s.logf("Serving API on %s", addr)
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
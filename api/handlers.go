@@ -0,0 +1,377 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"net/http"
+	"os"
+	"time"
+)
+
+type statusResponse struct {
+	Status device.Status `json:"status"`
+	VBat   float32       `json:"vbat"`
+	VRef   float32       `json:"vref"`
+}
+
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, fmt.Errorf("No such endpoint: %s", r.URL.Path))
+}
+
+// GET /status
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	if allow(w, r, http.MethodGet) {
+		s.writeStatus(w, r)
+	}
+}
+
+func (s *Server) writeStatus(w http.ResponseWriter, r *http.Request) {
+	var resp statusResponse
+
+	status, err := s.Device.Status()
+	if err == nil {
+		resp.Status = status.Decode()
+		resp.VBat, resp.VRef, err = s.Device.Voltage()
+	}
+	if err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// GET /snapshot
+func (s *Server) snapshot(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	snap, err := s.Device.Snapshot()
+	if err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &snap)
+}
+
+type batteryResponse struct {
+	Charger device.ChargerState `json:"charger"`
+	VBat    float32             `json:"vbat"`
+	Charge  battery.Estimate    `json:"charge"`
+	Runtime battery.Remaining   `json:"runtime"`
+	// Smoothed tells whether Charge and Runtime come from the monitor of the
+	// daemon, rather than from a single reading.
+	Smoothed bool `json:"smoothed"`
+}
+
+// GET /battery
+func (s *Server) battery(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	if s.Source != nil {
+		sample, ok := s.Source.Latest()
+		if ok && (s.MaxAge == 0 || time.Since(sample.Time) < s.MaxAge) {
+			writeJSON(w, http.StatusOK, &batteryResponse{sample.Status.Charger, sample.VBat, sample.Charge, sample.Runtime, true})
+			return
+		}
+	}
+
+	var resp batteryResponse
+	status, err := s.Device.Status()
+	if err == nil {
+		resp.Charger = status.Decode().Charger
+		resp.VBat, _, err = s.Device.Voltage()
+	}
+	if err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	model := s.Battery
+	if model == nil {
+		model = battery.DefaultModel()
+	}
+	resp.Charge = model.Estimate(float64(resp.VBat), monitor.BatteryMode(resp.Charger))
+	resp.Runtime = s.Rates.Predict(resp.Charge, model.Reserve(battery.DEFAULT_CUTOFF))
+	writeJSON(w, http.StatusOK, &resp)
+}
+
+// GET /battery/health
+func (s *Server) batteryHealth(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	if s.Health != nil {
+		report := s.Health.Latest()
+		writeJSON(w, http.StatusOK, &report)
+		return
+	}
+	h, err := battery.LoadHealth(s.HealthFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No battery health in %s, it is tracked by the daemon", s.HealthFile))
+			return
+		}
+		s.logf("%s %s: %s", r.Method, r.URL.Path, err)
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	report := battery.NewTracker(h).Latest()
+	writeJSON(w, http.StatusOK, &report)
+}
+
+type timeResponse struct {
+	Time       time.Time `json:"time"`
+	SystemTime time.Time `json:"system_time"`
+	// Offset is how far the RTC is ahead of the system clock, in seconds.
+	Offset float64 `json:"offset"`
+}
+
+type timeRequest struct {
+	Time *time.Time `json:"time"`
+	// Sync sets the RTC to the system time.
+	Sync bool `json:"sync"`
+}
+
+// GET /time, PUT /time {"time": "2020-01-02T15:04:05Z"} or {"sync": true}
+func (s *Server) rtc(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		tm, err := s.Device.Time()
+		if err != nil {
+			s.deviceError(w, r, err)
+			return
+		}
+		now := time.Now().UTC()
+		writeJSON(w, http.StatusOK, &timeResponse{tm, now, tm.Sub(now).Seconds()})
+		return
+	}
+
+	var req timeRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if (req.Time == nil) == !req.Sync {
+		writeError(w, http.StatusBadRequest, errors.New("Expected either 'time' or 'sync'"))
+		return
+	}
+	var tm time.Time
+	var err error
+	if req.Sync {
+		tm, err = s.Device.SyncTime()
+	} else {
+		tm = req.Time.UTC()
+		err = s.Device.SetTime(tm)
+	}
+	if err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &timeResponse{tm, tm, 0})
+}
+
+type alarmResponse struct {
+	Alarm device.Alarm `json:"alarm"`
+	Raw   uint32       `json:"raw"`
+}
+
+type alarmRequest struct {
+	Alarm *device.Alarm `json:"alarm"`
+}
+
+// GET /alarm, PUT /alarm {"alarm": "*-12-30-0"}
+func (s *Server) alarm(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		var req alarmRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Alarm == nil {
+			writeError(w, http.StatusBadRequest, errors.New("Missing 'alarm'"))
+			return
+		}
+		if err := s.Device.SetAlarm(*req.Alarm, device.CONF_WAKE_ALARM); err != nil {
+			s.deviceError(w, r, err)
+			return
+		}
+	}
+	alarm, err := s.Device.Alarm()
+	if err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &alarmResponse{alarm, uint32(alarm)})
+}
+
+type configResponse struct {
+	Options         device.ConfigurationByte `json:"options"`
+	Watchdog        uint16                   `json:"watchdog"`
+	Wakeup          uint16                   `json:"wakeup"`
+	LowBatteryTimer uint16                   `json:"low_battery_timer"`
+}
+
+func (s *Server) readConfig() (*configResponse, error) {
+	var resp configResponse
+
+	err := s.Device.Atomically(func(dev *device.Device) error {
+		var err error
+
+		if resp.Options, err = dev.Configuration(); err != nil {
+			return err
+		}
+		if resp.Watchdog, err = dev.Watchdog(); err != nil {
+			return err
+		}
+		if resp.Wakeup, err = dev.Wakeup(); err != nil {
+			return err
+		}
+		resp.LowBatteryTimer, err = dev.LowBatteryTimer()
+		return err
+	})
+	return &resp, err
+}
+
+// GET /config
+func (s *Server) config(w http.ResponseWriter, r *http.Request) {
+	if allow(w, r, http.MethodGet) {
+		s.writeConfig(w, r)
+	}
+}
+
+func (s *Server) writeConfig(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.readConfig()
+	if err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type optionsRequest struct {
+	Options device.ConfigurationByte `json:"options"`
+}
+
+// modifyOptions enables or disables the options listed in the request, and
+// replies with the configuration.
+func (s *Server) modifyOptions(w http.ResponseWriter, r *http.Request, enable bool) {
+	var req optionsRequest
+
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	value := req.Options
+	if !enable {
+		value = 0
+	}
+	if err := s.Device.ModifyConfiguration(req.Options, value); err != nil {
+		s.deviceError(w, r, err)
+		return
+	}
+	s.writeConfig(w, r)
+}
+
+// POST /enable {"options": ["power-wakeup"]}
+func (s *Server) enable(w http.ResponseWriter, r *http.Request) {
+	s.modifyOptions(w, r, true)
+}
+
+// POST /disable {"options": ["power-wakeup"]}
+func (s *Server) disable(w http.ResponseWriter, r *http.Request) {
+	s.modifyOptions(w, r, false)
+}
+
+type clearRequest struct {
+	Flags []string `json:"flags"`
+}
+
+// POST /clear {"flags": ["button", "alarm"]}
+func (s *Server) clearFlags(w http.ResponseWriter, r *http.Request) {
+	var req clearRequest
+	var prog byte
+
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	for _, flag := range req.Flags {
+		switch flag {
+		case "alarm":
+			prog |= device.PROG_CLEAR_ALARM
+		case "button":
+			prog |= device.PROG_CLEAR_BUTTON
+		default:
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Unknown flag '%s'", flag))
+			return
+		}
+	}
+	if prog != 0 {
+		if err := s.Device.Program(prog); err != nil {
+			s.deviceError(w, r, err)
+			return
+		}
+	}
+	s.writeStatus(w, r)
+}
+
+type timerResponse struct {
+	Seconds uint16                   `json:"seconds"`
+	Options device.ConfigurationByte `json:"options"`
+}
+
+type timerRequest struct {
+	Seconds *uint16 `json:"seconds"`
+}
+
+// timer handles GET and PUT {"seconds": 60} for the watchdog, wakeup and
+// low battery timers. Setting a timer enables the option conf, and the
+// reply lists the options selected by mask.
+func (s *Server) timer(mask device.ConfigurationByte, conf byte, get func(*device.Device) (uint16, error), set func(*device.Device, uint16, byte) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var resp timerResponse
+
+		if !allow(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			var req timerRequest
+			if !readJSON(w, r, &req) {
+				return
+			}
+			if req.Seconds == nil {
+				writeError(w, http.StatusBadRequest, errors.New("Missing 'seconds'"))
+				return
+			}
+			if err := set(s.Device, *req.Seconds, conf); err != nil {
+				s.deviceError(w, r, err)
+				return
+			}
+		}
+		err := s.Device.Atomically(func(dev *device.Device) error {
+			var err error
+
+			if resp.Seconds, err = get(dev); err != nil {
+				return err
+			}
+			options, err := dev.Configuration()
+			resp.Options = options & mask
+			return err
+		})
+		if err != nil {
+			s.deviceError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &resp)
+	}
+}
@@ -0,0 +1,82 @@
+package battery
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	DEFAULT_CHEMISTRY = "lipo"
+)
+
+// Chemistry describes how the voltage of a single cell battery relates to
+// its state of charge. The charge curve reads higher than the discharge
+// curve, because the charger raises the voltage of the battery.
+type Chemistry struct {
+	Name string
+	// Discharge is the resting voltage of the battery, without load.
+	Discharge Curve
+	// Charge is the voltage read while charging. It stops short of 100%:
+	// the end of the charge is reported by the charger, not by the
+	// voltage.
+	Charge Curve
+}
+
+func (c *Chemistry) Validate() error {
+	if err := c.Discharge.Validate(); err != nil {
+		return fmt.Errorf("Invalid discharge curve for %s: %w", c.Name, err)
+	}
+	if err := c.Charge.Validate(); err != nil {
+		return fmt.Errorf("Invalid charge curve for %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// Chemistries are the built-in chemistries, by name.
+var Chemistries = map[string]*Chemistry{
+	"lipo": {
+		Name: "lipo",
+		Discharge: Curve{
+			{3.27, 0}, {3.61, 5}, {3.69, 10}, {3.71, 15}, {3.73, 20},
+			{3.75, 25}, {3.77, 30}, {3.79, 35}, {3.80, 40}, {3.82, 45},
+			{3.84, 50}, {3.85, 55}, {3.87, 60}, {3.91, 65}, {3.95, 70},
+			{3.98, 75}, {4.02, 80}, {4.08, 85}, {4.11, 90}, {4.15, 95},
+			{4.20, 100},
+		},
+		Charge: Curve{
+			{3.45, 0}, {3.77, 10}, {3.83, 25}, {3.88, 40}, {3.92, 50},
+			{3.95, 60}, {4.03, 70}, {4.10, 80}, {4.20, 90},
+		},
+	},
+	"li-ion": {
+		Name: "li-ion",
+		Discharge: Curve{
+			{3.00, 0}, {3.30, 5}, {3.45, 10}, {3.55, 20}, {3.62, 30},
+			{3.68, 40}, {3.74, 50}, {3.80, 60}, {3.87, 70}, {3.95, 80},
+			{4.05, 90}, {4.20, 100},
+		},
+		Charge: Curve{
+			{3.30, 0}, {3.53, 10}, {3.63, 20}, {3.70, 30}, {3.76, 40},
+			{3.82, 50}, {3.88, 60}, {3.95, 70}, {4.03, 80}, {4.20, 90},
+		},
+	},
+}
+
+// ChemistryNames returns the names of the built-in chemistries, sorted.
+func ChemistryNames() []string {
+	names := make([]string, 0, len(Chemistries))
+	for name := range Chemistries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the built-in chemistry called name.
+func Lookup(name string) (*Chemistry, error) {
+	if c, ok := Chemistries[strings.ToLower(name)]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("Unknown battery chemistry '%s', expected one of %s", name, strings.Join(ChemistryNames(), ", "))
+}
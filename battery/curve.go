@@ -0,0 +1,68 @@
+// Package battery estimates the state of charge of the PiVoyager battery
+// from its voltage. It knows nothing about the device itself: callers feed
+// it voltages and charging modes.
+package battery
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Point maps a battery voltage to a state of charge.
+type Point struct {
+	Voltage float64 `json:"voltage"`
+	Percent float64 `json:"percent"`
+}
+
+// Curve maps voltages to states of charge, by linear interpolation between
+// points sorted by increasing voltage.
+type Curve []Point
+
+func (c Curve) Validate() error {
+	if len(c) < 2 {
+		return fmt.Errorf("A curve needs at least 2 points, got %d", len(c))
+	}
+	for i, p := range c {
+		if p.Percent < 0 || p.Percent > 100 {
+			return fmt.Errorf("Invalid percentage %g at %gV", p.Percent, p.Voltage)
+		}
+		if i == 0 {
+			continue
+		}
+		if p.Voltage <= c[i-1].Voltage {
+			return fmt.Errorf("Curve voltages must increase, got %gV after %gV", p.Voltage, c[i-1].Voltage)
+		}
+		if p.Percent < c[i-1].Percent {
+			return fmt.Errorf("Curve percentages cannot decrease, got %g%% at %gV", p.Percent, p.Voltage)
+		}
+	}
+	return nil
+}
+
+// Percent returns the state of charge at voltage v, clamped to the ends of
+// the curve.
+func (c Curve) Percent(v float64) float64 {
+	i := sort.Search(len(c), func(i int) bool { return c[i].Voltage >= v })
+	if i == 0 {
+		return c[0].Percent
+	}
+	if i == len(c) {
+		return c[len(c)-1].Percent
+	}
+	lo, hi := c[i-1], c[i]
+	return lo.Percent + (hi.Percent-lo.Percent)*(v-lo.Voltage)/(hi.Voltage-lo.Voltage)
+}
+
+// Slope returns how fast the state of charge changes with the voltage
+// around v, in percent per volt.
+func (c Curve) Slope(v float64) float64 {
+	i := sort.Search(len(c), func(i int) bool { return c[i].Voltage >= v })
+	if i == 0 {
+		i = 1
+	}
+	if i == len(c) {
+		i = len(c) - 1
+	}
+	lo, hi := c[i-1], c[i]
+	return (hi.Percent - lo.Percent) / (hi.Voltage - lo.Voltage)
+}
@@ -0,0 +1,274 @@
+package battery
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Mode is what the charger does with the battery.
+type Mode int
+
+const (
+	MODE_UNKNOWN Mode = iota // no battery, or a charger fault
+	MODE_DISCHARGING
+	MODE_CHARGING
+	MODE_FULL
+)
+
+var modeNames = []string{"unknown", "discharging", "charging", "full"}
+
+func (m Mode) String() string {
+	if m < 0 || int(m) >= len(modeNames) {
+		return "unknown"
+	}
+	return modeNames[m]
+}
+
+func (m Mode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Mode) UnmarshalText(data []byte) error {
+	for i, name := range modeNames {
+		if string(data) == name {
+			*m = Mode(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid battery mode: %s", data)
+}
+
+// NOISE is the typical error of a voltage reading, used to derive the
+// confidence of an estimate from the slope of the curve.
+const NOISE = 0.02
+
+// Model holds the parameters of the estimation.
+type Model struct {
+	Chemistry *Chemistry
+	// Load is the typical current drawn from the battery, in amps, and
+	// InternalResistance the resistance of the battery, in ohms. While
+	// discharging, the voltage read is raised by Load*InternalResistance
+	// to get the resting voltage described by the discharge curve.
+	Load               float64
+	InternalResistance float64
+	// Smoothing is the time constant of the moving average of the voltage.
+	Smoothing time.Duration
+	// SagThreshold is the drop below the average voltage, in volts, beyond
+	// which a reading taken while discharging is considered a transient
+	// caused by a load spike, and weighs less in the average.
+	SagThreshold float64
+	// Hysteresis, in percent, is how much the estimate must rise while
+	// discharging, or fall while charging, before it is reported.
+	Hysteresis float64
+	// Settle is the time taken to move from one curve to the other when
+	// the charger starts or stops charging.
+	Settle time.Duration
+}
+
+func DefaultModel() *Model {
+	return &Model{
+		Chemistry:          Chemistries[DEFAULT_CHEMISTRY],
+		Load:               0.5,
+		InternalResistance: 0.1,
+		Smoothing:          60 * time.Second,
+		SagThreshold:       0.15,
+		Hysteresis:         3,
+		Settle:             2 * time.Minute,
+	}
+}
+
+func (m *Model) Validate() error {
+	if m.Chemistry == nil {
+		return fmt.Errorf("Missing battery chemistry")
+	}
+	if err := m.Chemistry.Validate(); err != nil {
+		return err
+	}
+	if m.Load < 0 || m.InternalResistance < 0 || m.SagThreshold < 0 || m.Hysteresis < 0 {
+		return fmt.Errorf("Battery load, internal resistance, sag threshold and hysteresis cannot be negative")
+	}
+	if m.Smoothing < 0 || m.Settle < 0 {
+		return fmt.Errorf("Battery smoothing and settle time cannot be negative")
+	}
+	return nil
+}
+
+// restingVoltage compensates the drop caused by the load while
+// discharging.
+func (m *Model) restingVoltage(v float64, mode Mode) float64 {
+	if mode == MODE_DISCHARGING {
+		return v + m.Load*m.InternalResistance
+	}
+	return v
+}
+
+func (m *Model) curve(mode Mode) Curve {
+	if mode == MODE_CHARGING {
+		return m.Chemistry.Charge
+	}
+	return m.Chemistry.Discharge
+}
+
+// Reserve returns the charge left, in percent, when the voltage read while
+// discharging drops to cutoff. The battery is then considered empty, since
+// the charger reports a low battery, although the discharge curve goes
+// lower.
+func (m *Model) Reserve(cutoff float64) float64 {
+	return m.percent(m.restingVoltage(cutoff, MODE_DISCHARGING), MODE_DISCHARGING)
+}
+
+// percent returns the state of charge for the resting voltage v.
+func (m *Model) percent(v float64, mode Mode) float64 {
+	if mode == MODE_FULL {
+		return 100
+	}
+	return m.curve(mode).Percent(v)
+}
+
+// confidence returns the confidence in an estimate from the resting voltage
+// v: full confidence once the charger reports a full battery, less while
+// charging, and less where the curve is flat and a small error on the
+// voltage makes a large error on the charge.
+func (m *Model) confidence(v float64, mode Mode) float64 {
+	var base float64
+
+	switch mode {
+	case MODE_FULL:
+		return 1
+	case MODE_DISCHARGING:
+		base = 0.9
+	case MODE_CHARGING:
+		base = 0.6
+	default:
+		return 0
+	}
+	err := m.curve(mode).Slope(v) * NOISE
+	return base * math.Max(0.3, math.Min(1, 1-err/20))
+}
+
+// Estimate is an estimated state of charge.
+type Estimate struct {
+	// Percent is the state of charge, from 0 to 100.
+	Percent float64 `json:"percent"`
+	// Confidence, from 0 to 1, is how much the estimate can be trusted.
+	Confidence float64 `json:"confidence"`
+	// Voltage is the resting voltage the estimate is based on.
+	Voltage   float64 `json:"voltage"`
+	Mode      Mode    `json:"mode"`
+	Chemistry string  `json:"chemistry"`
+}
+
+func (e Estimate) String() string {
+	return fmt.Sprintf("%.0f%% (confidence %.0f%%)", e.Percent, 100*e.Confidence)
+}
+
+func (m *Model) estimate(v float64, mode Mode, percent float64, confidence float64) Estimate {
+	return Estimate{
+		Percent:    math.Round(percent*10) / 10,
+		Confidence: math.Round(confidence*100) / 100,
+		Voltage:    math.Round(v*1000) / 1000,
+		Mode:       mode,
+		Chemistry:  m.Chemistry.Name,
+	}
+}
+
+// Estimate estimates the state of charge from a single reading. With no
+// history to smooth it, the confidence is halved.
+func (m *Model) Estimate(volts float64, mode Mode) Estimate {
+	v := m.restingVoltage(volts, mode)
+	confidence := m.confidence(v, mode)
+	if mode != MODE_FULL {
+		confidence /= 2
+	}
+	return m.estimate(v, mode, m.percent(v, mode), confidence)
+}
+
+// Estimator estimates the state of charge from successive readings: it
+// smooths the voltage, ignores small moves against the direction of the
+// charge, and moves gradually from one curve to the other when the charger
+// starts or stops charging.
+type Estimator struct {
+	Model *Model
+
+	mu         sync.Mutex
+	started    bool
+	last       time.Time
+	voltage    float64
+	mode       Mode
+	modeSince  time.Time
+	percent    float64
+	settleFrom float64
+	settling   bool
+	latest     Estimate
+}
+
+func NewEstimator(m *Model) *Estimator {
+	if m == nil {
+		m = DefaultModel()
+	}
+	return &Estimator{Model: m}
+}
+
+// Update adds a reading of volts taken at t, and returns the new estimate.
+func (e *Estimator) Update(t time.Time, volts float64, mode Mode) Estimate {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	m := e.Model
+	v := m.restingVoltage(volts, mode)
+
+	if !e.started || mode != e.mode {
+		// The voltage jumps when the mode changes: restart the average,
+		// and settle from the previous estimate.
+		e.settling = e.started && m.Settle > 0
+		e.settleFrom = e.percent
+		e.started = true
+		e.mode = mode
+		e.modeSince = t
+		e.voltage = v
+	} else {
+		alpha := 1.0
+		if m.Smoothing > 0 {
+			alpha = 1 - math.Exp(-float64(t.Sub(e.last))/float64(m.Smoothing))
+			alpha = math.Max(0, alpha)
+		}
+		if mode == MODE_DISCHARGING && v < e.voltage-m.SagThreshold {
+			alpha /= 4
+		}
+		e.voltage += alpha * (v - e.voltage)
+	}
+	e.last = t
+
+	raw := m.percent(e.voltage, mode)
+	confidence := m.confidence(e.voltage, mode)
+	elapsed := t.Sub(e.modeSince)
+	if m.Smoothing > 0 && elapsed < m.Smoothing {
+		confidence *= 0.5 + 0.5*float64(elapsed)/float64(m.Smoothing)
+	}
+
+	percent := raw
+	switch {
+	case e.settling && elapsed < m.Settle:
+		progress := float64(elapsed) / float64(m.Settle)
+		percent = e.settleFrom + (raw-e.settleFrom)*progress
+		confidence *= 0.5 + 0.5*progress
+	case mode == MODE_DISCHARGING && raw > e.percent && raw-e.percent < m.Hysteresis:
+		percent = e.percent
+	case mode == MODE_CHARGING && raw < e.percent && e.percent-raw < m.Hysteresis:
+		percent = e.percent
+	default:
+		e.settling = false
+	}
+	e.percent = percent
+	e.latest = m.estimate(e.voltage, mode, percent, confidence)
+	return e.latest
+}
+
+// Latest returns the last estimate, if any.
+func (e *Estimator) Latest() (Estimate, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.latest, e.started
+}
@@ -0,0 +1,108 @@
+package battery
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCurvePercent(t *testing.T) {
+	c := Chemistries["lipo"].Discharge
+
+	tests := []struct {
+		voltage float64
+		percent float64
+	}{
+		{3.0, 0},
+		{3.84, 50},
+		{3.83, 47.5},
+		{4.3, 100},
+	}
+	for _, test := range tests {
+		if p := c.Percent(test.voltage); math.Abs(p-test.percent) > 1e-9 {
+			t.Errorf("Percent(%g) = %g, expected %g", test.voltage, p, test.percent)
+		}
+	}
+}
+
+func TestCurveValidate(t *testing.T) {
+	for name, chem := range Chemistries {
+		if err := chem.Validate(); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	for _, c := range []Curve{
+		{{3.5, 0}},
+		{{3.5, 0}, {3.4, 100}},
+		{{3.5, 50}, {3.6, 40}},
+		{{3.5, 0}, {4.2, 120}},
+	} {
+		if c.Validate() == nil {
+			t.Errorf("Validate() accepted %v", c)
+		}
+	}
+}
+
+func TestModelEstimate(t *testing.T) {
+	m := DefaultModel()
+
+	if e := m.Estimate(4.0, MODE_FULL); e.Percent != 100 || e.Confidence != 1 {
+		t.Errorf("Estimate(full) = %+v, expected 100%% with full confidence", e)
+	}
+	// The load lowers the voltage read while discharging.
+	v := 3.84 - m.Load*m.InternalResistance
+	if e := m.Estimate(v, MODE_DISCHARGING); e.Percent != 50 || e.Mode != MODE_DISCHARGING {
+		t.Errorf("Estimate(%gV) = %+v, expected 50%%", v, e)
+	}
+	if e := m.Estimate(3.84, MODE_UNKNOWN); e.Confidence != 0 {
+		t.Errorf("Estimate(unknown) = %+v, expected no confidence", e)
+	}
+}
+
+func testEstimator() (*Estimator, time.Time) {
+	m := DefaultModel()
+	m.Load = 0
+	m.Smoothing = 0
+	return NewEstimator(m), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestEstimatorHysteresis(t *testing.T) {
+	e, t0 := testEstimator()
+
+	steps := []struct {
+		voltage float64
+		percent float64
+	}{
+		{3.84, 50},
+		// A rise of less than Hysteresis while discharging is ignored.
+		{3.845, 50},
+		{3.83, 47.5},
+		// A larger rise is reported.
+		{3.85, 55},
+	}
+	for i, step := range steps {
+		est := e.Update(t0.Add(time.Duration(i)*time.Minute), step.voltage, MODE_DISCHARGING)
+		if math.Abs(est.Percent-step.percent) > 0.05 {
+			t.Errorf("step %d: Update(%gV) = %g%%, expected %g%%", i, step.voltage, est.Percent, step.percent)
+		}
+	}
+}
+
+func TestEstimatorSettle(t *testing.T) {
+	e, t0 := testEstimator()
+
+	e.Update(t0, 3.84, MODE_DISCHARGING)
+	// The charge curve reads 60% at 3.95V, reached over Settle from 50%.
+	est := e.Update(t0.Add(e.Model.Settle/2), 3.95, MODE_CHARGING)
+	if math.Abs(est.Percent-50) > 0.05 {
+		t.Errorf("Update() right after charging started = %g%%, expected 50%%", est.Percent)
+	}
+	est = e.Update(t0.Add(e.Model.Settle), 3.95, MODE_CHARGING)
+	if math.Abs(est.Percent-55) > 0.05 {
+		t.Errorf("Update() half way through settling = %g%%, expected 55%%", est.Percent)
+	}
+	est = e.Update(t0.Add(2*e.Model.Settle), 3.95, MODE_CHARGING)
+	if math.Abs(est.Percent-60) > 0.05 {
+		t.Errorf("Update() once settled = %g%%, expected 60%%", est.Percent)
+	}
+}
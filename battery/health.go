@@ -0,0 +1,316 @@
+package battery
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HEALTH_FILE = "/var/lib/pivoyager/battery-health.json"
+	// DEFAULT_CYCLE_LIFE is the number of full cycles after which a
+	// lithium battery typically retains 80% of its capacity.
+	DEFAULT_CYCLE_LIFE   = 500
+	DEFAULT_WORN         = 80
+	DEFAULT_FAULT_WINDOW = 7 * 24 * time.Hour
+	DEFAULT_FAULT_LIMIT  = 3
+	// DEEP_DISCHARGE is the charge, in percent, under which a discharge
+	// is counted as deep.
+	DEEP_DISCHARGE = 10
+	// MIN_DEPTH is the smallest discharge counted, in percent, below which
+	// the change of charge is indistinguishable from noise.
+	MIN_DEPTH = 2
+	// REFERENCE_DISCHARGES is the number of discharges over which the
+	// reference discharge rate is learned.
+	REFERENCE_DISCHARGES = 3
+)
+
+// Kinds of warnings.
+const (
+	WARNING_WORN   = "worn"
+	WARNING_CYCLES = "cycles"
+	WARNING_FAULTS = "faults"
+)
+
+// Session is a charge or a discharge in progress.
+type Session struct {
+	Mode         Mode      `json:"mode"`
+	Start        time.Time `json:"start"`
+	StartPercent float64   `json:"start_percent"`
+	MinPercent   float64   `json:"min_percent"`
+	MaxPercent   float64   `json:"max_percent"`
+}
+
+// Health is the usage history of a battery, kept across reboots.
+type Health struct {
+	Since   time.Time `json:"since"`
+	Updated time.Time `json:"updated"`
+	// Cycles is the number of equivalent full cycles: the sum of the depth
+	// of all the discharges, divided by 100%.
+	Cycles      float64 `json:"cycles"`
+	Charges     int     `json:"charges"`
+	FullCharges int     `json:"full_charges"`
+	Discharges  int     `json:"discharges"`
+	// Depths of discharge, in percent.
+	LastDepth      float64 `json:"last_depth"`
+	AverageDepth   float64 `json:"average_depth"`
+	MaxDepth       float64 `json:"max_depth"`
+	DeepDischarges int     `json:"deep_discharges"`
+	// ReferenceRate is the discharge rate learned over the first
+	// REFERENCE_DISCHARGES discharges, in percent per hour, and
+	// DischargeRate the latest one. With the same load, the rate rises as
+	// the capacity of the battery falls.
+	ReferenceRate float64 `json:"reference_rate"`
+	DischargeRate float64 `json:"discharge_rate"`
+	// Faults counts the times the charger reported a fault or an error.
+	Faults       int         `json:"faults"`
+	RecentFaults []time.Time `json:"recent_faults,omitempty"`
+	Session      *Session    `json:"session,omitempty"`
+}
+
+// LoadHealth reads a health saved by Save.
+func LoadHealth(path string) (Health, error) {
+	var h Health
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return h, err
+	}
+	err = json.Unmarshal(data, &h)
+	return h, err
+}
+
+// Save writes h to path, atomically.
+func (h Health) Save(path string) error {
+	data, err := json.MarshalIndent(&h, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Capacity estimates the remaining capacity of the battery, in percent of
+// its initial capacity. It compares the learned discharge rates if both are
+// known, and otherwise assumes that the battery loses 20% of its capacity
+// over cycleLife cycles. The source of the estimate is "rate" or "cycles".
+func (h Health) Capacity(cycleLife float64) (float64, string) {
+	if h.ReferenceRate > 0 && h.DischargeRate > 0 {
+		return math.Min(100, 100*h.ReferenceRate/h.DischargeRate), "rate"
+	}
+	if cycleLife <= 0 {
+		cycleLife = DEFAULT_CYCLE_LIFE
+	}
+	return math.Max(0, 100-20*h.Cycles/cycleLife), "cycles"
+}
+
+// Warning tells that the battery looks worn or faulty.
+type Warning struct {
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Report is the health of a battery, with its estimated capacity and the
+// resulting warnings.
+type Report struct {
+	Health
+	Capacity       float64   `json:"capacity"`
+	CapacitySource string    `json:"capacity_source"`
+	Warnings       []Warning `json:"warnings"`
+}
+
+// Tracker follows the successive estimates of the charge of a battery to
+// update its Health.
+type Tracker struct {
+	// CycleLife is the expected life of the battery, in full cycles.
+	CycleLife float64
+	// Worn is the capacity, in percent, under which the battery is worn.
+	Worn float64
+	// FaultLimit faults within FaultWindow raise a warning.
+	FaultLimit  int
+	FaultWindow time.Duration
+
+	mu      sync.Mutex
+	health  Health
+	fault   bool
+	raised  map[string]bool
+	changed bool
+}
+
+func NewTracker(h Health) *Tracker {
+	return &Tracker{
+		CycleLife:   DEFAULT_CYCLE_LIFE,
+		Worn:        DEFAULT_WORN,
+		FaultLimit:  DEFAULT_FAULT_LIMIT,
+		FaultWindow: DEFAULT_FAULT_WINDOW,
+		health:      h,
+		raised:      make(map[string]bool),
+	}
+}
+
+// SetDischargeRate records the discharge rate learned for the battery, in
+// percent per hour.
+func (tr *Tracker) SetDischargeRate(rate float64) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if rate <= 0 || rate == tr.health.DischargeRate {
+		return
+	}
+	if tr.health.ReferenceRate == 0 || tr.health.Discharges < REFERENCE_DISCHARGES {
+		tr.health.ReferenceRate = rate
+	}
+	tr.health.DischargeRate = rate
+	tr.changed = true
+}
+
+// Update adds the estimate est made at t, and whether the charger reports
+// a fault. It returns the warnings raised since the previous update.
+func (tr *Tracker) Update(t time.Time, est Estimate, fault bool) []Warning {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	h := &tr.health
+	if h.Since.IsZero() {
+		h.Since = t
+		tr.changed = true
+	}
+	if fault && !tr.fault {
+		h.Faults++
+		h.RecentFaults = append(h.RecentFaults, t)
+		tr.changed = true
+	}
+	tr.fault = fault
+	tr.pruneFaults(t)
+
+	switch est.Mode {
+	case MODE_DISCHARGING, MODE_CHARGING:
+		if h.Session != nil && h.Session.Mode != est.Mode {
+			tr.endSession()
+		}
+		if h.Session == nil {
+			h.Session = &Session{Mode: est.Mode, Start: t, StartPercent: est.Percent, MinPercent: est.Percent, MaxPercent: est.Percent}
+			if est.Mode == MODE_CHARGING {
+				h.Charges++
+			}
+			tr.changed = true
+		}
+		h.Session.MinPercent = math.Min(h.Session.MinPercent, est.Percent)
+		h.Session.MaxPercent = math.Max(h.Session.MaxPercent, est.Percent)
+	case MODE_FULL:
+		if h.Session != nil {
+			charging := h.Session.Mode == MODE_CHARGING
+			tr.endSession()
+			if charging {
+				h.FullCharges++
+			}
+		}
+	}
+	h.Updated = t
+
+	var warnings []Warning
+	raised := make(map[string]bool)
+	for _, w := range tr.warnings() {
+		if !tr.raised[w.Kind] {
+			warnings = append(warnings, w)
+		}
+		raised[w.Kind] = true
+	}
+	tr.raised = raised
+	return warnings
+}
+
+func (tr *Tracker) pruneFaults(t time.Time) {
+	h := &tr.health
+	n := 0
+	for _, f := range h.RecentFaults {
+		if t.Sub(f) < tr.FaultWindow {
+			h.RecentFaults[n] = f
+			n++
+		}
+	}
+	if n != len(h.RecentFaults) {
+		h.RecentFaults = h.RecentFaults[:n]
+		tr.changed = true
+	}
+}
+
+func (tr *Tracker) endSession() {
+	h := &tr.health
+	s := h.Session
+	h.Session = nil
+	tr.changed = true
+	if s.Mode != MODE_DISCHARGING {
+		return
+	}
+	depth := s.StartPercent - s.MinPercent
+	if depth < MIN_DEPTH {
+		return
+	}
+	h.Discharges++
+	h.Cycles = math.Round((h.Cycles+depth/100)*1000) / 1000
+	h.LastDepth = depth
+	h.AverageDepth += (depth - h.AverageDepth) / float64(h.Discharges)
+	h.MaxDepth = math.Max(h.MaxDepth, depth)
+	if s.MinPercent <= DEEP_DISCHARGE {
+		h.DeepDischarges++
+	}
+}
+
+func (tr *Tracker) warnings() []Warning {
+	var warnings []Warning
+
+	h := tr.health
+	if capacity, source := h.Capacity(tr.CycleLife); capacity < tr.Worn {
+		warnings = append(warnings, Warning{WARNING_WORN, fmt.Sprintf("The battery looks worn: its capacity is estimated at %.0f%% from its %s", capacity, source)})
+	}
+	if h.Cycles >= tr.CycleLife {
+		warnings = append(warnings, Warning{WARNING_CYCLES, fmt.Sprintf("The battery went through %.0f cycles, beyond its expected life of %.0f cycles", h.Cycles, tr.CycleLife)})
+	}
+	if len(h.RecentFaults) >= tr.FaultLimit {
+		window := tr.FaultWindow.String()
+		if days := tr.FaultWindow / (24 * time.Hour); days > 0 && tr.FaultWindow%(24*time.Hour) == 0 {
+			window = fmt.Sprintf("%d days", days)
+		}
+		warnings = append(warnings, Warning{WARNING_FAULTS, fmt.Sprintf("The battery may be faulty: the charger reported %d faults within %s", len(h.RecentFaults), window)})
+	}
+	return warnings
+}
+
+// Report returns the health of the battery, and whether it changed since
+// the last call.
+func (tr *Tracker) Report() (Report, bool) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	changed := tr.changed
+	tr.changed = false
+	return tr.report(), changed
+}
+
+func (tr *Tracker) report() Report {
+	r := Report{Health: tr.health, Warnings: tr.warnings()}
+	r.RecentFaults = append([]time.Time(nil), tr.health.RecentFaults...)
+	if s := tr.health.Session; s != nil {
+		session := *s
+		r.Session = &session
+	}
+	r.Capacity, r.CapacitySource = tr.health.Capacity(tr.CycleLife)
+	return r
+}
+
+// Latest returns the health of the battery.
+func (tr *Tracker) Latest() Report {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.report()
+}
@@ -0,0 +1,100 @@
+package battery
+
+import (
+	"testing"
+	"time"
+)
+
+type healthStep struct {
+	percent float64
+	mode    Mode
+	fault   bool
+}
+
+func track(tr *Tracker, t0 time.Time, steps []healthStep) []Warning {
+	var warnings []Warning
+	for i, s := range steps {
+		warnings = append(warnings, tr.Update(t0.Add(time.Duration(i)*time.Hour), Estimate{Percent: s.percent, Mode: s.mode}, s.fault)...)
+	}
+	return warnings
+}
+
+func TestTrackerCycles(t *testing.T) {
+	tr := NewTracker(Health{})
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	track(tr, t0, []healthStep{
+		{100, MODE_DISCHARGING, false},
+		{70, MODE_DISCHARGING, false},
+		{50, MODE_DISCHARGING, false},
+		{55, MODE_CHARGING, false},
+		{90, MODE_CHARGING, false},
+		{100, MODE_FULL, false},
+		{100, MODE_DISCHARGING, false},
+		{50, MODE_DISCHARGING, false},
+		{52, MODE_CHARGING, false},
+		// Too shallow to count.
+		{51, MODE_DISCHARGING, false},
+		{60, MODE_CHARGING, false},
+	})
+	h := tr.Latest().Health
+	if h.Cycles != 1 || h.Discharges != 2 || h.Charges != 3 || h.FullCharges != 1 {
+		t.Errorf("health = %+v, expected 1 cycle, 2 discharges, 3 charges and 1 full charge", h)
+	}
+	if h.LastDepth != 50 || h.AverageDepth != 50 || h.MaxDepth != 50 || h.DeepDischarges != 0 {
+		t.Errorf("health = %+v, expected discharges of 50%%", h)
+	}
+	if h.Session == nil || h.Session.Mode != MODE_CHARGING {
+		t.Errorf("session = %+v, expected a charge in progress", h.Session)
+	}
+	if !h.Since.Equal(t0) {
+		t.Errorf("Since = %s, expected %s", h.Since, t0)
+	}
+}
+
+func TestTrackerFaults(t *testing.T) {
+	tr := NewTracker(Health{})
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	warnings := track(tr, t0, []healthStep{
+		{80, MODE_UNKNOWN, true},
+		// Still the same fault.
+		{80, MODE_UNKNOWN, true},
+		{80, MODE_DISCHARGING, false},
+		{80, MODE_UNKNOWN, true},
+		{80, MODE_DISCHARGING, false},
+	})
+	if len(warnings) != 0 {
+		t.Errorf("warnings after 2 faults: %v", warnings)
+	}
+	warnings = tr.Update(t0.Add(10*time.Hour), Estimate{Percent: 80, Mode: MODE_UNKNOWN}, true)
+	if len(warnings) != 1 || warnings[0].Kind != WARNING_FAULTS {
+		t.Errorf("warnings after 3 faults: %v, expected %s", warnings, WARNING_FAULTS)
+	}
+	if warnings = tr.Update(t0.Add(11*time.Hour), Estimate{Percent: 80, Mode: MODE_UNKNOWN}, true); len(warnings) != 0 {
+		t.Errorf("the warning was raised twice: %v", warnings)
+	}
+	// The faults are forgotten after FaultWindow.
+	tr.Update(t0.Add(tr.FaultWindow+12*time.Hour), Estimate{Percent: 80, Mode: MODE_DISCHARGING}, false)
+	if r := tr.Latest(); r.Faults != 3 || len(r.RecentFaults) != 0 || len(r.Warnings) != 0 {
+		t.Errorf("report = %+v, expected 3 faults, none recent", r)
+	}
+}
+
+func TestHealthCapacity(t *testing.T) {
+	tests := []struct {
+		health   Health
+		capacity float64
+		source   string
+	}{
+		{Health{}, 100, "cycles"},
+		{Health{Cycles: 250}, 90, "cycles"},
+		{Health{Cycles: 250, ReferenceRate: 20, DischargeRate: 25}, 80, "rate"},
+		{Health{ReferenceRate: 20, DischargeRate: 18}, 100, "rate"},
+	}
+	for _, test := range tests {
+		if c, source := test.health.Capacity(500); c != test.capacity || source != test.source {
+			t.Errorf("Capacity(%+v) = %g (%s), expected %g (%s)", test.health, c, source, test.capacity, test.source)
+		}
+	}
+}
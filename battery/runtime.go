@@ -0,0 +1,279 @@
+package battery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_RATES_FILE = "/var/lib/pivoyager/battery-rates.json"
+	DEFAULT_WINDOW     = 15 * time.Minute
+	DEFAULT_MIN_SPAN   = 2 * time.Minute
+	DEFAULT_LEARNING   = 0.2
+	// DEFAULT_CUTOFF is the battery voltage under which the charger of the
+	// PiVoyager reports a low battery.
+	DEFAULT_CUTOFF = 3.4
+)
+
+// Rates are the charge and discharge rates learned for a battery and the
+// load of its Pi, in percent per hour. Zero means not learned yet.
+//
+// The PiVoyager does not measure the current, so the capacity of the
+// battery cannot be learned in amp hours: a rate relates the charge derived
+// from the voltage to the time it takes to drain, which covers both the
+// capacity and the load, and holds as long as the load stays about the
+// same.
+type Rates struct {
+	Discharge float64   `json:"discharge_rate"`
+	Charge    float64   `json:"charge_rate"`
+	Updated   time.Time `json:"updated"`
+}
+
+// LoadRates reads rates saved by Save.
+func LoadRates(path string) (Rates, error) {
+	var r Rates
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Save writes r to path, atomically.
+func (r Rates) Save(path string) error {
+	data, err := json.MarshalIndent(&r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Hours returns how long a full discharge lasts at the learned rate.
+func (r Rates) Hours() float64 {
+	if r.Discharge <= 0 {
+		return 0
+	}
+	return 100 / r.Discharge
+}
+
+// Remaining is the time left before the battery is empty, while
+// discharging, or full, while charging.
+type Remaining struct {
+	Mode Mode
+	// Rate is how fast the charge changes, in percent per hour, negative
+	// while discharging. It is zero if unknown.
+	Rate        float64
+	TimeToEmpty time.Duration
+	TimeToFull  time.Duration
+	// Source is "fit" if the rate was fitted on recent estimates, "learned"
+	// if it comes from the learned rates, "mixed" for a blend of both, and
+	// empty if unknown.
+	Source string
+}
+
+type remainingJSON struct {
+	Mode        Mode    `json:"mode"`
+	Rate        float64 `json:"rate"`
+	TimeToEmpty int64   `json:"time_to_empty,omitempty"`
+	TimeToFull  int64   `json:"time_to_full,omitempty"`
+	Source      string  `json:"source,omitempty"`
+}
+
+// MarshalJSON encodes the durations in seconds, and omits them when
+// unknown.
+func (r Remaining) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&remainingJSON{
+		Mode:        r.Mode,
+		Rate:        math.Round(r.Rate*100) / 100,
+		TimeToEmpty: int64(r.TimeToEmpty / time.Second),
+		TimeToFull:  int64(r.TimeToFull / time.Second),
+		Source:      r.Source,
+	})
+}
+
+func (r *Remaining) UnmarshalJSON(data []byte) error {
+	var j remainingJSON
+
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	*r = Remaining{j.Mode, j.Rate, time.Duration(j.TimeToEmpty) * time.Second, time.Duration(j.TimeToFull) * time.Second, j.Source}
+	return nil
+}
+
+type point struct {
+	t       time.Time
+	percent float64
+}
+
+// Runtime estimates the time left from successive charge estimates: it
+// fits the rate of change of the charge over a sliding window, falling back
+// on learned rates while the window is too short, and learns the rates
+// from each full window.
+type Runtime struct {
+	Rates Rates
+	// Window is the period over which the rate is fitted.
+	Window time.Duration
+	// MinSpan is the shortest period over which a rate is fitted.
+	MinSpan time.Duration
+	// Learning is the weight of each new fit in the learned rates.
+	Learning float64
+	// Reserve is the charge, in percent, at which the battery is
+	// considered empty, usually Model.Reserve(DEFAULT_CUTOFF).
+	Reserve float64
+
+	mu      sync.Mutex
+	mode    Mode
+	points  []point
+	learned time.Time
+	changed bool
+}
+
+func NewRuntime(rates Rates) *Runtime {
+	return &Runtime{
+		Rates:    rates,
+		Window:   DEFAULT_WINDOW,
+		MinSpan:  DEFAULT_MIN_SPAN,
+		Learning: DEFAULT_LEARNING,
+		Reserve:  DefaultModel().Reserve(DEFAULT_CUTOFF),
+	}
+}
+
+// fit returns the slope of the least squares line through points, in
+// percent per hour.
+func fit(points []point) float64 {
+	var st, sp, stt, stp float64
+
+	n := float64(len(points))
+	t0 := points[0].t
+	for _, p := range points {
+		t := p.t.Sub(t0).Hours()
+		st += t
+		sp += p.percent
+		stt += t * t
+		stp += t * p.percent
+	}
+	d := n*stt - st*st
+	if d == 0 {
+		return 0
+	}
+	return (n*stp - st*sp) / d
+}
+
+// Update adds the estimate est made at t, and returns the time left.
+func (r *Runtime) Update(t time.Time, est Estimate) Remaining {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if est.Mode != r.mode {
+		r.mode = est.Mode
+		r.points = r.points[:0]
+		r.learned = t
+	}
+	r.points = append(r.points, point{t, est.Percent})
+	for len(r.points) > 2 && t.Sub(r.points[1].t) >= r.Window {
+		r.points = r.points[1:]
+	}
+	return r.remaining(t, est)
+}
+
+func (r *Runtime) remaining(t time.Time, est Estimate) Remaining {
+	rem := Remaining{Mode: est.Mode}
+
+	var learned float64
+	switch est.Mode {
+	case MODE_DISCHARGING:
+		learned = -r.Rates.Discharge
+	case MODE_CHARGING:
+		learned = r.Rates.Charge
+	default:
+		return rem
+	}
+
+	span := t.Sub(r.points[0].t)
+	fitted := 0.0
+	if span >= r.MinSpan {
+		fitted = fit(r.points)
+		// Only a rate in the direction of the charge makes sense.
+		if fitted*learned < 0 || (learned == 0 && (fitted < 0) != (est.Mode == MODE_DISCHARGING)) {
+			fitted = 0
+		}
+	}
+	if fitted != 0 && span >= r.Window && t.Sub(r.learned) >= r.Window {
+		r.learn(t, est.Mode, fitted)
+	}
+
+	switch {
+	case fitted != 0 && learned != 0 && span < r.Window:
+		w := float64(span) / float64(r.Window)
+		rem.Rate = w*fitted + (1-w)*learned
+		rem.Source = "mixed"
+	case fitted != 0:
+		rem.Rate = fitted
+		rem.Source = "fit"
+	case learned != 0:
+		rem.Rate = learned
+		rem.Source = "learned"
+	default:
+		return rem
+	}
+
+	hours := func(h float64) time.Duration {
+		return time.Duration(math.Max(0, h) * float64(time.Hour)).Round(time.Second)
+	}
+	if rem.Rate < 0 {
+		rem.TimeToEmpty = hours((est.Percent - r.Reserve) / -rem.Rate)
+	} else {
+		rem.TimeToFull = hours((100 - est.Percent) / rem.Rate)
+	}
+	return rem
+}
+
+func (r *Runtime) learn(t time.Time, mode Mode, rate float64) {
+	rate = math.Abs(rate)
+	learned := &r.Rates.Charge
+	if mode == MODE_DISCHARGING {
+		learned = &r.Rates.Discharge
+	}
+	if *learned == 0 {
+		*learned = rate
+	} else {
+		*learned += r.Learning * (rate - *learned)
+	}
+	r.Rates.Updated = t
+	r.learned = t
+	r.changed = true
+}
+
+// LearnedRates returns the learned rates, and whether they changed since
+// the last call.
+func (r *Runtime) LearnedRates() (Rates, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := r.changed
+	r.changed = false
+	return r.Rates, changed
+}
+
+// Predict returns the time left at the learned rates, for a single
+// estimate.
+func (r Rates) Predict(est Estimate, reserve float64) Remaining {
+	rt := NewRuntime(r)
+	rt.Reserve = reserve
+	rt.points = []point{{time.Time{}, est.Percent}}
+	return rt.remaining(time.Time{}, est)
+}
@@ -0,0 +1,97 @@
+package battery
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestFit(t *testing.T) {
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	var points []point
+	for i := 0; i < 10; i++ {
+		points = append(points, point{t0.Add(time.Duration(i) * 6 * time.Minute), 80 - 2*float64(i)})
+	}
+	if rate := fit(points); math.Abs(rate+20) > 1e-9 {
+		t.Errorf("fit() = %g%%/h, expected -20%%/h", rate)
+	}
+	if rate := fit(points[:1]); rate != 0 {
+		t.Errorf("fit() of a single point = %g, expected 0", rate)
+	}
+}
+
+func TestRuntimeUpdate(t *testing.T) {
+	r := NewRuntime(Rates{})
+	r.Reserve = 5
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var rem Remaining
+	percent := 80.0
+	for d := time.Duration(0); d <= 20*time.Minute; d += 30 * time.Second {
+		percent = 80 - 20*d.Hours()
+		rem = r.Update(t0.Add(d), Estimate{Percent: percent, Mode: MODE_DISCHARGING})
+		if d < r.MinSpan && rem.Rate != 0 {
+			t.Fatalf("Update() fitted a rate over %s", d)
+		}
+	}
+	if math.Abs(rem.Rate+20) > 1e-6 || rem.Source != "fit" {
+		t.Errorf("Update() rate = %g%%/h (%s), expected -20%%/h (fit)", rem.Rate, rem.Source)
+	}
+	expected := time.Duration((percent - 5) / 20 * float64(time.Hour))
+	if d := rem.TimeToEmpty - expected; d < -time.Second || d > time.Second {
+		t.Errorf("TimeToEmpty = %s, expected %s", rem.TimeToEmpty, expected)
+	}
+
+	rates, changed := r.LearnedRates()
+	if !changed || math.Abs(rates.Discharge-20) > 1e-6 {
+		t.Errorf("LearnedRates() = %+v, %v, expected a discharge rate of 20%%/h", rates, changed)
+	}
+	if _, changed := r.LearnedRates(); changed {
+		t.Errorf("LearnedRates() changed twice")
+	}
+}
+
+func TestRuntimeModeChange(t *testing.T) {
+	r := NewRuntime(Rates{Discharge: 10, Charge: 40})
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for d := time.Duration(0); d <= 10*time.Minute; d += time.Minute {
+		r.Update(t0.Add(d), Estimate{Percent: 60 - d.Hours()*30, Mode: MODE_DISCHARGING})
+	}
+	// The discharge points are not fitted once charging.
+	rem := r.Update(t0.Add(11*time.Minute), Estimate{Percent: 70, Mode: MODE_CHARGING})
+	if rem.Rate != 40 || rem.Source != "learned" || rem.TimeToFull != 45*time.Minute {
+		t.Errorf("Update() after charging started = %+v, expected the learned rate", rem)
+	}
+}
+
+func TestPredict(t *testing.T) {
+	rates := Rates{Discharge: 25, Charge: 50}
+
+	rem := rates.Predict(Estimate{Percent: 55, Mode: MODE_DISCHARGING}, 5)
+	if rem.TimeToEmpty != 2*time.Hour || rem.Rate != -25 || rem.Source != "learned" {
+		t.Errorf("Predict(discharging) = %+v, expected 2h to empty", rem)
+	}
+	rem = rates.Predict(Estimate{Percent: 50, Mode: MODE_CHARGING}, 5)
+	if rem.TimeToFull != time.Hour {
+		t.Errorf("Predict(charging) = %+v, expected 1h to full", rem)
+	}
+	rem = Rates{}.Predict(Estimate{Percent: 50, Mode: MODE_DISCHARGING}, 5)
+	if rem.Rate != 0 || rem.TimeToEmpty != 0 || rem.Source != "" {
+		t.Errorf("Predict() without rates = %+v, expected nothing", rem)
+	}
+}
+
+func TestModelReserve(t *testing.T) {
+	m := DefaultModel()
+	m.Load = 0
+
+	// Between 3.27V at 0% and 3.61V at 5%.
+	if r := m.Reserve(3.4); math.Abs(r-5*0.13/0.34) > 1e-9 {
+		t.Errorf("Reserve(3.4) = %g, expected %g", r, 5*0.13/0.34)
+	}
+	m.Load = 0.5
+	if r := m.Reserve(3.4); math.Abs(r-5*0.18/0.34) > 1e-9 {
+		t.Errorf("Reserve(3.4) under load = %g, expected %g", r, 5*0.18/0.34)
+	}
+}
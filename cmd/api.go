@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/api"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readToken returns the API token from the file at path, if not empty, or
+// from PIVOYAGER_API_TOKEN.
+func readToken(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("PIVOYAGER_API_TOKEN"), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// cmd_api serves the HTTP API until SIGINT or SIGTERM.
+func cmd_api(dev *device.Device, args []string) error {
+	flags := flag.NewFlagSet("api", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	listen := flags.String("listen", api.DEFAULT_ADDRESS, "unix:<path> or TCP address of the API")
+	mode := flags.String("socket-mode", strconv.FormatUint(api.DEFAULT_SOCKET_MODE, 8), "permissions of the unix socket, in octal")
+	tokenFile := flags.String("token-file", "", "file containing the bearer token required from clients (default env PIVOYAGER_API_TOKEN)")
+	if err := flags.Parse(args[1:]); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("api: %w", err))
+	}
+	if flags.NArg() != 0 {
+		fail(EXIT_USAGE, fmt.Errorf("api: unexpected argument '%s'", flags.Arg(0)))
+	}
+	perm, err := strconv.ParseUint(*mode, 8, 32)
+	if err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("api: invalid socket mode '%s'", *mode))
+	}
+	token, err := readToken(*tokenFile)
+	if err != nil {
+		return err
+	}
+
+	model, err := batteryModel()
+	if err != nil {
+		return err
+	}
+	srv := api.New(dev, token)
+	srv.Battery = model
+	srv.Rates, _ = loadRates(battery.DEFAULT_RATES_FILE)
+	srv.HealthFile = battery.DEFAULT_HEALTH_FILE
+	srv.Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := srv.ListenAndServe(ctx, *listen, os.FileMode(perm)); err != nil {
+		return err
+	}
+	return output(OK)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+)
+
+const CALIBRATION_SAMPLES = 32
+
+type calibrateResult struct {
+	File        string                `json:"file"`
+	Calibration device.Calibration    `json:"calibration"`
+	Voltage     device.VoltageReading `json:"voltage"`
+	Saved       bool                  `json:"saved"`
+}
+
+func (r *calibrateResult) WriteText(w io.Writer) {
+	c := r.Calibration
+	fmt.Fprintf(w, "Calibration: gain %.4f, offset %+.3fV, from %d point(s)\n", c.Gain, c.Offset, len(c.Points))
+	fmt.Fprintf(w, "VBat: %.3fV (uncalibrated %.3fV)\n", r.Voltage.VBat, r.Voltage.Uncalibrated)
+	fmt.Fprintf(w, "ADC: %s, median of %d readings\n", r.Voltage.Raw, r.Voltage.Samples)
+	if r.Saved {
+		fmt.Fprintf(w, "Saved to %s\n", r.File)
+	}
+}
+
+// cmd_calibrate corrects the battery voltage of the board against a
+// voltage measured with a multimeter on the battery terminals.
+func cmd_calibrate(dev *device.Device, args []string) error {
+	flags := flag.NewFlagSet("calibrate", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	samples := flags.Int("samples", CALIBRATION_SAMPLES, "ADC readings combined for the calibration")
+	if len(args) < 2 || args[1] != "voltage" {
+		fail(EXIT_USAGE, fmt.Errorf("calibrate: expected 'calibrate voltage [<measured-volts>|reset]'"))
+	}
+	if err := flags.Parse(args[2:]); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("calibrate: %w", err))
+	}
+	if flags.NArg() > 1 {
+		fail(EXIT_USAGE, fmt.Errorf("calibrate: unexpected argument '%s'", flags.Arg(1)))
+	}
+	sampling := device.Sampling{Samples: *samples, Interval: 20 * time.Millisecond, Filter: device.FILTER_MEDIAN}
+	if err := sampling.Validate(); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("calibrate: %w", err))
+	}
+	if calibrationFile == "" {
+		fail(EXIT_USAGE, fmt.Errorf("calibrate: no calibration file, see -calibration"))
+	}
+
+	var err error
+
+	res := calibrateResult{File: calibrationFile}
+	cal := device.DefaultCalibration()
+	// The calibration is not loaded when resetting, as it may be invalid.
+	if flags.Arg(0) == "reset" {
+		if err := os.Remove(calibrationFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if cal, err = loadCalibration(); err != nil {
+		return fmt.Errorf("%w, reset it with 'pivoyager calibrate voltage reset'", err)
+	}
+
+	dev.SetSampling(sampling)
+	dev.SetCalibration(cal)
+	if res.Voltage, err = dev.ReadVoltage(); err != nil {
+		return err
+	}
+
+	if arg := flags.Arg(0); arg != "" && arg != "reset" {
+		measured, err := strconv.ParseFloat(arg, 64)
+		if err != nil || measured <= 0 {
+			fail(EXIT_USAGE, fmt.Errorf("calibrate: invalid voltage '%s'", arg))
+		}
+		point := device.CalibrationPoint{
+			Measured: measured,
+			Read:     float64(res.Voltage.Uncalibrated),
+			Time:     time.Now().UTC(),
+		}
+		if err := cal.AddPoint(point); err != nil {
+			return err
+		}
+		if err := cal.Save(calibrationFile); err != nil {
+			return err
+		}
+		res.Voltage.VBat = float32(cal.Apply(point.Read))
+		res.Saved = true
+	}
+	res.Calibration = cal
+	return output(&res)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"github.com/omzlo/pivoyager/daemon"
+	"github.com/omzlo/pivoyager/device"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// loadDaemonConfig reads the configuration file at path, or the default
+// configuration file if path is empty. A missing default configuration
+// file is not an error.
+func loadDaemonConfig(path string) (*daemon.Config, error) {
+	if path != "" {
+		return daemon.LoadConfig(path)
+	}
+	cfg, err := daemon.LoadConfig(daemon.DEFAULT_CONFIG_PATH)
+	if os.IsNotExist(err) {
+		return daemon.DefaultConfig(), nil
+	}
+	return cfg, err
+}
+
+// startDaemon runs a daemon configured by cfg. If prev is not nil, the new
+// daemon resumes from its state.
+func startDaemon(dev *device.Device, cfg *daemon.Config, logger *log.Logger, prev *daemon.Daemon) (*daemon.Daemon, context.CancelFunc, <-chan error, error) {
+	d, err := daemon.New(dev, cfg, logger)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d.Version = PIVOYAGER_VERSION
+	if prev != nil {
+		d.Resume(prev)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run(ctx)
+	}()
+	return d, cancel, done, nil
+}
+
+// cmd_daemon runs the daemon until SIGINT or SIGTERM. SIGHUP reloads the
+// configuration file and restarts the daemon, unless the new configuration
+// is invalid.
+func cmd_daemon(dev *device.Device, args []string) error {
+	var path string
+
+	args = assert_argc(args, 0, 1)
+	if len(args) == 1 {
+		path = args[0]
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	cfg, err := loadDaemonConfig(path)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	d, cancel, done, err := startDaemon(dev, cfg, logger, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		select {
+		case err := <-done:
+			cancel()
+			return err
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logger.Printf("Received %s, stopping", sig)
+				cancel()
+				return <-done
+			}
+			newCfg, err := loadDaemonConfig(path)
+			if err != nil {
+				logger.Printf("Not reloading configuration: %s", err)
+				continue
+			}
+			logger.Printf("Reloading configuration")
+			cancel()
+			if err := <-done; err != nil {
+				return err
+			}
+			if d, cancel, done, err = startDaemon(dev, newCfg, logger, d); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/exporter"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// cmd_exporter serves Prometheus metrics until SIGINT or SIGTERM.
+func cmd_exporter(dev *device.Device, args []string) error {
+	flags := flag.NewFlagSet("exporter", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	listen := flags.String("listen", exporter.DEFAULT_ADDRESS, "TCP address serving /metrics")
+	if err := flags.Parse(args[1:]); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("exporter: %w", err))
+	}
+	if flags.NArg() != 0 {
+		fail(EXIT_USAGE, fmt.Errorf("exporter: unexpected argument '%s'", flags.Arg(0)))
+	}
+
+	e := exporter.New(dev, PIVOYAGER_VERSION)
+	e.Logger = log.New(os.Stderr, "", log.LstdFlags)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := e.ListenAndServe(ctx, *listen); err != nil {
+		return err
+	}
+	return output(OK)
+}
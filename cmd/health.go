@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+type healthResult struct {
+	battery.Report
+}
+
+func (r *healthResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Tracked since: %s, updated %s\n", r.Since.Local().Format(time.RFC3339), r.Updated.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "Cycles: %.1f full cycles, %d charges (%d to full), %d discharges\n", r.Cycles, r.Charges, r.FullCharges, r.Discharges)
+	if r.Discharges > 0 {
+		fmt.Fprintf(w, "Depth of discharge: last %.0f%%, average %.0f%%, max %.0f%%, %d below %d%%\n", r.LastDepth, r.AverageDepth, r.MaxDepth, r.DeepDischarges, battery.DEEP_DISCHARGE)
+	}
+	if s := r.Session; s != nil {
+		fmt.Fprintf(w, "In progress: %s since %s, from %.0f%%\n", s.Mode, s.Start.Local().Format(time.RFC3339), s.StartPercent)
+	}
+	fmt.Fprintf(w, "Capacity: %.0f%% of initial (from %s)\n", r.Capacity, r.CapacitySource)
+	if r.DischargeRate > 0 {
+		fmt.Fprintf(w, "Discharge rate: %.1f%%/h, initially %.1f%%/h\n", r.DischargeRate, r.ReferenceRate)
+	}
+	fmt.Fprintf(w, "Faults: %d, %d recent\n", r.Faults, len(r.RecentFaults))
+	if len(r.Warnings) == 0 {
+		fmt.Fprintln(w, "Health: good")
+		return
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning.Message)
+	}
+}
+
+// cmd_health shows the health of the battery tracked by the daemon. It does
+// not use the device, which is nil.
+func cmd_health(dev *device.Device, args []string) error {
+	flags := flag.NewFlagSet("health", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	path := flags.String("file", battery.DEFAULT_HEALTH_FILE, "battery health saved by the daemon")
+	cycleLife := flags.Float64("cycle-life", battery.DEFAULT_CYCLE_LIFE, "expected life of the battery, in full cycles")
+	worn := flags.Float64("worn", battery.DEFAULT_WORN, "capacity, in percent, under which the battery is worn")
+	if err := flags.Parse(args[1:]); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("health: %w", err))
+	}
+	if flags.NArg() != 0 {
+		fail(EXIT_USAGE, fmt.Errorf("health: unexpected argument '%s'", flags.Arg(0)))
+	}
+	if *cycleLife <= 0 {
+		fail(EXIT_USAGE, fmt.Errorf("health: cycle life must be positive"))
+	}
+
+	h, err := battery.LoadHealth(*path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("No battery health in %s, it is tracked by the daemon", *path)
+		}
+		return err
+	}
+	tr := battery.NewTracker(h)
+	tr.CycleLife = *cycleLife
+	tr.Worn = *worn
+	return output(&healthResult{tr.Latest()})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/history"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+type historyResult struct {
+	Records []history.Record `json:"records"`
+}
+
+func (r *historyResult) WriteText(w io.Writer) {
+	for _, rec := range r.Records {
+		event := rec.Event
+		if event == "" {
+			event = "sample"
+		}
+		if !rec.HasReading() {
+			fmt.Fprintf(w, "%s  %-15s  %s\n", rec.Time.Local().Format(time.RFC3339), event, rec.Message)
+			continue
+		}
+		power := "battery"
+		if rec.USBPower {
+			power = "usb"
+		}
+		fmt.Fprintf(w, "%s  %-15s  %-7s  %-15s  %.2fV  %3.0f%%\n", rec.Time.Local().Format(time.RFC3339), event, power, rec.Charger, rec.VBat, rec.Charge)
+	}
+}
+
+type outagesResult struct {
+	Outages []history.Outage `json:"outages"`
+}
+
+func (r *outagesResult) WriteText(w io.Writer) {
+	if len(r.Outages) == 0 {
+		fmt.Fprintln(w, "No outages")
+		return
+	}
+	var total time.Duration
+	for _, o := range r.Outages {
+		duration := time.Duration(o.Duration * float64(time.Second))
+		total += duration
+		ended := "power restored"
+		switch o.Ended {
+		case history.ENDED_ONGOING:
+			ended = "ongoing"
+		case history.ENDED_STOPPED:
+			ended = "log stopped"
+		}
+		if o.LowBattery {
+			ended += ", low battery"
+		}
+		fmt.Fprintf(w, "%s - %s  %10s  min %.2fV %3.0f%%  %s\n", o.Start.Local().Format(time.RFC3339), o.End.Local().Format(time.RFC3339), duration, o.MinVoltage, o.MinCharge, ended)
+	}
+	fmt.Fprintf(w, "%d outage(s), %s on battery\n", len(r.Outages), total)
+}
+
+type timeValue struct {
+	t *time.Time
+}
+
+func (v timeValue) String() string {
+	if v.t == nil || v.t.IsZero() {
+		return ""
+	}
+	return v.t.Format(time.RFC3339)
+}
+
+// Set accepts an RFC3339 time, or a date or a date and time in the local
+// time zone.
+func (v timeValue) Set(s string) error {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		*v.t = t
+		return nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			*v.t = t
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time '%s'", s)
+}
+
+// cmd_history queries the history logged by the daemon. It does not use
+// the device, which is nil.
+func cmd_history(dev *device.Device, args []string) error {
+	var from, to time.Time
+
+	action := "list"
+	args = args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action = args[0]
+		args = args[1:]
+	}
+	switch action {
+	case "list", "outages", "export":
+	default:
+		fail(EXIT_USAGE, fmt.Errorf("history: unknown action '%s', expected 'list', 'outages' or 'export'", action))
+	}
+
+	flags := flag.NewFlagSet("history", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	path := flags.String("file", history.DEFAULT_PATH, "history log file")
+	flags.Var(timeValue{&from}, "from", "start of the range")
+	flags.Var(timeValue{&to}, "to", "end of the range")
+	since := flags.Duration("since", 0, "start the range this long ago")
+	events := flags.Bool("events", false, "only list events, not periodic samples")
+	maxGap := flags.Duration("gap", history.DEFAULT_MAX_GAP, "time without records after which an outage is considered interrupted")
+	as := flags.String("as", "csv", "export format: 'csv' or 'jsonl'")
+	outages := flags.Bool("outages", false, "export outages instead of records")
+	if err := flags.Parse(args); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("history: %w", err))
+	}
+	if flags.NArg() != 0 {
+		fail(EXIT_USAGE, fmt.Errorf("history: unexpected argument '%s'", flags.Arg(0)))
+	}
+	if *as != "csv" && *as != "jsonl" {
+		fail(EXIT_USAGE, fmt.Errorf("history: unknown export format '%s'", *as))
+	}
+	if *since > 0 {
+		from = time.Now().Add(-*since)
+	}
+
+	if _, err := os.Stat(*path); err != nil {
+		if files, _ := history.Files(*path); len(files) == 0 {
+			return fmt.Errorf("No history in %s, enable the history section of the daemon", *path)
+		}
+	}
+	records, err := history.ReadAll(*path, from, to)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case action == "outages":
+		return output(&outagesResult{history.Outages(records, *maxGap)})
+	case action == "export" && *outages:
+		found := history.Outages(records, *maxGap)
+		if *as == "csv" {
+			return history.WriteOutagesCSV(os.Stdout, found)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for i := range found {
+			if err := enc.Encode(&found[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case action == "export":
+		if *as == "csv" {
+			return history.WriteCSV(os.Stdout, records)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for i := range records {
+			if err := enc.Encode(&records[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if *events {
+		filtered := records[:0]
+		for _, r := range records {
+			if r.Event != "" {
+				filtered = append(filtered, r)
+			}
+		}
+		records = filtered
+	}
+	return output(&historyResult{records})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/i2c"
+	"github.com/omzlo/pivoyager/trace"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Global options, shared by all commands.
+ * Each option can be set on the command line, before the command name, or
+ * through an environment variable.
+ */
+
+type addressValue byte
+
+func (a *addressValue) String() string {
+	return fmt.Sprintf("0x%02x", byte(*a))
+}
+
+func (a *addressValue) Set(s string) error {
+	v, err := strconv.ParseUint(s, 0, 7)
+	if err != nil {
+		return fmt.Errorf("Invalid i2c address '%s'", s)
+	}
+	*a = addressValue(v)
+	return nil
+}
+
+type envOption struct {
+	Flag string
+	Env  string
+}
+
+var envOptions = []envOption{
+	{"bus", "PIVOYAGER_I2C_BUS"},
+	{"address", "PIVOYAGER_I2C_ADDRESS"},
+	{"device", "PIVOYAGER_I2C_DEVICE"},
+	{"retries", "PIVOYAGER_I2C_RETRIES"},
+	{"retry-delay", "PIVOYAGER_I2C_RETRY_DELAY"},
+	{"lock", "PIVOYAGER_LOCK"},
+	{"trace", "PIVOYAGER_TRACE"},
+	{"replay", "PIVOYAGER_REPLAY"},
+	{"format", "PIVOYAGER_FORMAT"},
+	{"battery", "PIVOYAGER_BATTERY"},
+	{"calibration", "PIVOYAGER_CALIBRATION"},
+	{"voltage-samples", "PIVOYAGER_VOLTAGE_SAMPLES"},
+	{"voltage-filter", "PIVOYAGER_VOLTAGE_FILTER"},
+}
+
+var (
+	traceFile        string
+	replayFile       string
+	batteryChemistry string
+	calibrationFile  string
+)
+
+type filterValue device.Filter
+
+func (f *filterValue) String() string {
+	return string(*f)
+}
+
+func (f *filterValue) Set(s string) error {
+	return (*device.Filter)(f).UnmarshalText([]byte(s))
+}
+
+var globalFlags = flag.NewFlagSet("pivoyager", flag.ContinueOnError)
+
+func parseGlobalOptions(args []string) (device.Options, []string, error) {
+	opts := device.DefaultOptions()
+	address := addressValue(opts.Address)
+	format := formatValue(FORMAT_TEXT)
+	filter := filterValue(opts.Sampling.Filter)
+	var jsonFormat bool
+
+	globalFlags.Usage = func() {}
+	globalFlags.SetOutput(ioutil.Discard)
+	globalFlags.IntVar(&opts.BusNumber, "bus", opts.BusNumber, "i2c bus number, i.e. /dev/i2c-<bus> (env PIVOYAGER_I2C_BUS)")
+	globalFlags.Var(&address, "address", "i2c address of the PiVoyager (env PIVOYAGER_I2C_ADDRESS)")
+	globalFlags.StringVar(&opts.DevicePath, "device", "", "i2c device node, overrides -bus (env PIVOYAGER_I2C_DEVICE)")
+	globalFlags.IntVar(&opts.Retry.Attempts, "retries", opts.Retry.Attempts, "attempts for each i2c transaction, 1 disables retries (env PIVOYAGER_I2C_RETRIES)")
+	globalFlags.StringVar(&opts.LockPath, "lock", opts.LockPath, "lock file shared by all processes using the PiVoyager, empty to disable (env PIVOYAGER_LOCK)")
+	globalFlags.StringVar(&traceFile, "trace", "", "append a trace of all i2c transactions to this file (env PIVOYAGER_TRACE)")
+	globalFlags.StringVar(&replayFile, "replay", "", "replay i2c transactions from this trace file instead of using the bus (env PIVOYAGER_REPLAY)")
+	globalFlags.DurationVar(&opts.Retry.Delay, "retry-delay", opts.Retry.Delay, "delay before retrying an i2c transaction (env PIVOYAGER_I2C_RETRY_DELAY)")
+	globalFlags.Var(&format, "format", "output format: 'text', 'json' or 'env' (env PIVOYAGER_FORMAT)")
+	globalFlags.BoolVar(&jsonFormat, "json", false, "same as -format=json")
+	globalFlags.StringVar(&calibrationFile, "calibration", device.DEFAULT_CALIBRATION_FILE, "voltage calibration file of the board, written by 'calibrate voltage' (env PIVOYAGER_CALIBRATION)")
+	globalFlags.IntVar(&opts.Sampling.Samples, "voltage-samples", opts.Sampling.Samples, "ADC readings combined for each voltage reading (env PIVOYAGER_VOLTAGE_SAMPLES)")
+	globalFlags.Var(&filter, "voltage-filter", "how ADC readings are combined: 'median' or 'mean' (env PIVOYAGER_VOLTAGE_FILTER)")
+	globalFlags.StringVar(&batteryChemistry, "battery", battery.DEFAULT_CHEMISTRY, "battery chemistry, 'lipo' or 'li-ion', to estimate the charge (env PIVOYAGER_BATTERY)")
+
+	for _, o := range envOptions {
+		if v, ok := os.LookupEnv(o.Env); ok {
+			if err := globalFlags.Set(o.Flag, v); err != nil {
+				return opts, nil, fmt.Errorf("Invalid value '%s' for %s: %s", v, o.Env, err)
+			}
+		}
+	}
+	if err := globalFlags.Parse(args); err != nil {
+		return opts, nil, err
+	}
+	opts.Address = byte(address)
+	opts.Sampling.Filter = device.Filter(filter)
+	if err := opts.Sampling.Validate(); err != nil {
+		return opts, nil, err
+	}
+	outputFormat = string(format)
+	if jsonFormat {
+		outputFormat = FORMAT_JSON
+	}
+	return opts, globalFlags.Args(), nil
+}
+
+func printGlobalOptions() {
+	fmt.Println("Global options are:")
+	globalFlags.SetOutput(os.Stdout)
+	globalFlags.PrintDefaults()
+}
+
+// loadCalibration returns the voltage calibration of the board, or the
+// default calibration if there is none.
+func loadCalibration() (device.Calibration, error) {
+	if calibrationFile == "" {
+		return device.DefaultCalibration(), nil
+	}
+	cal, err := device.LoadCalibration(calibrationFile)
+	if err != nil && os.IsNotExist(err) {
+		return device.DefaultCalibration(), nil
+	}
+	return cal, err
+}
+
+// openDevice opens the PiVoyager, replaying or tracing i2c transactions if
+// requested.
+func openDevice(opts device.Options) (*device.Device, error) {
+	var bus device.Bus
+
+	if replayFile != "" {
+		rp, err := trace.LoadReplayer(replayFile)
+		if err != nil {
+			return nil, err
+		}
+		bus = rp
+		// A replayed device is never shared with other processes.
+		opts.LockPath = ""
+	}
+	if traceFile != "" {
+		if bus == nil {
+			b, err := i2c.Open(opts.Path())
+			if err != nil {
+				return nil, err
+			}
+			bus = b
+		}
+		f, err := os.OpenFile(traceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			bus.Close()
+			return nil, err
+		}
+		fmt.Fprintf(f, "# pivoyager %s, trace started %s: %s\n", PIVOYAGER_VERSION, time.Now().UTC().Format(time.RFC3339), strings.Join(os.Args[1:], " "))
+		bus = trace.NewRecorder(bus, f)
+	}
+	opts.Transport = bus
+	return device.OpenWithOptions(opts)
+}
+
+// batteryModel returns the model estimating the state of charge of the
+// battery selected with -battery.
+func batteryModel() (*battery.Model, error) {
+	chem, err := battery.Lookup(batteryChemistry)
+	if err != nil {
+		return nil, err
+	}
+	m := battery.DefaultModel()
+	m.Chemistry = chem
+	return m, nil
+}
+
+// loadRates returns the battery rates saved in path by the daemon, or zero
+// rates if there are none yet.
+func loadRates(path string) (battery.Rates, error) {
+	rates, err := battery.LoadRates(path)
+	if err != nil && os.IsNotExist(err) {
+		return battery.Rates{}, nil
+	}
+	return rates, err
+}
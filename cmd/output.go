@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+/* Output formats.
+ * Each command returns a Result, which is printed as human readable text,
+ * as a JSON object or as shell variable assignments.
+ */
+
+const (
+	FORMAT_TEXT = "text"
+	FORMAT_JSON = "json"
+	FORMAT_ENV  = "env"
+)
+
+// Exit codes
+const (
+	EXIT_OK      = 0
+	EXIT_ERROR   = 1 // the command failed
+	EXIT_USAGE   = 2 // invalid command line
+	EXIT_CONNECT = 3 // the PiVoyager could not be reached
+)
+
+var outputFormat = FORMAT_TEXT
+
+type formatValue string
+
+func (f *formatValue) String() string {
+	return string(*f)
+}
+
+func (f *formatValue) Set(s string) error {
+	switch s {
+	case FORMAT_TEXT, FORMAT_JSON, FORMAT_ENV:
+		*f = formatValue(s)
+		return nil
+	}
+	return fmt.Errorf("Unknown output format '%s', expected 'text', 'json' or 'env'", s)
+}
+
+type Result interface {
+	WriteText(w io.Writer)
+}
+
+type okResult struct {
+	OK bool `json:"ok"`
+}
+
+func (r okResult) WriteText(w io.Writer) {
+	fmt.Fprintln(w, "OK")
+}
+
+var OK = okResult{true}
+
+type errorResult struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func (r errorResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Error: %s\n", r.Error)
+}
+
+func output(r Result) error {
+	return writeResult(os.Stdout, r)
+}
+
+func writeResult(w io.Writer, r Result) error {
+	switch outputFormat {
+	case FORMAT_JSON:
+		return json.NewEncoder(w).Encode(r)
+	case FORMAT_ENV:
+		return writeEnv(w, r)
+	}
+	r.WriteText(w)
+	return nil
+}
+
+// fail reports err in the selected output format and exits with code.
+// Errors are written to stderr in text mode and to stdout otherwise, so
+// that scripts always get a parsable answer.
+func fail(code int, err error) {
+	r := errorResult{err.Error(), code}
+	if outputFormat == FORMAT_TEXT {
+		r.WriteText(os.Stderr)
+	} else {
+		writeResult(os.Stdout, r)
+	}
+	os.Exit(code)
+}
+
+// usageError is returned by a command for an invalid command line, so that
+// main exits with EXIT_USAGE once the device is closed.
+type usageError struct {
+	err error
+}
+
+func (e usageError) Error() string {
+	return e.err.Error()
+}
+
+func (e usageError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code of a command that failed with err.
+func exitCode(err error) int {
+	var usage usageError
+	if errors.As(err, &usage) {
+		return EXIT_USAGE
+	}
+	return EXIT_ERROR
+}
+
+// writeEnv flattens the JSON form of r into PIVOYAGER_* assignments, one
+// per line, that can be evaluated by a POSIX shell.
+func writeEnv(w io.Writer, r Result) error {
+	var tree interface{}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&tree); err != nil {
+		return err
+	}
+	vars := make(map[string]string)
+	flatten(vars, "PIVOYAGER", tree)
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s=%s\n", k, shellQuote(vars[k]))
+	}
+	return nil
+}
+
+func flatten(vars map[string]string, prefix string, v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			flatten(vars, prefix+"_"+strings.ToUpper(k), e)
+		}
+	case []interface{}:
+		// Objects are numbered, e.g. PIVOYAGER_WARNINGS_0_KIND.
+		if len(t) > 0 {
+			if _, ok := t[0].(map[string]interface{}); ok {
+				for i, e := range t {
+					flatten(vars, fmt.Sprintf("%s_%d", prefix, i), e)
+				}
+				vars[prefix+"_COUNT"] = fmt.Sprint(len(t))
+				return
+			}
+		}
+		s := make([]string, len(t))
+		for i, e := range t {
+			s[i] = fmt.Sprint(e)
+		}
+		vars[prefix] = strings.Join(s, " ")
+	case nil:
+		vars[prefix] = ""
+	default:
+		vars[prefix] = fmt.Sprint(t)
+	}
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"github.com/omzlo/pivoyager/battery"
 	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"io"
 	"os"
 	"strconv"
 	"strings"
@@ -30,8 +34,7 @@ func assert_argc(args []string, count ...int) []string {
 	}
 
 	if len(count) == 1 {
-		fmt.Fprintf(os.Stderr, "Command '%s' expects %d parameter(s), but %d were provided.\n", args[0], count[0], argc)
-		os.Exit(2)
+		fail(EXIT_USAGE, fmt.Errorf("Command '%s' expects %d parameter(s), but %d were provided.", args[0], count[0], argc))
 	}
 
 	s := fmt.Sprintf("%d", count[0])
@@ -39,19 +42,64 @@ func assert_argc(args []string, count ...int) []string {
 		s += fmt.Sprintf(", %d", count[i])
 	}
 	s += fmt.Sprintf(" or %d", count[len(count)-1])
-	fmt.Fprintf(os.Stderr, "Command '%s' expects %s parameters, but %d were provided.\n", args[0], s, argc)
-	os.Exit(2)
+	fail(EXIT_USAGE, fmt.Errorf("Command '%s' expects %s parameters, but %d were provided.", args[0], s, argc))
 	return nil
 }
 
+func optionsString(options []string) string {
+	if len(options) == 0 {
+		return "disabled"
+	}
+	return strings.Join(options, " ")
+}
+
+// optionList returns the options enabled in conf, never nil so that it is
+// encoded as an empty JSON list.
+func optionList(conf device.ConfigurationByte) []string {
+	options := conf.ToStrings()
+	if options == nil {
+		options = []string{}
+	}
+	return options
+}
+
 const (
 	DO_FLAGS   = 1
 	DO_BATTERY = 2
 	DO_VOLTAGE = 4
 )
 
+type statusResult struct {
+	Status  *device.Status       `json:"status,omitempty"`
+	Battery *device.ChargerState `json:"battery,omitempty"`
+	Charge  *battery.Estimate    `json:"charge,omitempty"`
+	VBat    *float32             `json:"vbat,omitempty"`
+	VRef    *float32             `json:"vref,omitempty"`
+	ADC     *device.RawVoltage   `json:"adc,omitempty"`
+}
+
+func (r *statusResult) WriteText(w io.Writer) {
+	if r.Status != nil {
+		fmt.Fprintf(w, "Status(%d): %s\n", r.Status.Raw, r.Status)
+	}
+	if r.Battery != nil {
+		fmt.Fprintf(w, "Battery: %s\n", r.Battery)
+	}
+	if r.Charge != nil {
+		fmt.Fprintf(w, "Charge: %s, %s\n", r.Charge, r.Charge.Chemistry)
+	}
+	if r.VBat != nil {
+		fmt.Fprintf(w, "VBat: %.2fV\n", *r.VBat)
+		fmt.Fprintf(w, "VRef: %.2fV\n", *r.VRef)
+	}
+	if r.ADC != nil {
+		fmt.Fprintf(w, "ADC: %s\n", r.ADC)
+	}
+}
+
 func cmd_status(dev *device.Device, args []string) error {
 	var todo int
+	var res statusResult
 
 	args = assert_argc(args, 0, 1)
 	if len(args) == 0 {
@@ -73,22 +121,48 @@ func cmd_status(dev *device.Device, args []string) error {
 		if err != nil {
 			return err
 		}
+		status := s.Decode()
 		if (todo & DO_FLAGS) != 0 {
-			fmt.Printf("Status(%d): %s\n", s, s)
+			res.Status = &status
 		}
 		if (todo & DO_BATTERY) != 0 {
-			fmt.Printf("Battery: %s\n", s.BatteryStateString())
+			res.Battery = &status.Charger
 		}
 	}
-	if (todo & DO_VOLTAGE) != 0 {
-		vbat, vref, err := dev.Voltage()
+	if (todo & (DO_VOLTAGE | DO_BATTERY)) != 0 {
+		voltage, err := dev.ReadVoltage()
 		if err != nil {
 			return err
 		}
-		fmt.Printf("VBat: %.2fV\n", vbat)
-		fmt.Printf("VRef: %.2fV\n", vref)
+		vbat := voltage.VBat
+		if (todo & DO_VOLTAGE) != 0 {
+			res.VBat = &voltage.VBat
+			res.VRef = &voltage.VRef
+			res.ADC = &voltage.Raw
+		}
+		if (todo & DO_BATTERY) != 0 {
+			model, err := batteryModel()
+			if err != nil {
+				return err
+			}
+			charge := model.Estimate(float64(vbat), monitor.BatteryMode(*res.Battery))
+			res.Charge = &charge
+		}
+	}
+	return output(&res)
+}
+
+type dateResult struct {
+	Time time.Time `json:"time"`
+	Set  bool      `json:"set"`
+}
+
+func (r *dateResult) WriteText(w io.Writer) {
+	if r.Set {
+		fmt.Fprintf(w, "Setting date to %s\n", r.Time)
+	} else {
+		fmt.Fprintln(w, r.Time.Format(time.RFC3339))
 	}
-	return nil
 }
 
 func cmd_date(dev *device.Device, args []string) error {
@@ -102,26 +176,22 @@ func cmd_date(dev *device.Device, args []string) error {
 		if err != nil {
 			return err
 		}
-		fmt.Println(tm.Format(time.RFC3339))
-	} else {
-		if args[0] != "sync" {
-			tm, err = time.Parse(time.RFC3339, args[0])
-			if err != nil {
-				return fmt.Errorf("Failed to parse date: %s", err)
-			}
-		} else {
-			for {
-				tm = time.Now()
-				if tm.Nanosecond() < 100000 {
-					break
-				}
-				time.Sleep(50000 * time.Nanosecond)
-			}
+		return output(&dateResult{Time: tm})
+	}
+	if args[0] == "sync" {
+		if tm, err = dev.SyncTime(); err != nil {
+			return err
 		}
-		dev.SetTime(tm.UTC())
-		fmt.Printf("Setting date to %s\n", tm.UTC())
+		return output(&dateResult{Time: tm, Set: true})
 	}
-	return nil
+	tm, err = time.Parse(time.RFC3339, args[0])
+	if err != nil {
+		return fmt.Errorf("Failed to parse date: %s", err)
+	}
+	if err := dev.SetTime(tm.UTC()); err != nil {
+		return err
+	}
+	return output(&dateResult{Time: tm.UTC(), Set: true})
 }
 
 /*
@@ -138,7 +208,20 @@ func cmd_voltage(dev *device.Device, args []string) error {
 }
 */
 
+type watchdogResult struct {
+	Watchdog uint16   `json:"watchdog"`
+	Options  []string `json:"options"`
+}
+
+func (r *watchdogResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Watchdog: %d seconds\n", r.Watchdog)
+	fmt.Fprintf(w, "Options: %s\n", optionsString(r.Options))
+}
+
 func cmd_watchdog(dev *device.Device, args []string) error {
+	if len(args) > 1 && args[1] == "run" {
+		return cmd_watchdog_run(dev, args[2:])
+	}
 	args = assert_argc(args, 0, 1)
 
 	if len(args) == 1 {
@@ -149,28 +232,27 @@ func cmd_watchdog(dev *device.Device, args []string) error {
 		if err := dev.SetWatchdog(uint16(delay), device.CONF_I2C_WD); err != nil {
 			return err
 		}
-		fmt.Println("OK")
-	} else {
-		delay, err := dev.Watchdog()
-		if err != nil {
-			return err
-		}
-		conf, err := dev.Configuration()
-		if err != nil {
-			return err
-		}
-		conf = conf & 0x3
-		fmt.Printf("Watchdog: %d seconds\n", delay)
-		options := conf.ToStrings()
-		var res string
-		if len(options) == 0 {
-			res = "disabled"
-		} else {
-			res = strings.Join(options, " ")
-		}
-		fmt.Printf("Options: %s\n", res)
+		return output(OK)
 	}
-	return nil
+	delay, err := dev.Watchdog()
+	if err != nil {
+		return err
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		return err
+	}
+	return output(&watchdogResult{delay, optionList(conf & 0x3)})
+}
+
+type wakeupResult struct {
+	Wakeup  uint16   `json:"wakeup"`
+	Options []string `json:"options"`
+}
+
+func (r *wakeupResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Wakeup: %d seconds\n", r.Wakeup)
+	fmt.Fprintf(w, "Options: %s\n", optionsString(r.Options))
 }
 
 func cmd_wakeup(dev *device.Device, args []string) error {
@@ -185,28 +267,27 @@ func cmd_wakeup(dev *device.Device, args []string) error {
 		if err := dev.SetWakeup(uint16(delay), device.CONF_WAKE_AFTER); err != nil {
 			return err
 		}
-		fmt.Println("OK")
-	} else {
-		delay, err := dev.Wakeup()
-		if err != nil {
-			return err
-		}
-		conf, err := dev.Configuration()
-		if err != nil {
-			return err
-		}
-		conf = conf & 0x3C
-		fmt.Printf("Wakeup: %d seconds\n", delay)
-		options := conf.ToStrings()
-		var res string
-		if len(options) == 0 {
-			res = "disabled"
-		} else {
-			res = strings.Join(options, " ")
-		}
-		fmt.Printf("Options: %s\n", res)
+		return output(OK)
 	}
-	return nil
+	delay, err := dev.Wakeup()
+	if err != nil {
+		return err
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		return err
+	}
+	return output(&wakeupResult{delay, optionList(conf & 0x3C)})
+}
+
+type lowBatteryTimerResult struct {
+	LowBatteryTimer uint16   `json:"low_battery_timer"`
+	Options         []string `json:"options"`
+}
+
+func (r *lowBatteryTimerResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Shutdown: %d seconds after low battery detected\n", r.LowBatteryTimer)
+	fmt.Fprintf(w, "Options: %s\n", optionsString(r.Options))
 }
 
 func cmd_low_battery_timer(dev *device.Device, args []string) error {
@@ -221,28 +302,17 @@ func cmd_low_battery_timer(dev *device.Device, args []string) error {
         if err := dev.SetLowBatteryTimer(uint16(delay), device.CONF_LBO_SHUTDOWN); err != nil {
             return err
         }
-        fmt.Println("OK")
-    } else {
-        delay, err := dev.LowBatteryTimer()
-        if err != nil {
-            return err
-        }
-        conf, err := dev.Configuration()
-        if err != nil {
-            return err
-        }
-        conf = conf & device.CONF_LBO_SHUTDOWN
-        fmt.Printf("Shutdown: %d seconds after low battery detected\n", delay)
-        options := conf.ToStrings()
-        var res string
-        if len(options) == 0 {
-            res = "disabled"
-        } else {
-            res = strings.Join(options, " ")
-        }
-        fmt.Printf("Options: %s\n", res)
+        return output(OK)
+    }
+    delay, err := dev.LowBatteryTimer()
+    if err != nil {
+        return err
+    }
+    conf, err := dev.Configuration()
+    if err != nil {
+        return err
     }
-    return nil
+    return output(&lowBatteryTimerResult{delay, optionList(conf & device.CONF_LBO_SHUTDOWN)})
 }
 
 /*
@@ -256,6 +326,15 @@ func cmd_battery(dev *device.Device, args []string) error {
 }
 */
 
+type alarmResult struct {
+	Alarm device.Alarm `json:"alarm"`
+	Raw   uint32       `json:"raw"`
+}
+
+func (r *alarmResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Alarm: %s (%x)\n", r.Alarm, r.Raw)
+}
+
 func cmd_alarm(dev *device.Device, args []string) error {
 	args = assert_argc(args, 0, 1)
 
@@ -268,15 +347,21 @@ func cmd_alarm(dev *device.Device, args []string) error {
 		if err := dev.SetAlarm(alarm, device.CONF_WAKE_ALARM); err != nil {
 			return err
 		}
-		fmt.Println("OK")
-	} else {
-		alarm, err := dev.Alarm()
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Alarm: %s (%x)\n", alarm, uint32(alarm))
+		return output(OK)
 	}
-	return nil
+	alarm, err := dev.Alarm()
+	if err != nil {
+		return err
+	}
+	return output(&alarmResult{alarm, uint32(alarm)})
+}
+
+type enabledResult struct {
+	Enabled []string `json:"enabled"`
+}
+
+func (r *enabledResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Enabled: %s\n", strings.Join(r.Enabled, " "))
 }
 
 func cmd_enable(dev *device.Device, args []string) error {
@@ -286,18 +371,24 @@ func cmd_enable(dev *device.Device, args []string) error {
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Enabled: %s\n", conf)
-	} else {
-		var options device.ConfigurationByte
-		if err := options.FromStrings(args); err != nil {
-			return err
-		}
-		if err := dev.ModifyConfiguration(options, options); err != nil {
-			return err
-		}
-		fmt.Println("OK")
+		return output(&enabledResult{optionList(conf)})
 	}
-	return nil
+	var options device.ConfigurationByte
+	if err := options.FromStrings(args); err != nil {
+		return err
+	}
+	if err := dev.ModifyConfiguration(options, options); err != nil {
+		return err
+	}
+	return output(OK)
+}
+
+type disabledResult struct {
+	Disabled []string `json:"disabled"`
+}
+
+func (r *disabledResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Disabled: %s\n", strings.Join(r.Disabled, " "))
 }
 
 func cmd_disable(dev *device.Device, args []string) error {
@@ -307,18 +398,16 @@ func cmd_disable(dev *device.Device, args []string) error {
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Disabled: %s\n", conf.Invert())
-	} else {
-		var options device.ConfigurationByte
-		if err := options.FromStrings(args); err != nil {
-			return err
-		}
-		if err := dev.ModifyConfiguration(options, 0); err != nil {
-			return err
-		}
-		fmt.Println("OK")
+		return output(&disabledResult{optionList(conf.Invert())})
 	}
-	return nil
+	var options device.ConfigurationByte
+	if err := options.FromStrings(args); err != nil {
+		return err
+	}
+	if err := dev.ModifyConfiguration(options, 0); err != nil {
+		return err
+	}
+	return output(OK)
 }
 
 func cmd_clear(dev *device.Device, args []string) error {
@@ -336,8 +425,17 @@ func cmd_clear(dev *device.Device, args []string) error {
 	default:
 		return fmt.Errorf("Unknown flag '%s' for clear command.", args[0])
 	}
-	fmt.Println("OK")
-	return nil
+	return output(OK)
+}
+
+type versionResult struct {
+	Software string `json:"software"`
+	Firmware string `json:"firmware"`
+}
+
+func (r *versionResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Sofware version: %s\n", r.Software)
+	fmt.Fprintf(w, "Firmware version: %s\n", r.Firmware)
 }
 
 func cmd_version(dev *device.Device, args []string) error {
@@ -347,15 +445,18 @@ func cmd_version(dev *device.Device, args []string) error {
     if err!=nil {
         return err
     }
-    fmt.Printf("Sofware version: %s\n", PIVOYAGER_VERSION)
-    fmt.Printf("Firmware version: %s\n", fw_version)
-    return nil
+    return output(&versionResult{PIVOYAGER_VERSION, fw_version})
 }
 
 func cmd_flash(dev *device.Device, args []string) error {
     var length int
     args = assert_argc(args, 1, 2, 3)
 
+    // Progress bars only make sense to a person reading text output.
+    if outputFormat != FORMAT_TEXT {
+        dev.SetFlashProgress(nil)
+    }
+
     switch args[0] {
     case "read":
         if len(args)<2 {
@@ -404,8 +505,7 @@ func cmd_flash(dev *device.Device, args []string) error {
     default:
         return fmt.Errorf("Unrecognized subcommand '%s': valid subcommands for flash are 'read', 'write' and 'exit'.", args[0])
     }
-    fmt.Println("OK")
-    return nil
+    return output(OK)
 }
 
 var commands = []Command{
@@ -418,9 +518,24 @@ var commands = []Command{
                 - minute is 0-59 to select a minute or "*" to ignore
                 - second is 0-59 to select a second or "*" to ignore
 	`},
+	Command{"api", cmd_api, `Serve the HTTP/JSON API (api [-listen <address>] [-socket-mode <mode>] [-token-file <path>]).
+                The default address is unix:/run/pivoyager.sock. Clients must send the token found in
+                token-file, or in PIVOYAGER_API_TOKEN, as an "Authorization: Bearer <token>" header.
+	`},
+	Command{"calibrate", cmd_calibrate, `Calibrate the battery voltage (calibrate voltage [-samples <n>] [<measured-volts>|reset]).
+                Measure the battery voltage with a multimeter, on the battery terminals, and pass it as
+                <measured-volts>: the correction is saved to the file selected with -calibration and
+                applied to all voltage readings. A single measurement corrects the gain; measurements
+                taken at voltages at least 0.2V apart also correct the offset. Without a voltage, show
+                the current calibration; 'reset' removes it.
+	`},
 	Command{"clear", cmd_clear, `Clear a status bit (clear <flags>).
 				The value <flags> can be either "button" or "alarm".
 	`},
+	Command{"daemon", cmd_daemon, `Monitor the PiVoyager and report power events (daemon [config-file]).
+                The configuration is read from the JSON file config-file, or from
+                /etc/pivoyager/daemon.json if it exists. Send SIGHUP to reload it.
+	`},
 	Command{"date", cmd_date, `Get the current RTC time, or set it (date <utc-time-RFC3339>.
                 Use 'date sync' to use the current operating system date for the RTC.
                 Time is typically expressed as UTC time to avoid any ambiguity.
@@ -440,6 +555,9 @@ var commands = []Command{
                 - "low-battery-shutdown" shutdown if the battery is low, after timer expires.
                 Note: "timer-wakeup" cancels "alarm-wakeup".
 	`},
+	Command{"exporter", cmd_exporter, `Serve Prometheus metrics on /metrics (exporter [-listen <address>]).
+                The default address is :9105.
+	`},
     Command{"flash", cmd_flash, `Flash the new firmware file in 'bin' format.
                 Typical use is:
                 - 'flash write example.bin', this will write the firmware file example.bin into the pivoyager.
@@ -449,15 +567,43 @@ var commands = []Command{
                       then powering the device while simulaneously pressing the main button.
                       Once in bootloader mode, the device leds will blink in sequence.
     `},
+	Command{"health", cmd_health, `Show the health of the battery tracked by the daemon (health [options]).
+                Shows the charge cycles, depths of discharge, charger faults and estimated capacity,
+                and warns if the battery looks worn or faulty. Options are:
+                - "-file <path>" health saved by the daemon (default /var/lib/pivoyager/battery-health.json).
+                - "-cycle-life <cycles>" expected life of the battery, in full cycles (default 500).
+                - "-worn <percent>" capacity under which the battery is worn (default 80).
+                The PiVoyager is not needed.
+	`},
     Command{"help", nil, `Prints this message.
 	`},
+	Command{"history", cmd_history, `Query the history logged by the daemon (history [list|outages|export] [options]).
+                - "list" shows the samples and events logged (default), only the events with "-events".
+                - "outages" summarises the USB power outages: start, end, duration, minimum voltage and charge.
+                - "export" writes the records, or the outages with "-outages", as CSV or "-as jsonl".
+                Options are:
+                - "-from <time>", "-to <time>" restrict the range, e.g. 2020-12-31 or 2020-12-31T23:00:00Z.
+                - "-since <duration>" starts the range this long ago, e.g. 24h.
+                - "-file <path>" the history log (default /var/lib/pivoyager/history.jsonl).
+                - "-gap <duration>" time without records after which an outage is interrupted (default 5m).
+                The PiVoyager is not needed, so the log can be copied and analysed elsewhere.
+	`},
     Command{"low-battery-timer", cmd_low_battery_timer, `Get or set how much time to wait (in seconds) before shutting down when the battery is low.
                 Note: By default this timer is set to 60 seconds.
     `},
+	Command{"runtime", cmd_runtime, `Estimate the time left on battery, or before the battery is full.
+                The rates learned by the daemon are used, unless the voltage is sampled. Options are:
+                - "-sample <duration>" sample the voltage for this long to fit the rate (e.g. 5m).
+                - "-interval <duration>" delay between samples (default 5s).
+                - "-rates <path>" rates learned by the daemon (default /var/lib/pivoyager/battery-rates.json).
+                - "-cutoff <volts>" battery voltage at which the battery is considered empty (default 3.4).
+                If "low-battery-shutdown" is enabled, the time left before the power is cut is also shown.
+	`},
 	Command{"status", cmd_status, `Get the current UPS status of the PiVoyager.
 				- "status flags" shows system status flags.
-				- "status battery" shows battery status (e.g. "charging").
-				- "status volatge" shows battery and reference voltage.
+				- "status battery" shows battery status (e.g. "charging") and the
+				  estimated charge, for the battery chemistry selected with -battery.
+				- "status volatge" shows battery and reference voltage, and the raw ADC counts.
 				- "status" shows all of the above.
 	`},
     Command{"version", cmd_version, `Print current software and firmware version"
@@ -466,6 +612,18 @@ var commands = []Command{
 				Note: "wakeup" sets an alarm, overriding any alarm previously set.
 	`},
 	Command{"watchdog", cmd_watchdog, `Get watchdog information, or set watchdog time (watchdog <seconds>)
+                Use 'watchdog run [options]' to enable the watchdog and keep kicking it
+                while the system is healthy. Options are:
+                - "-mechanism <i2c|gpio>" kick the i2c watchdog (default) or toggle GPIO 26.
+                - "-gpio-chip <path>" GPIO chip of the watchdog pin (default /dev/gpiochip0).
+                - "-gpio-line <offset>" GPIO line of the watchdog pin (default 26).
+                - "-timeout <duration>" power-cycle the Pi after this delay (default 60s).
+                - "-interval <duration>" delay between kicks (default timeout/4).
+                - "-check-command <command>" the command must exit with status 0.
+                - "-check-file <path>" the file must be modified every -check-file-age (default 1m).
+                - "-check-unit <unit>" the systemd unit must be active.
+                - "-min-memory <MiB>" the available memory must be at least that much.
+                - "-keep-armed" leave the watchdog armed when stopped by SIGINT or SIGTERM.
 	`},
 }
 
@@ -477,7 +635,8 @@ func version() {
 
 func help() {
 	version()
-	fmt.Println("Syntax: pivoyager <command> (options...)")
+	fmt.Println("Syntax: pivoyager [global options] <command> (options...)")
+	printGlobalOptions()
 	fmt.Println("Valid commands are:")
 	for _, command := range commands {
 		fmt.Printf("  %10s:  %s\n", command.Name, command.Description)
@@ -485,33 +644,56 @@ func help() {
 }
 
 func main() {
+	opts, args, err := parseGlobalOptions(os.Args[1:])
+	if err == flag.ErrHelp {
+		help()
+		os.Exit(EXIT_OK)
+	}
+	if err != nil {
+		fail(EXIT_USAGE, err)
+	}
 
-	if len(os.Args) == 1 {
+	if len(args) == 0 {
 		version()
 		fmt.Println("Type 'pivoyager help' for usage information.")
-		os.Exit(0)
+		os.Exit(EXIT_OK)
 	}
 
-	if os.Args[1] == "help" {
+	if args[0] == "help" {
 		help()
-		os.Exit(0)
+		os.Exit(EXIT_OK)
 	}
 
 	for _, command := range commands {
-		if command.Name == os.Args[1] {
-			pivoyager, err := device.Open(command.Name == "flash")
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "failed to connect to pivoyager.\n")
-				fmt.Fprintf(os.Stderr, "Could not connect to i2c device: %s\n", err)
-				os.Exit(1)
+		if command.Name == args[0] {
+			var pivoyager *device.Device
+
+			// The history and health are read from files, without the
+			// PiVoyager.
+			if command.Name != "history" && command.Name != "health" {
+				opts.Bootloader = command.Name == "flash"
+				// The calibrate command loads the calibration itself, so
+				// that it can reset an invalid one.
+				if command.Name != "calibrate" {
+					if opts.Calibration, err = loadCalibration(); err != nil {
+						fail(EXIT_ERROR, fmt.Errorf("%w, reset it with 'pivoyager calibrate voltage reset'", err))
+					}
+				}
+				pivoyager, err = openDevice(opts)
+				if err != nil {
+					fail(EXIT_CONNECT, fmt.Errorf("Could not connect to pivoyager on %s at address 0x%02x: %w", opts.Path(), opts.Address, err))
+				}
 			}
-			if err := command.Execute(pivoyager, os.Args[1:]); err != nil {
-				fmt.Fprintf(os.Stderr, "Error: %s\n", err)
-				os.Exit(1)
+			err = command.Execute(pivoyager, args)
+			if pivoyager != nil {
+				pivoyager.Close()
+			}
+			if err != nil {
+				fail(exitCode(err), err)
 			}
-			os.Exit(0)
+			os.Exit(EXIT_OK)
 		}
 	}
 
-	fmt.Fprintf(os.Stderr, "Error: command '%s' unknown\n", os.Args[1])
+	fail(EXIT_USAGE, fmt.Errorf("command '%s' unknown", args[0]))
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+type runtimeResult struct {
+	Charge  battery.Estimate  `json:"charge"`
+	Runtime battery.Remaining `json:"runtime"`
+	// PowerOff is the time left, in seconds, before the PiVoyager cuts the
+	// power, if low-battery-shutdown is enabled and the runtime is known.
+	PowerOff int64 `json:"power_off,omitempty"`
+	// LowBatteryTimer is set if low-battery-shutdown is enabled.
+	LowBatteryTimer *uint16 `json:"low_battery_timer,omitempty"`
+}
+
+func formatRemaining(d time.Duration) string {
+	if d <= 0 {
+		return "unknown"
+	}
+	return d.Round(time.Minute).String()
+}
+
+func (r *runtimeResult) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "Charge: %s, %s\n", r.Charge, r.Charge.Chemistry)
+	fmt.Fprintf(w, "Mode: %s\n", r.Runtime.Mode)
+	if r.Runtime.Source != "" {
+		fmt.Fprintf(w, "Rate: %+.1f%%/h (%s)\n", r.Runtime.Rate, r.Runtime.Source)
+	} else {
+		fmt.Fprintf(w, "Rate: unknown\n")
+	}
+	switch r.Runtime.Mode {
+	case battery.MODE_DISCHARGING:
+		fmt.Fprintf(w, "Time to empty: %s\n", formatRemaining(r.Runtime.TimeToEmpty))
+		if r.LowBatteryTimer != nil {
+			fmt.Fprintf(w, "Power off: %s, %d seconds after low battery detected\n", formatRemaining(time.Duration(r.PowerOff)*time.Second), *r.LowBatteryTimer)
+		}
+	case battery.MODE_CHARGING:
+		fmt.Fprintf(w, "Time to full: %s\n", formatRemaining(r.Runtime.TimeToFull))
+	}
+}
+
+// cmd_runtime estimates the time left on battery, or before the battery is
+// full, from the rates learned by the daemon, or by sampling the voltage.
+func cmd_runtime(dev *device.Device, args []string) error {
+	flags := flag.NewFlagSet("runtime", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	ratesFile := flags.String("rates", battery.DEFAULT_RATES_FILE, "battery rates learned by the daemon")
+	sample := flags.Duration("sample", 0, "sample the battery voltage for this long to fit the rate")
+	interval := flags.Duration("interval", 5*time.Second, "time between two samples")
+	cutoff := flags.Float64("cutoff", battery.DEFAULT_CUTOFF, "battery voltage at which the battery is considered empty")
+	if err := flags.Parse(args[1:]); err != nil {
+		fail(EXIT_USAGE, fmt.Errorf("runtime: %w", err))
+	}
+	if flags.NArg() != 0 {
+		fail(EXIT_USAGE, fmt.Errorf("runtime: unexpected argument '%s'", flags.Arg(0)))
+	}
+	if *interval <= 0 {
+		fail(EXIT_USAGE, fmt.Errorf("runtime: invalid interval %s", *interval))
+	}
+	if *cutoff <= 0 {
+		fail(EXIT_USAGE, fmt.Errorf("runtime: invalid cutoff %g", *cutoff))
+	}
+
+	model, err := batteryModel()
+	if err != nil {
+		return err
+	}
+	rates, err := loadRates(*ratesFile)
+	if err != nil {
+		return err
+	}
+	rt := battery.NewRuntime(rates)
+	rt.Reserve = model.Reserve(*cutoff)
+	// The whole sampling period is used for the fit.
+	if *sample > rt.Window {
+		rt.Window = *sample
+	}
+
+	var res runtimeResult
+	if res.Charge, res.Runtime, err = monitor.Runtime(dev, model, rt, *sample, *interval); err != nil {
+		return err
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		return err
+	}
+	if conf&device.CONF_LBO_SHUTDOWN != 0 {
+		timer, err := dev.LowBatteryTimer()
+		if err != nil {
+			return err
+		}
+		res.LowBatteryTimer = &timer
+		if res.Runtime.TimeToEmpty > 0 {
+			res.PowerOff = int64(res.Runtime.TimeToEmpty/time.Second) + int64(timer)
+		}
+	}
+	return output(&res)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/gpio"
+	"github.com/omzlo/pivoyager/watchdog"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// stringList is a flag that can be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// cmd_watchdog_run kicks the i2c or gpio watchdog until SIGINT or SIGTERM,
+// as long as the health checks given on the command line pass.
+func cmd_watchdog_run(dev *device.Device, args []string) error {
+	var commands, files, units stringList
+
+	flags := flag.NewFlagSet("watchdog run", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	mechanism := flags.String("mechanism", watchdog.MECHANISM_I2C, "watchdog kicked: 'i2c' or 'gpio'")
+	chip := flags.String("gpio-chip", gpio.DEFAULT_CHIP, "GPIO chip of the watchdog pin, with -mechanism=gpio")
+	line := flags.Uint("gpio-line", watchdog.WATCHDOG_GPIO, "GPIO line of the watchdog pin, with -mechanism=gpio")
+	timeout := flags.Duration("timeout", watchdog.DEFAULT_TIMEOUT, "power-cycle the Pi if the watchdog is not kicked for this long")
+	interval := flags.Duration("interval", 0, "interval between two kicks, a quarter of the timeout by default")
+	flags.Var(&commands, "check-command", "shell command that must exit with status 0 (repeatable)")
+	flags.Var(&files, "check-file", "file that must be modified regularly (repeatable)")
+	fileAge := flags.Duration("check-file-age", time.Minute, "maximum age of the files given with -check-file")
+	flags.Var(&units, "check-unit", "systemd unit that must be active (repeatable)")
+	minMemory := flags.Uint64("min-memory", 0, "minimum available memory, in MiB")
+	keepArmed := flags.Bool("keep-armed", false, "leave the watchdog armed when stopping")
+	if err := flags.Parse(args); err != nil {
+		return usageError{fmt.Errorf("watchdog run: %w", err)}
+	}
+	if flags.NArg() != 0 {
+		return usageError{fmt.Errorf("watchdog run: unexpected argument '%s'", flags.Arg(0))}
+	}
+
+	var kicker watchdog.Kicker
+	switch *mechanism {
+	case watchdog.MECHANISM_I2C:
+		kicker = watchdog.NewI2CKicker(dev)
+	case watchdog.MECHANISM_GPIO:
+		pin, err := gpio.RequestOutput(*chip, uint32(*line), "pivoyager-watchdog", false)
+		if err != nil {
+			return err
+		}
+		defer pin.Close()
+		kicker = watchdog.NewGPIOKicker(dev, pin)
+	default:
+		return usageError{fmt.Errorf("watchdog run: unknown mechanism '%s', expected 'i2c' or 'gpio'", *mechanism)}
+	}
+
+	w := watchdog.New(kicker, *timeout)
+	w.Interval = *interval
+	w.KeepArmed = *keepArmed
+	w.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	for _, c := range commands {
+		w.Checks = append(w.Checks, &watchdog.CommandCheck{Command: c})
+	}
+	for _, f := range files {
+		w.Checks = append(w.Checks, &watchdog.FileCheck{Path: f, MaxAge: *fileAge})
+	}
+	for _, u := range units {
+		w.Checks = append(w.Checks, &watchdog.UnitCheck{Unit: u})
+	}
+	if *minMemory > 0 {
+		w.Checks = append(w.Checks, &watchdog.MemoryCheck{MinAvailable: *minMemory << 20})
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if err := w.Run(ctx); err != nil {
+		return err
+	}
+	return output(OK)
+}
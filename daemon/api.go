@@ -0,0 +1,77 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/api"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// APIConfig describes the HTTP API of the daemon.
+type APIConfig struct {
+	Enabled bool `json:"enabled"`
+	// Listen is "unix:<path>" or a TCP address.
+	Listen string `json:"listen"`
+	// SocketMode is the permissions of the unix socket, in octal.
+	SocketMode string `json:"socket_mode"`
+	// Token, or the content of TokenFile, must be sent by clients as a
+	// bearer token. The API is open if both are empty.
+	Token     string `json:"token"`
+	TokenFile string `json:"token_file"`
+}
+
+func DefaultAPIConfig() APIConfig {
+	return APIConfig{
+		Listen:     api.DEFAULT_ADDRESS,
+		SocketMode: strconv.FormatUint(api.DEFAULT_SOCKET_MODE, 8),
+	}
+}
+
+func (cfg *APIConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if _, err := cfg.mode(); err != nil {
+		return err
+	}
+	if cfg.Token != "" && cfg.TokenFile != "" {
+		return fmt.Errorf("api token and token_file cannot be both set")
+	}
+	return nil
+}
+
+func (cfg *APIConfig) mode() (os.FileMode, error) {
+	perm, err := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid api socket_mode '%s'", cfg.SocketMode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// runAPI serves the HTTP API until ctx is cancelled.
+func (d *Daemon) runAPI(ctx context.Context) error {
+	cfg := &d.Config.API
+
+	token := cfg.Token
+	if cfg.TokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.TokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	mode, err := cfg.mode()
+	if err != nil {
+		return err
+	}
+	srv := api.New(d.Device, token)
+	srv.Battery = d.Monitor.Battery.Model
+	srv.Source = d.Monitor
+	srv.Health = d.Monitor.Health
+	srv.MaxAge = 3 * d.Monitor.Interval
+	srv.Logger = d.Logger
+	return srv.ListenAndServe(ctx, cfg.Listen, mode)
+}
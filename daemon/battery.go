@@ -0,0 +1,193 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/battery"
+	"os"
+	"time"
+)
+
+// BatteryConfig describes the battery, to estimate its state of charge.
+type BatteryConfig struct {
+	// Chemistry is "lipo" or "li-ion".
+	Chemistry string `json:"chemistry"`
+	// DischargeCurve and ChargeCurve, if not empty, replace the curves of
+	// the chemistry.
+	DischargeCurve battery.Curve `json:"discharge_curve"`
+	ChargeCurve    battery.Curve `json:"charge_curve"`
+	// Load is the typical current drawn from the battery, in amps.
+	Load float64 `json:"load"`
+	// InternalResistance of the battery, in ohms.
+	InternalResistance float64 `json:"internal_resistance"`
+	// Smoothing is the time constant of the moving average of the voltage.
+	Smoothing Duration `json:"smoothing"`
+	// Hysteresis, in percent, is how much the charge must rise while
+	// discharging, or fall while charging, before it is reported.
+	Hysteresis float64 `json:"hysteresis"`
+	// Settle is the time taken to switch between the charge and discharge
+	// curves.
+	Settle Duration `json:"settle"`
+	// RatesFile is where the charge and discharge rates learned for the
+	// battery are kept, to estimate the runtime. They are not kept if empty.
+	RatesFile string `json:"rates_file"`
+	// RuntimeWindow is the period over which the runtime is estimated.
+	RuntimeWindow Duration `json:"runtime_window"`
+	// Cutoff is the battery voltage at which the battery is considered
+	// empty, mapped to a charge through the discharge curve.
+	Cutoff float64 `json:"cutoff"`
+	// HealthFile is where the cycles, depths of discharge and faults of the
+	// battery are kept. They are not kept if empty.
+	HealthFile string `json:"health_file"`
+	// CycleLife is the expected life of the battery, in full cycles.
+	CycleLife float64 `json:"cycle_life"`
+	// WornCapacity, in percent of the initial capacity, is the estimated
+	// capacity under which the battery is reported as worn.
+	WornCapacity float64 `json:"worn_capacity"`
+	// FaultLimit charger faults within FaultWindow report the battery as
+	// faulty.
+	FaultLimit  int      `json:"fault_limit"`
+	FaultWindow Duration `json:"fault_window"`
+}
+
+func DefaultBatteryConfig() BatteryConfig {
+	m := battery.DefaultModel()
+	return BatteryConfig{
+		Chemistry:          m.Chemistry.Name,
+		Load:               m.Load,
+		InternalResistance: m.InternalResistance,
+		Smoothing:          Duration(m.Smoothing),
+		Hysteresis:         m.Hysteresis,
+		Settle:             Duration(m.Settle),
+		RatesFile:          battery.DEFAULT_RATES_FILE,
+		RuntimeWindow:      Duration(battery.DEFAULT_WINDOW),
+		Cutoff:             battery.DEFAULT_CUTOFF,
+		HealthFile:         battery.DEFAULT_HEALTH_FILE,
+		CycleLife:          battery.DEFAULT_CYCLE_LIFE,
+		WornCapacity:       battery.DEFAULT_WORN,
+		FaultLimit:         battery.DEFAULT_FAULT_LIMIT,
+		FaultWindow:        Duration(battery.DEFAULT_FAULT_WINDOW),
+	}
+}
+
+func (cfg *BatteryConfig) Validate() error {
+	if cfg.RuntimeWindow.Duration() < battery.DEFAULT_MIN_SPAN {
+		return fmt.Errorf("battery: runtime_window must be at least %s", battery.DEFAULT_MIN_SPAN)
+	}
+	if cfg.Cutoff <= 0 {
+		return fmt.Errorf("battery: cutoff must be positive")
+	}
+	if cfg.CycleLife <= 0 {
+		return fmt.Errorf("battery: cycle_life must be positive")
+	}
+	if cfg.WornCapacity <= 0 || cfg.WornCapacity >= 100 {
+		return fmt.Errorf("battery: worn_capacity must be between 0 and 100")
+	}
+	if cfg.FaultLimit < 1 {
+		return fmt.Errorf("battery: fault_limit must be at least 1")
+	}
+	if cfg.FaultWindow <= 0 {
+		return fmt.Errorf("battery: fault_window must be positive")
+	}
+	_, err := cfg.Model()
+	return err
+}
+
+// Model returns the estimation model described by cfg.
+func (cfg *BatteryConfig) Model() (*battery.Model, error) {
+	chem, err := battery.Lookup(cfg.Chemistry)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.DischargeCurve) > 0 || len(cfg.ChargeCurve) > 0 {
+		custom := *chem
+		custom.Name = "custom " + chem.Name
+		if len(cfg.DischargeCurve) > 0 {
+			custom.Discharge = cfg.DischargeCurve
+		}
+		if len(cfg.ChargeCurve) > 0 {
+			custom.Charge = cfg.ChargeCurve
+		}
+		chem = &custom
+	}
+
+	m := battery.DefaultModel()
+	m.Chemistry = chem
+	m.Load = cfg.Load
+	m.InternalResistance = cfg.InternalResistance
+	m.Smoothing = cfg.Smoothing.Duration()
+	m.Hysteresis = cfg.Hysteresis
+	m.Settle = cfg.Settle.Duration()
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("battery: %w", err)
+	}
+	return m, nil
+}
+
+// Runtime returns the runtime estimator described by cfg, for model,
+// starting from the rates saved in RatesFile, if any.
+func (cfg *BatteryConfig) Runtime(model *battery.Model) (*battery.Runtime, error) {
+	var rates battery.Rates
+
+	if cfg.RatesFile != "" {
+		var err error
+		rates, err = battery.LoadRates(cfg.RatesFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("battery: %w", err)
+		}
+	}
+	r := battery.NewRuntime(rates)
+	r.Window = cfg.RuntimeWindow.Duration()
+	r.Reserve = model.Reserve(cfg.Cutoff)
+	return r, nil
+}
+
+// Health returns the health tracker described by cfg, starting from the
+// health saved in HealthFile, if any.
+func (cfg *BatteryConfig) Health() (*battery.Tracker, error) {
+	var h battery.Health
+
+	if cfg.HealthFile != "" {
+		var err error
+		h, err = battery.LoadHealth(cfg.HealthFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("battery: %w", err)
+		}
+	}
+	tr := battery.NewTracker(h)
+	tr.CycleLife = cfg.CycleLife
+	tr.Worn = cfg.WornCapacity
+	tr.FaultLimit = cfg.FaultLimit
+	tr.FaultWindow = cfg.FaultWindow.Duration()
+	return tr, nil
+}
+
+// runBattery saves the rates learned by the monitor and the health of the
+// battery every few minutes, and once more when ctx is cancelled.
+func (d *Daemon) runBattery(ctx context.Context) error {
+	cfg := d.Config.Battery
+	save := func() {
+		if rates, changed := d.Monitor.Runtime.LearnedRates(); changed && cfg.RatesFile != "" {
+			if err := rates.Save(cfg.RatesFile); err != nil {
+				d.Logger.Printf("Failed to save battery rates to %s: %s", cfg.RatesFile, err)
+			}
+		}
+		if report, changed := d.Monitor.Health.Report(); changed && cfg.HealthFile != "" {
+			if err := report.Health.Save(cfg.HealthFile); err != nil {
+				d.Logger.Printf("Failed to save battery health to %s: %s", cfg.HealthFile, err)
+			}
+		}
+	}
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			return nil
+		case <-ticker.C:
+			save()
+		}
+	}
+}
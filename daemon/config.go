@@ -0,0 +1,156 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/pivoyager/monitor"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	DEFAULT_CONFIG_PATH = "/etc/pivoyager/daemon.json"
+)
+
+// Duration is a time.Duration written as a string such as "5s" or "2m30s"
+// in the configuration file.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(data []byte) error {
+	v, err := time.ParseDuration(string(data))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Config is the daemon configuration, read from a JSON file.
+type Config struct {
+	// Interval between two polls of the device.
+	Interval Duration `json:"interval"`
+	// LowBatteryVoltage, if not zero, is the battery voltage under which
+	// the battery is considered low, in addition to the charger state.
+	LowBatteryVoltage float32 `json:"low_battery_voltage"`
+	// ClearFlags clears the button and alarm flags once reported.
+	ClearFlags bool `json:"clear_flags"`
+	// LogEvents logs every event.
+	LogEvents bool `json:"log_events"`
+	// Battery describes the battery, to estimate its state of charge.
+	Battery BatteryConfig `json:"battery"`
+	// Shutdown configures the shutdown of the system on battery.
+	Shutdown ShutdownConfig `json:"shutdown"`
+	// Watchdog configures the watchdog kicked by the daemon.
+	Watchdog WatchdogConfig `json:"watchdog"`
+	// NUT configures the Network UPS Tools server.
+	NUT NUTConfig `json:"nut"`
+	// NIS configures the apcupsd Network Information Server.
+	NIS NISConfig `json:"nis"`
+	// Exporter configures the Prometheus exporter.
+	Exporter ExporterConfig `json:"exporter"`
+	// API configures the HTTP API.
+	API APIConfig `json:"api"`
+	// MQTT configures the MQTT publisher.
+	MQTT MQTTConfig `json:"mqtt"`
+	// Hooks configures the commands run on events.
+	Hooks HooksConfig `json:"hooks"`
+	// History configures the log of samples and events.
+	History HistoryConfig `json:"history"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Interval:   Duration(monitor.DEFAULT_INTERVAL),
+		ClearFlags: true,
+		LogEvents:  true,
+		Battery:    DefaultBatteryConfig(),
+		Shutdown:   DefaultShutdownConfig(),
+		Watchdog:   DefaultWatchdogConfig(),
+		NUT:        DefaultNUTConfig(),
+		NIS:        DefaultNISConfig(),
+		Exporter:   DefaultExporterConfig(),
+		API:        DefaultAPIConfig(),
+		MQTT:       DefaultMQTTConfig(),
+		Hooks:      DefaultHooksConfig(),
+		History:    DefaultHistoryConfig(),
+	}
+}
+
+// LoadConfig reads the configuration file at path. Settings missing from
+// the file keep their default value.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Could not parse %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid configuration in %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// validateListen checks that addr is a TCP address, such as
+// 127.0.0.1:3493 or :9105, with a port.
+func validateListen(section string, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s listen address '%s' is invalid: %w", section, addr, err)
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return fmt.Errorf("%s listen address '%s' needs a port between 1 and 65535", section, addr)
+	}
+	return nil
+}
+
+func (cfg *Config) Validate() error {
+	if cfg.Interval.Duration() < 100*time.Millisecond {
+		return fmt.Errorf("interval must be at least 100ms, got %s", cfg.Interval.Duration())
+	}
+	if err := cfg.Battery.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Shutdown.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Watchdog.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.NUT.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.NIS.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Exporter.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.API.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.MQTT.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Hooks.Validate(); err != nil {
+		return err
+	}
+	return cfg.History.Validate()
+}
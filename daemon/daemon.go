@@ -0,0 +1,172 @@
+// Package daemon runs the long-lived pivoyager services: a monitor polling
+// the device and dispatching power events to handlers, and any service
+// registered alongside it.
+package daemon
+
+import (
+	"context"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"github.com/omzlo/pivoyager/watchdog"
+	"log"
+	"sync"
+)
+
+type service struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+type Daemon struct {
+	Device  *device.Device
+	Config  *Config
+	Monitor *monitor.Monitor
+	Logger  *log.Logger
+	// Version of pivoyager, reported to clients.
+	Version string
+	// Shutdown is nil unless enabled in the configuration.
+	Shutdown *Shutdown
+	// Watchdog is nil unless enabled in the configuration.
+	Watchdog *watchdog.Watchdog
+
+	services []service
+}
+
+// New creates a daemon for dev, configured by cfg. Handlers and services
+// can be added before calling Run.
+func New(dev *device.Device, cfg *Config, logger *log.Logger) (*Daemon, error) {
+	model, err := cfg.Battery.Model()
+	if err != nil {
+		return nil, err
+	}
+	m := monitor.New(dev, cfg.Interval.Duration())
+	m.Battery = battery.NewEstimator(model)
+	if m.Runtime, err = cfg.Battery.Runtime(model); err != nil {
+		return nil, err
+	}
+	if m.Health, err = cfg.Battery.Health(); err != nil {
+		return nil, err
+	}
+	m.LowBatteryVoltage = cfg.LowBatteryVoltage
+	m.ClearFlags = cfg.ClearFlags
+	m.Logger = logger
+
+	d := &Daemon{Device: dev, Config: cfg, Monitor: m, Logger: logger}
+	if cfg.Battery.RatesFile != "" || cfg.Battery.HealthFile != "" {
+		d.AddService("battery", d.runBattery)
+	}
+	if cfg.LogEvents {
+		d.Handle(monitor.LogHandler(logger))
+	}
+	if cfg.History.Enabled {
+		l := cfg.History.log(logger)
+		d.Handle(l)
+		d.AddService("history", func(ctx context.Context) error {
+			return runHistory(ctx, l)
+		})
+	}
+	if cfg.Hooks.Enabled {
+		r := cfg.Hooks.runner(logger)
+		d.Handle(r)
+		d.AddService("hooks", r.Run)
+	}
+	if cfg.Shutdown.Enabled {
+		d.Shutdown = NewShutdown(dev, m, cfg.Shutdown, logger)
+		d.Handle(d.Shutdown)
+	}
+	if cfg.Watchdog.Enabled {
+		d.Watchdog = watchdog.New(nil, cfg.Watchdog.Timeout.Duration())
+		d.Watchdog.Interval = cfg.Watchdog.Interval.Duration()
+		d.Watchdog.KeepArmed = cfg.Watchdog.KeepArmed
+		d.Watchdog.Checks = cfg.Watchdog.Checks()
+		d.Watchdog.Logger = logger
+		if d.Shutdown != nil {
+			d.Shutdown.Watchdog = d.Watchdog
+		}
+		d.AddService("watchdog", func(ctx context.Context) error {
+			return cfg.Watchdog.run(ctx, d.Watchdog, dev)
+		})
+	}
+	if cfg.NUT.Enabled {
+		d.AddService("nut", d.runNUT)
+	}
+	if cfg.NIS.Enabled {
+		// Registered now, so that the event log starts with the first sample.
+		srv := d.newNIS()
+		d.Handle(srv)
+		d.AddService("nis", func(ctx context.Context) error {
+			return d.runNIS(ctx, srv)
+		})
+	}
+	if cfg.Exporter.Enabled {
+		d.AddService("exporter", d.runExporter)
+	}
+	if cfg.API.Enabled {
+		d.AddService("api", d.runAPI)
+	}
+	if cfg.MQTT.Enabled {
+		p := d.newMQTT()
+		d.Handle(p)
+		d.AddService("mqtt", func(ctx context.Context) error {
+			return d.runMQTT(ctx, p)
+		})
+	}
+	return d, nil
+}
+
+// Resume carries over the state of prev, a daemon stopped to reload the
+// configuration: the last sample of its monitor, so that events are not
+// reported again for a state that did not change, and the state of its
+// shutdown.
+func (d *Daemon) Resume(prev *Daemon) {
+	if sample, ok := prev.Monitor.Latest(); ok {
+		d.Monitor.Resume(sample)
+	}
+	if d.Shutdown != nil && prev.Shutdown != nil {
+		d.Shutdown.Resume(prev.Shutdown)
+	}
+}
+
+// Handle registers a handler for the events detected by the monitor.
+func (d *Daemon) Handle(h monitor.Handler) {
+	d.Monitor.Handle(h)
+}
+
+// AddService registers a function run alongside the monitor. It must
+// return once ctx is cancelled. If it returns an error, the daemon stops.
+func (d *Daemon) AddService(name string, run func(ctx context.Context) error) {
+	d.services = append(d.services, service{name, run})
+}
+
+// Run runs the monitor and the services until ctx is cancelled or a
+// service fails, in which case its error is returned.
+func (d *Daemon) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var result error
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := func(name string, run func(ctx context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := run(ctx); err != nil {
+				d.Logger.Printf("Service %s failed: %s", name, err)
+				once.Do(func() { result = err })
+				cancel()
+			}
+		}()
+	}
+
+	d.Logger.Printf("Starting pivoyager daemon, polling every %s", d.Monitor.Interval)
+	start("monitor", d.Monitor.Run)
+	for _, s := range d.services {
+		start(s.name, s.run)
+	}
+	wg.Wait()
+	d.Logger.Printf("Stopped pivoyager daemon")
+	return result
+}
@@ -0,0 +1,31 @@
+package daemon
+
+import (
+	"context"
+	"github.com/omzlo/pivoyager/exporter"
+)
+
+// ExporterConfig describes the Prometheus exporter of the daemon.
+type ExporterConfig struct {
+	Enabled bool `json:"enabled"`
+	// Listen is the TCP address serving /metrics, :9105 by default.
+	Listen string `json:"listen"`
+}
+
+func DefaultExporterConfig() ExporterConfig {
+	return ExporterConfig{Listen: exporter.DEFAULT_ADDRESS}
+}
+
+func (cfg *ExporterConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	return validateListen("exporter", cfg.Listen)
+}
+
+// runExporter serves Prometheus metrics until ctx is cancelled.
+func (d *Daemon) runExporter(ctx context.Context) error {
+	e := exporter.New(d.Device, d.Version)
+	e.Logger = d.Logger
+	return e.ListenAndServe(ctx, d.Config.Exporter.Listen)
+}
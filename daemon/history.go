@@ -0,0 +1,65 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/history"
+	"log"
+)
+
+// HistoryConfig describes the log of samples and events kept by the
+// daemon.
+type HistoryConfig struct {
+	Enabled bool `json:"enabled"`
+	// Path is the current log file. Rotated files are kept alongside it.
+	Path string `json:"path"`
+	// Interval between two samples logged. Events are always logged.
+	Interval Duration `json:"interval"`
+	// MaxSize, in bytes, and MaxFileAge trigger the rotation of the log.
+	MaxSize    int64    `json:"max_size"`
+	MaxFileAge Duration `json:"max_file_age"`
+	// Retention is how long rotated files are kept, 0 to keep them all.
+	Retention Duration `json:"retention"`
+}
+
+func DefaultHistoryConfig() HistoryConfig {
+	return HistoryConfig{
+		Path:       history.DEFAULT_PATH,
+		Interval:   Duration(history.DEFAULT_INTERVAL),
+		MaxSize:    history.DEFAULT_MAX_SIZE,
+		MaxFileAge: Duration(history.DEFAULT_MAX_FILE_AGE),
+		Retention:  Duration(history.DEFAULT_RETENTION),
+	}
+}
+
+func (cfg *HistoryConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Path == "" {
+		return fmt.Errorf("history: path must be set")
+	}
+	if cfg.MaxSize < 4096 {
+		return fmt.Errorf("history: max_size must be at least 4096 bytes")
+	}
+	if cfg.Interval < 0 || cfg.MaxFileAge < 0 || cfg.Retention < 0 {
+		return fmt.Errorf("history: durations cannot be negative")
+	}
+	return nil
+}
+
+func (cfg *HistoryConfig) log(logger *log.Logger) *history.Log {
+	l := history.New(cfg.Path)
+	l.Interval = cfg.Interval.Duration()
+	l.MaxSize = cfg.MaxSize
+	l.MaxFileAge = cfg.MaxFileAge.Duration()
+	l.Retention = cfg.Retention.Duration()
+	l.Logger = logger
+	return l
+}
+
+// runHistory closes the log once ctx is cancelled.
+func runHistory(ctx context.Context, l *history.Log) error {
+	<-ctx.Done()
+	return l.Close()
+}
@@ -0,0 +1,90 @@
+package daemon
+
+import (
+	"fmt"
+	"github.com/omzlo/pivoyager/hooks"
+	"github.com/omzlo/pivoyager/monitor"
+	"log"
+	"sort"
+)
+
+// HookConfig is a command run on an event: a shell snippet in Command, or
+// an executable and its arguments in Exec.
+type HookConfig struct {
+	Command string   `json:"command"`
+	Exec    []string `json:"exec"`
+	// Timeout, if not zero, overrides the timeout of the hooks section.
+	Timeout Duration `json:"timeout"`
+}
+
+// HooksConfig describes the commands run by the daemon on power events.
+type HooksConfig struct {
+	Enabled bool `json:"enabled"`
+	// Timeout after which a hook is killed.
+	Timeout Duration `json:"timeout"`
+	// Concurrency is the number of hooks allowed to run at the same time.
+	Concurrency int `json:"concurrency"`
+	// Events maps event types, such as on_battery, to their hooks.
+	Events map[string][]HookConfig `json:"events"`
+}
+
+func DefaultHooksConfig() HooksConfig {
+	return HooksConfig{
+		Timeout:     Duration(hooks.DEFAULT_TIMEOUT),
+		Concurrency: hooks.DEFAULT_CONCURRENCY,
+	}
+}
+
+func isEventType(t string) bool {
+	for _, et := range monitor.EventTypes {
+		if t == et {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *HooksConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Timeout.Duration() <= 0 {
+		return fmt.Errorf("hooks timeout must be positive")
+	}
+	if cfg.Concurrency < 1 {
+		return fmt.Errorf("hooks concurrency must be at least 1, got %d", cfg.Concurrency)
+	}
+	for event, hs := range cfg.Events {
+		if !isEventType(event) {
+			return fmt.Errorf("unknown hook event '%s'", event)
+		}
+		for _, h := range hs {
+			if (h.Command == "") == (len(h.Exec) == 0) {
+				return fmt.Errorf("each %s hook needs either a command or exec", event)
+			}
+			if h.Timeout.Duration() < 0 {
+				return fmt.Errorf("%s hook timeout cannot be negative", event)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg *HooksConfig) runner(logger *log.Logger) *hooks.Runner {
+	r := hooks.New()
+	r.Timeout = cfg.Timeout.Duration()
+	r.Concurrency = cfg.Concurrency
+	r.Logger = logger
+
+	events := make([]string, 0, len(cfg.Events))
+	for event := range cfg.Events {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		for _, h := range cfg.Events[event] {
+			r.Add(event, hooks.Hook{Shell: h.Command, Exec: h.Exec, Timeout: h.Timeout.Duration()})
+		}
+	}
+	return r
+}
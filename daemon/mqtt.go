@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/mqtt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// MQTTConfig describes the MQTT publisher of the daemon.
+type MQTTConfig struct {
+	Enabled bool `json:"enabled"`
+	// Broker is the address of the broker, localhost:1883 by default.
+	Broker   string `json:"broker"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	// Password, or the content of PasswordFile, authenticates Username.
+	Password     string   `json:"password"`
+	PasswordFile string   `json:"password_file"`
+	KeepAlive    Duration `json:"keep_alive"`
+	// Topic is the prefix of the topics, pivoyager/<node_id> by default.
+	Topic string `json:"topic"`
+	// DiscoveryPrefix is the Home Assistant discovery prefix. An empty
+	// prefix disables discovery.
+	DiscoveryPrefix string `json:"discovery_prefix"`
+	// NodeID identifies the PiVoyager, the host name by default.
+	NodeID string `json:"node_id"`
+	// Name is the device name in Home Assistant.
+	Name string `json:"name"`
+	// Interval is the longest time between two publications of the state.
+	Interval Duration `json:"interval"`
+	// Commands subscribes to the command topics. It is off by default, since
+	// anyone allowed to publish on them can shut the Pi down.
+	Commands bool `json:"commands"`
+}
+
+func DefaultMQTTConfig() MQTTConfig {
+	return MQTTConfig{
+		Broker:          mqtt.DEFAULT_BROKER,
+		KeepAlive:       Duration(mqtt.DEFAULT_KEEP_ALIVE),
+		DiscoveryPrefix: mqtt.DEFAULT_DISCOVERY_PREFIX,
+		Name:            "PiVoyager",
+		Interval:        Duration(mqtt.DEFAULT_INTERVAL),
+	}
+}
+
+var invalidNodeID = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+func (cfg *MQTTConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Password != "" && cfg.PasswordFile != "" {
+		return fmt.Errorf("mqtt password and password_file cannot be both set")
+	}
+	if cfg.NodeID != "" && invalidNodeID.MatchString(cfg.NodeID) {
+		return fmt.Errorf("mqtt node_id may only contain letters, digits, '_' and '-'")
+	}
+	if strings.ContainsAny(cfg.Topic, "+#") {
+		return fmt.Errorf("mqtt topic cannot contain wildcards")
+	}
+	if cfg.KeepAlive.Duration().Seconds() < 1 || cfg.KeepAlive.Duration().Seconds() > 65535 {
+		return fmt.Errorf("mqtt keep_alive must be between 1s and 65535s")
+	}
+	return nil
+}
+
+func (cfg *MQTTConfig) nodeID() string {
+	if cfg.NodeID != "" {
+		return cfg.NodeID
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "pivoyager"
+	}
+	return invalidNodeID.ReplaceAllString(strings.SplitN(hostname, ".", 2)[0], "_")
+}
+
+func (d *Daemon) newMQTT() *mqtt.Publisher {
+	cfg := &d.Config.MQTT
+
+	node := cfg.nodeID()
+	topic := cfg.Topic
+	if topic == "" {
+		topic = mqtt.DEFAULT_TOPIC + "/" + node
+	}
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "pivoyager-" + node
+	}
+	opts := mqtt.Options{
+		Broker:    cfg.Broker,
+		ClientID:  clientID,
+		Username:  cfg.Username,
+		Password:  cfg.Password,
+		KeepAlive: cfg.KeepAlive.Duration(),
+	}
+	p := mqtt.NewPublisher(opts, topic, node)
+	p.DiscoveryPrefix = cfg.DiscoveryPrefix
+	p.Name = cfg.Name
+	p.Interval = cfg.Interval.Duration()
+	p.Logger = d.Logger
+	p.Commands = cfg.Commands
+	p.Device = d.Device
+	if d.Shutdown != nil {
+		p.Shutdown = d.Shutdown
+	}
+	return p
+}
+
+// runMQTT publishes to the MQTT broker until ctx is cancelled.
+func (d *Daemon) runMQTT(ctx context.Context, p *mqtt.Publisher) error {
+	cfg := &d.Config.MQTT
+
+	if cfg.PasswordFile != "" {
+		data, err := ioutil.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return err
+		}
+		p.Options.Password = strings.TrimSpace(string(data))
+	}
+	if firmware, err := d.Device.FirmwareVersion(); err == nil {
+		p.Firmware = firmware
+	}
+	return p.Run(ctx)
+}
@@ -0,0 +1,68 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/monitor"
+	"github.com/omzlo/pivoyager/nis"
+	"time"
+)
+
+// NISConfig describes the apcupsd Network Information Server of the
+// daemon.
+type NISConfig struct {
+	Enabled bool `json:"enabled"`
+	// Listen is the TCP address of the server, 127.0.0.1:3551 by default.
+	Listen string `json:"listen"`
+	// Name is the UPS name reported as UPSNAME.
+	Name string `json:"name"`
+	// Events is the number of events kept in the event log.
+	Events int `json:"events"`
+}
+
+func DefaultNISConfig() NISConfig {
+	return NISConfig{
+		Listen: nis.DEFAULT_ADDRESS,
+		Name:   "pivoyager",
+		Events: nis.DEFAULT_EVENTS,
+	}
+}
+
+func (cfg *NISConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if err := validateListen("nis", cfg.Listen); err != nil {
+		return err
+	}
+	if cfg.Events < 1 {
+		return fmt.Errorf("nis events must be at least 1, got %d", cfg.Events)
+	}
+	return nil
+}
+
+func (d *Daemon) newNIS() *nis.Server {
+	cfg := &d.Config.NIS
+
+	srv := nis.NewServer(cfg.Name, d.Monitor)
+	srv.MaxAge = 3 * d.Monitor.Interval
+	srv.LowBatteryVoltage = d.Monitor.LowBatteryVoltage
+	srv.MaxEvents = cfg.Events
+	srv.Logger = d.Logger
+	srv.TimeLeft = func(s monitor.Sample) (time.Duration, bool) {
+		return s.Runtime.TimeToEmpty, s.Runtime.TimeToEmpty > 0
+	}
+	if d.Shutdown != nil {
+		srv.ShuttingDown = d.Shutdown.ShuttingDown
+	}
+	return srv
+}
+
+// runNIS serves apcupsd NIS clients until ctx is cancelled.
+func (d *Daemon) runNIS(ctx context.Context, srv *nis.Server) error {
+	srv.Version = d.Version
+	if firmware, err := d.Device.FirmwareVersion(); err == nil {
+		srv.Static = map[string]string{"FIRMWARE": firmware}
+	}
+	return srv.ListenAndServe(ctx, d.Config.NIS.Listen)
+}
@@ -0,0 +1,64 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/nut"
+)
+
+// NUTConfig describes the Network UPS Tools server of the daemon.
+type NUTConfig struct {
+	Enabled bool `json:"enabled"`
+	// Listen is the TCP address of the server, 127.0.0.1:3493 by default.
+	Listen string `json:"listen"`
+	// Name is the name of the UPS seen by clients, e.g. pivoyager@host.
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Users       []nut.User `json:"users"`
+}
+
+func DefaultNUTConfig() NUTConfig {
+	return NUTConfig{
+		Listen:      nut.DEFAULT_ADDRESS,
+		Name:        nut.DEFAULT_NAME,
+		Description: "PiVoyager UPS",
+	}
+}
+
+func (cfg *NUTConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if err := validateListen("nut", cfg.Listen); err != nil {
+		return err
+	}
+	if cfg.Name == "" {
+		return fmt.Errorf("nut name cannot be empty")
+	}
+	for _, u := range cfg.Users {
+		if u.Name == "" || u.Password == "" {
+			return fmt.Errorf("nut users need a name and a password")
+		}
+	}
+	return nil
+}
+
+// runNUT serves NUT clients until ctx is cancelled.
+func (d *Daemon) runNUT(ctx context.Context) error {
+	cfg := &d.Config.NUT
+
+	srv := nut.NewServer(cfg.Name, d.Monitor)
+	srv.Description = cfg.Description
+	srv.Version = d.Version
+	srv.Users = cfg.Users
+	srv.MaxAge = 3 * d.Monitor.Interval
+	srv.LowBatteryVoltage = d.Monitor.LowBatteryVoltage
+	srv.Logger = d.Logger
+	if d.Shutdown != nil {
+		srv.Shutdown = d.Shutdown
+	}
+	if firmware, err := d.Device.FirmwareVersion(); err == nil {
+		srv.Static = map[string]string{"ups.firmware": firmware}
+	}
+	return srv.ListenAndServe(ctx, cfg.Listen)
+}
@@ -0,0 +1,312 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"github.com/omzlo/pivoyager/watchdog"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownConfig describes when and how the daemon shuts the system down
+// while running on battery.
+type ShutdownConfig struct {
+	Enabled bool `json:"enabled"`
+	// OnLowBattery shuts down when the charger reports a low battery.
+	OnLowBattery bool `json:"on_low_battery"`
+	// BatteryVoltage, if not zero, shuts down when the battery voltage
+	// drops below it.
+	BatteryVoltage float32 `json:"battery_voltage"`
+	// BatteryBudget, if not zero, shuts down after running on battery for
+	// that long.
+	BatteryBudget Duration `json:"battery_budget"`
+	// Grace is the time the operating system needs to shut down. The low
+	// battery timer is raised to at least this value so that power is not
+	// removed before the filesystems are synced. When the charger does not
+	// report a low battery, the PiVoyager does not cut power on its own, so
+	// the i2c watchdog is armed for twice Grace to power-cycle the halted
+	// Pi.
+	Grace Duration `json:"grace"`
+	// PreHooks are shell commands run, in order, before shutting down.
+	PreHooks    []string `json:"pre_hooks"`
+	HookTimeout Duration `json:"hook_timeout"`
+	// WakeOnPower restarts the Pi when USB power comes back.
+	WakeOnPower bool `json:"wake_on_power"`
+	// WakeAfter, if not zero, restarts the Pi after that long.
+	WakeAfter Duration `json:"wake_after"`
+	// Command is the command shutting the system down.
+	Command []string `json:"command"`
+	// DryRun logs the shutdown command instead of running it.
+	DryRun bool `json:"dry_run"`
+}
+
+func DefaultShutdownConfig() ShutdownConfig {
+	return ShutdownConfig{
+		OnLowBattery: true,
+		Grace:        Duration(30 * time.Second),
+		HookTimeout:  Duration(30 * time.Second),
+		WakeOnPower:  true,
+		Command:      []string{"/sbin/shutdown", "-h", "now"},
+	}
+}
+
+func (cfg *ShutdownConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if len(cfg.Command) == 0 {
+		return errors.New("shutdown command cannot be empty")
+	}
+	if cfg.Grace.Duration() < time.Second || cfg.Grace.Duration() > 0xFFFF*time.Second {
+		return fmt.Errorf("shutdown grace must be between 1s and 65535s, got %s", cfg.Grace.Duration())
+	}
+	if cfg.WakeAfter.Duration() > 0xFFFF*time.Second {
+		return fmt.Errorf("wake_after must be at most 65535s, got %s", cfg.WakeAfter.Duration())
+	}
+	return nil
+}
+
+var (
+	ShutdownInProgress = errors.New("Shutdown already in progress")
+	ShutdownAborted    = errors.New("Shutdown aborted: USB power is back")
+)
+
+// Shutdown is a monitor handler that shuts the system down when the
+// battery runs out, as described by its ShutdownConfig. It can also be
+// triggered directly, e.g. by a network UPS client.
+type Shutdown struct {
+	Config  ShutdownConfig
+	Device  *device.Device
+	Monitor *monitor.Monitor
+	// Watchdog, if not nil, is the watchdog kicked by the daemon. It is
+	// released before shutting down, so that it neither kicks nor disarms
+	// the watchdog arming the power cut.
+	Watchdog *watchdog.Watchdog
+	Logger   *log.Logger
+
+	mu           sync.Mutex
+	onBattery    time.Time
+	inProgress   bool
+	shuttingDown bool
+}
+
+func NewShutdown(dev *device.Device, m *monitor.Monitor, cfg ShutdownConfig, logger *log.Logger) *Shutdown {
+	return &Shutdown{Config: cfg, Device: dev, Monitor: m, Logger: logger}
+}
+
+// Resume carries over the state of prev, replaced on a reload, so that the
+// battery budget still counts from the start of the outage.
+func (s *Shutdown) Resume(prev *Shutdown) {
+	prev.mu.Lock()
+	onBattery, shuttingDown := prev.onBattery, prev.shuttingDown
+	prev.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onBattery = onBattery
+	s.shuttingDown = shuttingDown
+}
+
+func (s *Shutdown) HandleEvent(e monitor.Event) {
+}
+
+// HandleSample checks each sample against the shutdown conditions.
+func (s *Shutdown) HandleSample(sample monitor.Sample) {
+	s.mu.Lock()
+	if !sample.OnBattery() {
+		s.onBattery = time.Time{}
+		s.mu.Unlock()
+		return
+	}
+	if s.onBattery.IsZero() {
+		s.onBattery = sample.Time
+	}
+	since := s.onBattery
+	busy := s.inProgress || s.shuttingDown
+	s.mu.Unlock()
+
+	if busy {
+		return
+	}
+	if reason := s.reason(sample, since); reason != "" {
+		go func() {
+			if err := s.shutdown(reason, false, true); err != nil {
+				s.Logger.Printf("Shutdown: %s", err)
+			}
+		}()
+	}
+}
+
+func (s *Shutdown) reason(sample monitor.Sample, since time.Time) string {
+	cfg := &s.Config
+
+	if cfg.OnLowBattery && sample.Status.Charger == device.CHARGER_LOW_BATTERY {
+		return "low battery"
+	}
+	if cfg.BatteryVoltage > 0 && sample.VBat < cfg.BatteryVoltage {
+		return fmt.Sprintf("battery voltage %.2fV below %.2fV", sample.VBat, cfg.BatteryVoltage)
+	}
+	if cfg.BatteryBudget > 0 && sample.Time.Sub(since) >= cfg.BatteryBudget.Duration() {
+		return fmt.Sprintf("running on battery for more than %s", cfg.BatteryBudget.Duration())
+	}
+	return ""
+}
+
+// OnBatterySince returns when the system started running on battery, or
+// the zero time if it runs on USB power.
+func (s *Shutdown) OnBatterySince() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.onBattery
+}
+
+// ShuttingDown reports whether the shutdown command was issued.
+func (s *Shutdown) ShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// Shutdown shuts the system down now. If stayOff is true, the wakeup
+// options are disabled so that the Pi does not restart on its own.
+func (s *Shutdown) Shutdown(reason string, stayOff bool) error {
+	return s.shutdown(reason, stayOff, false)
+}
+
+func (s *Shutdown) shutdown(reason string, stayOff bool, automatic bool) error {
+	s.mu.Lock()
+	if s.inProgress || s.shuttingDown {
+		s.mu.Unlock()
+		return ShutdownInProgress
+	}
+	s.inProgress = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inProgress = false
+		s.mu.Unlock()
+	}()
+
+	s.Logger.Printf("Shutting down: %s", reason)
+	for _, hook := range s.Config.PreHooks {
+		s.runHook(hook, reason)
+	}
+
+	if automatic && s.Monitor != nil {
+		if sample, ok := s.Monitor.Latest(); ok && !sample.OnBattery() {
+			s.Logger.Printf("%s", ShutdownAborted)
+			return ShutdownAborted
+		}
+	}
+
+	if err := s.prepareDevice(stayOff); err != nil {
+		// Shutting down is still safer than running the battery flat.
+		s.Logger.Printf("Failed to prepare pivoyager for shutdown: %s", err)
+	}
+
+	s.mu.Lock()
+	s.shuttingDown = true
+	s.mu.Unlock()
+
+	syscall.Sync()
+	if s.Config.DryRun {
+		s.Logger.Printf("Dry run, not running %q", s.Config.Command)
+		return nil
+	}
+	cmd := exec.Command(s.Config.Command[0], s.Config.Command[1:]...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		s.mu.Lock()
+		s.shuttingDown = false
+		s.mu.Unlock()
+		return fmt.Errorf("Shutdown command %q failed: %w", s.Config.Command, err)
+	}
+	return nil
+}
+
+func (s *Shutdown) runHook(hook string, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config.HookTimeout.Duration())
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", hook)
+	cmd.Env = append(os.Environ(), "PIVOYAGER_SHUTDOWN_REASON="+reason)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		s.Logger.Printf("Pre-shutdown hook %q failed: %s", hook, err)
+	}
+}
+
+// prepareDevice arms the wakeup options and makes sure the PiVoyager cuts
+// power only once the operating system had Grace to shut down.
+//
+// The PiVoyager cuts power on its own only when the charger reports a low
+// battery. Otherwise, unless stayOff is set, the i2c watchdog power-cycles
+// the halted Pi after twice Grace. The Pi then restarts right away rather
+// than on the wakeup options, and shuts down again if the trigger still
+// holds. With stayOff, the halted Pi stays powered until the battery runs
+// low.
+func (s *Shutdown) prepareDevice(stayOff bool) error {
+	cfg := &s.Config
+	grace := uint16(cfg.Grace.Duration() / time.Second)
+
+	if s.Watchdog != nil {
+		s.Watchdog.Release()
+	}
+	return s.Device.Atomically(func(dev *device.Device) error {
+		// A halted Pi does not kick the watchdog, which would restart it.
+		if err := dev.ModifyConfiguration(device.CONF_I2C_WD|device.CONF_PIN_WD, 0); err != nil {
+			return err
+		}
+		if stayOff {
+			wake := device.ConfigurationByte(device.CONF_WAKE_AFTER | device.CONF_WAKE_ALARM | device.CONF_WAKE_POWER | device.CONF_WAKE_BUTTON)
+			if err := dev.ModifyConfiguration(wake, 0); err != nil {
+				return err
+			}
+		} else {
+			if cfg.WakeOnPower {
+				if err := dev.ModifyConfiguration(device.CONF_WAKE_POWER, device.CONF_WAKE_POWER); err != nil {
+					return err
+				}
+			}
+			if cfg.WakeAfter > 0 {
+				if err := dev.SetWakeup(uint16(cfg.WakeAfter.Duration()/time.Second), device.CONF_WAKE_AFTER); err != nil {
+					return err
+				}
+			}
+		}
+		timer, err := dev.LowBatteryTimer()
+		if err != nil {
+			return err
+		}
+		if timer < grace {
+			timer = grace
+		}
+		if err := dev.SetLowBatteryTimer(timer, device.CONF_LBO_SHUTDOWN); err != nil {
+			return err
+		}
+		if stayOff {
+			return nil
+		}
+		status, err := dev.Status()
+		if err != nil {
+			return err
+		}
+		if status.Decode().Charger == device.CHARGER_LOW_BATTERY {
+			return nil
+		}
+		delay := 2 * uint32(grace)
+		if delay > 0xFFFF {
+			delay = 0xFFFF
+		}
+		return dev.SetWatchdog(uint16(delay), device.CONF_I2C_WD)
+	})
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/gpio"
+	"github.com/omzlo/pivoyager/watchdog"
+	"time"
+)
+
+type FileCheckConfig struct {
+	Path   string   `json:"path"`
+	MaxAge Duration `json:"max_age"`
+}
+
+// WatchdogConfig describes the watchdog kicked by the daemon, and the
+// health checks that must pass for it to be kicked.
+type WatchdogConfig struct {
+	Enabled bool `json:"enabled"`
+	// Mechanism is "i2c" or "gpio".
+	Mechanism string `json:"mechanism"`
+	// GPIOChip and GPIOLine select the watchdog pin with the gpio mechanism.
+	GPIOChip string   `json:"gpio_chip"`
+	GPIOLine uint32   `json:"gpio_line"`
+	Timeout  Duration `json:"timeout"`
+	Interval Duration `json:"interval"`
+	// KeepArmed leaves the watchdog armed when the daemon stops.
+	KeepArmed     bool              `json:"keep_armed"`
+	CheckCommands []string          `json:"check_commands"`
+	CheckFiles    []FileCheckConfig `json:"check_files"`
+	CheckUnits    []string          `json:"check_units"`
+	// MinAvailableMemory is in MiB, 0 disables the check.
+	MinAvailableMemory uint64 `json:"min_available_memory"`
+}
+
+func DefaultWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{
+		Mechanism: watchdog.MECHANISM_I2C,
+		GPIOChip:  gpio.DEFAULT_CHIP,
+		GPIOLine:  watchdog.WATCHDOG_GPIO,
+		Timeout:   Duration(watchdog.DEFAULT_TIMEOUT),
+	}
+}
+
+func (cfg *WatchdogConfig) Validate() error {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Mechanism != watchdog.MECHANISM_I2C && cfg.Mechanism != watchdog.MECHANISM_GPIO {
+		return fmt.Errorf("watchdog mechanism must be 'i2c' or 'gpio', got '%s'", cfg.Mechanism)
+	}
+	if _, err := watchdog.Seconds(cfg.Timeout.Duration()); err != nil {
+		return err
+	}
+	if cfg.Interval.Duration() >= cfg.Timeout.Duration() {
+		return errors.New("watchdog interval must be shorter than its timeout")
+	}
+	for _, f := range cfg.CheckFiles {
+		if f.Path == "" || f.MaxAge <= 0 {
+			return errors.New("watchdog file checks need a path and a max_age")
+		}
+	}
+	return nil
+}
+
+// run kicks the watchdog with the mechanism selected by cfg until ctx is
+// cancelled.
+func (cfg *WatchdogConfig) run(ctx context.Context, w *watchdog.Watchdog, dev *device.Device) error {
+	if cfg.Mechanism != watchdog.MECHANISM_GPIO {
+		w.Kicker = watchdog.NewI2CKicker(dev)
+		return w.Run(ctx)
+	}
+	pin, err := gpio.RequestOutput(cfg.GPIOChip, cfg.GPIOLine, "pivoyager-watchdog", false)
+	if err != nil {
+		return err
+	}
+	defer pin.Close()
+	w.Kicker = watchdog.NewGPIOKicker(dev, pin)
+	return w.Run(ctx)
+}
+
+// Checks returns the health checks described by cfg.
+func (cfg *WatchdogConfig) Checks() []watchdog.Check {
+	var checks []watchdog.Check
+
+	for _, c := range cfg.CheckCommands {
+		checks = append(checks, &watchdog.CommandCheck{Command: c})
+	}
+	for _, f := range cfg.CheckFiles {
+		checks = append(checks, &watchdog.FileCheck{Path: f.Path, MaxAge: time.Duration(f.MaxAge)})
+	}
+	for _, u := range cfg.CheckUnits {
+		checks = append(checks, &watchdog.UnitCheck{Unit: u})
+	}
+	if cfg.MinAvailableMemory > 0 {
+		checks = append(checks, &watchdog.MemoryCheck{MinAvailable: cfg.MinAvailableMemory << 20})
+	}
+	return checks
+}
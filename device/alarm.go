@@ -24,7 +24,7 @@ const (
 var weekdays = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
 
 func BCDstring(b Alarm) string {
-	return string('0' + FromBCD(byte(b&0xF)))
+	return string(rune('0' + FromBCD(byte(b&0xF))))
 }
 
 func MewAlarm() *Alarm {
@@ -101,6 +101,10 @@ func (a Alarm) String() string {
 	return s
 }
 
+func (a Alarm) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
 func matchWeekday(s string) (int, error) {
 	if len(s) < 3 {
 		return 0, fmt.Errorf("Weekday name must be at least 3 characters long, got %d.", len(s))
@@ -1,9 +1,12 @@
 package device
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/omzlo/pivoyager/i2c"
+	"io"
+	"os"
 	"strings"
 	"time"
 )
@@ -13,10 +16,21 @@ type DeviceStatus byte
 /*  TODO: DeviceStatus and ConfiguratioByte should probably be factored together */
 
 var (
-	stateBits = [8]string{"pg", "stat1", "stat2", "5v", "inits", "!B5!", "alarm", "button"}
+	stateBits = [8]string{"pg", "stat1", "stat2", "5v", "inits", "reserved", "alarm", "button"}
 	batState  = [8]string{"n/a", "fault", "err", "charge complete", "low battery", "charging", "discharging", "no battery"}
 )
 
+const (
+	STAT_PG       = 0x01
+	STAT_STAT1    = 0x02
+	STAT_STAT2    = 0x04
+	STAT_5V       = 0x08
+	STAT_INITS    = 0x10
+	STAT_RESERVED = 0x20
+	STAT_ALARM    = 0x40
+	STAT_BUTTON   = 0x80
+)
+
 func (s DeviceStatus) BatteryStateString() string {
 	return batState[s&7]
 }
@@ -63,6 +77,14 @@ func (s DeviceStatus) String() string {
 	return strings.Join(s.ToStrings(), " ")
 }
 
+func (s DeviceStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *DeviceStatus) UnmarshalText(data []byte) error {
+	return s.FromStrings(strings.Fields(string(data)))
+}
+
 /*******/
 
 const (
@@ -93,6 +115,7 @@ const (
 
 const (
 	DEVICE_ADDRESS = 0x65
+	DEVICE_BUS     = 1
 )
 
 const (
@@ -156,29 +179,163 @@ func (c ConfigurationByte) String() string {
 	return strings.Join(c.ToStrings(), " ")
 }
 
+func (c ConfigurationByte) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *ConfigurationByte) UnmarshalText(data []byte) error {
+	return c.FromStrings(strings.Fields(string(data)))
+}
+
+// MarshalJSON encodes the configuration as a list of options.
+func (c ConfigurationByte) MarshalJSON() ([]byte, error) {
+	options := c.ToStrings()
+	if options == nil {
+		options = []string{}
+	}
+	return json.Marshal(options)
+}
+
+func (c *ConfigurationByte) UnmarshalJSON(data []byte) error {
+	var options []string
+
+	if err := json.Unmarshal(data, &options); err != nil {
+		return err
+	}
+	return c.FromStrings(options)
+}
+
+// Bus is the transport used by Device to reach the PiVoyager registers.
+// i2c.Bus implements it for /dev/i2c-N, but mocks, remote buses or
+// simulators can be used as well.
+type Bus interface {
+	ReadByte(addr byte, reg byte) (byte, error)
+	ReadBytes(addr byte, reg byte, data []byte) error
+	WriteByte(addr byte, reg byte, data byte) error
+	WriteBytes(addr byte, reg byte, data []byte) error
+	ModifyByte(addr byte, reg byte, mask byte, data byte) error
+	Close() error
+}
+
 type Device struct {
-	i2c.Bus
+	Bus
 	address byte
+	lock    *Lock
+
+	sampling    Sampling
+	calibration Calibration
+	progress    io.Writer
 }
 
 var (
 	ModeError error = errors.New("Device in incorrect mode")
 )
 
+// New returns a Device talking to the PiVoyager at the given address on bus.
+// Unlike Open, it does not check the device signature: see CheckMode.
+// Operations are serialised between goroutines, but not between processes:
+// see SetLock.
+func New(bus Bus, address byte) *Device {
+	return &Device{
+		Bus:         bus,
+		address:     address,
+		lock:        NewLock(""),
+		sampling:    DefaultSampling(),
+		calibration: DefaultCalibration(),
+		progress:    os.Stderr,
+	}
+}
+
+// SetLock replaces the lock used to serialise operations on the device.
+func (dev *Device) SetLock(lock *Lock) {
+	dev.lock = lock
+}
+
+// Options select how OpenWithOptions reaches the PiVoyager.
+type Options struct {
+	// BusNumber selects /dev/i2c-<BusNumber>, unless DevicePath is set.
+	BusNumber int
+	// DevicePath is the i2c device node to use, such as /dev/i2c-3.
+	DevicePath string
+	Address    byte
+	Bootloader bool
+	// Retry is applied to all transactions on the bus.
+	Retry RetryPolicy
+	// LockPath is the lock file shared by all processes using the device.
+	// If empty, operations are only serialised within the process.
+	LockPath string
+	// Transport, if not nil, is used instead of opening the device node.
+	Transport Bus
+	// Sampling and Calibration select how Voltage reads the battery.
+	Sampling    Sampling
+	Calibration Calibration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		BusNumber:   DEVICE_BUS,
+		Address:     DEVICE_ADDRESS,
+		Retry:       DefaultRetryPolicy,
+		LockPath:    DEFAULT_LOCK_PATH,
+		Sampling:    DefaultSampling(),
+		Calibration: DefaultCalibration(),
+	}
+}
+
+func (opts Options) Path() string {
+	if opts.DevicePath != "" {
+		return opts.DevicePath
+	}
+	return i2c.BusPath(opts.BusNumber)
+}
+
 func Open(bootloader bool) (*Device, error) {
-	bus := i2c.OpenBus(1)
-	r, err := bus.ReadByte(DEVICE_ADDRESS, REG_MODE)
+	opts := DefaultOptions()
+	opts.Bootloader = bootloader
+	return OpenWithOptions(opts)
+}
+
+func OpenWithOptions(opts Options) (*Device, error) {
+	var bus Bus = opts.Transport
+
+	if bus == nil {
+		b, err := i2c.Open(opts.Path())
+		if err != nil {
+			return nil, err
+		}
+		bus = b
+	}
+	dev := New(NewRetryBus(bus, opts.Retry), opts.Address)
+	dev.SetLock(NewLock(opts.LockPath))
+	dev.SetSampling(opts.Sampling)
+	dev.SetCalibration(opts.Calibration)
+	if err := dev.CheckMode(opts.Bootloader); err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return dev, nil
+}
+
+// CheckMode verifies that the device answers with a PiVoyager signature
+// and that it is in bootloader mode if bootloader is true, or in normal
+// mode otherwise.
+func (dev *Device) CheckMode(bootloader bool) error {
+	r, err := dev.ReadByte(dev.address, REG_MODE)
 	if err != nil {
-		return nil, fmt.Errorf("Could not connect to i2c device: %s", err)
+		return fmt.Errorf("Could not connect to i2c device: %w", err)
 	}
 
 	if r != 'N' && r != 'B' {
-		return nil, fmt.Errorf("Unrecognized signature byte 0x%02x. i2c device does not seem to be a pivoyager", r)
+		return fmt.Errorf("Unrecognized signature byte 0x%02x. i2c device does not seem to be a pivoyager", r)
 	}
 	if (bootloader && r != 'B') || (!bootloader && r != 'N') {
-		return nil, ModeError
+		return ModeError
 	}
-	return &Device{bus, DEVICE_ADDRESS}, nil
+	return nil
+}
+
+func (dev *Device) Address() byte {
+	return dev.address
 }
 
 func (dev *Device) FirmwareVersion() (string, error) {
@@ -201,6 +358,28 @@ func (dev *Device) Time() (time.Time, error) {
 }
 
 func (dev *Device) SetTime(tm time.Time) error {
+	return dev.Atomically(func(dev *Device) error {
+		return dev.setTime(tm)
+	})
+}
+
+// SyncTime sets the RTC to the system time, in UTC. As the RTC has no
+// sub-second resolution, it waits for the start of a second first.
+func (dev *Device) SyncTime() (time.Time, error) {
+	var tm time.Time
+
+	for {
+		tm = time.Now()
+		if tm.Nanosecond() < 100000 {
+			break
+		}
+		time.Sleep(50000 * time.Nanosecond)
+	}
+	tm = tm.UTC()
+	return tm, dev.SetTime(tm)
+}
+
+func (dev *Device) setTime(tm time.Time) error {
 	var buf [8]byte
 	buf[0] = ToBCD(tm.Second())
 	buf[1] = ToBCD(tm.Minute())
@@ -233,20 +412,6 @@ func (dev *Device) Program(b byte) error {
 	return dev.WriteByte(dev.address, REG_PROG, b)
 }
 
-func (dev *Device) Voltage() (float32, float32, error) {
-	var buf [6]byte
-	var vbat, vref, vcal uint16
-
-	if err := dev.ReadBytes(dev.address, REG_VBAT, buf[:]); err != nil {
-		return 0, 0, err
-	}
-	vbat = uint16(buf[0]) + (uint16(buf[1]) << 8)
-	vref = uint16(buf[2]) + (uint16(buf[3]) << 8)
-	vcal = uint16(buf[4]) + (uint16(buf[5]) << 8)
-	Ref := 3.3 * float32(vcal) / float32(vref)
-	return 2 * Ref * float32(vbat) / 4095.0, Ref, nil
-}
-
 func (dev *Device) Configuration() (ConfigurationByte, error) {
 	conf, err := dev.ReadByte(dev.address, REG_CONF)
 	if err != nil {
@@ -259,6 +424,8 @@ func (dev *Device) SetConfiguration(conf ConfigurationByte) error {
 	return dev.WriteByte(dev.address, REG_CONF, byte(conf))
 }
 
+// ModifyConfiguration changes the bits of the configuration selected by
+// mask, in a single locked read-modify-write.
 func (dev *Device) ModifyConfiguration(mask ConfigurationByte, conf ConfigurationByte) error {
 	return dev.ModifyByte(dev.address, REG_CONF, byte(mask), byte(conf))
 }
@@ -274,16 +441,28 @@ func (dev *Device) Watchdog() (uint16, error) {
 }
 
 func (dev *Device) SetWatchdog(delay uint16, conf byte) error {
-	var buf [2]byte
+	return dev.Atomically(func(dev *Device) error {
+		return dev.setWatchdog(delay, conf)
+	})
+}
 
-	buf[0] = byte(delay)
-	buf[1] = byte(delay >> 8)
-	if err := dev.WriteBytes(dev.address, REG_WATCH, buf[:]); err != nil {
+func (dev *Device) setWatchdog(delay uint16, conf byte) error {
+	if err := dev.KickWatchdog(delay); err != nil {
 		return err
 	}
 	return dev.ModifyByte(dev.address, REG_CONF, conf, conf)
 }
 
+// KickWatchdog restarts the watchdog timer from delay seconds, without
+// touching the configuration.
+func (dev *Device) KickWatchdog(delay uint16) error {
+	var buf [2]byte
+
+	buf[0] = byte(delay)
+	buf[1] = byte(delay >> 8)
+	return dev.WriteBytes(dev.address, REG_WATCH, buf[:])
+}
+
 func (dev *Device) Wakeup() (uint16, error) {
 	var buf [2]byte
 
@@ -295,6 +474,12 @@ func (dev *Device) Wakeup() (uint16, error) {
 }
 
 func (dev *Device) SetWakeup(delay uint16, conf byte) error {
+	return dev.Atomically(func(dev *Device) error {
+		return dev.setWakeup(delay, conf)
+	})
+}
+
+func (dev *Device) setWakeup(delay uint16, conf byte) error {
 	var buf [2]byte
 
 	buf[0] = byte(delay)
@@ -316,6 +501,12 @@ func (dev *Device) Alarm() (Alarm, error) {
 }
 
 func (dev *Device) SetAlarm(a Alarm, conf byte) error {
+	return dev.Atomically(func(dev *Device) error {
+		return dev.setAlarm(a, conf)
+	})
+}
+
+func (dev *Device) setAlarm(a Alarm, conf byte) error {
 	var buf [4]byte
 
 	buf[0] = byte(a)
@@ -343,6 +534,12 @@ func (dev *Device) LowBatteryTimer() (uint16, error) {
 }
 
 func (dev *Device) SetLowBatteryTimer(delay uint16, conf byte) error {
+    return dev.Atomically(func(dev *Device) error {
+        return dev.setLowBatteryTimer(delay, conf)
+    })
+}
+
+func (dev *Device) setLowBatteryTimer(delay uint16, conf byte) error {
     var buf [2]byte
 
     buf[0] = byte(delay)
@@ -0,0 +1,60 @@
+package device_test
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/simulator"
+	"testing"
+	"time"
+)
+
+func newDevice(t *testing.T) (*simulator.PiVoyager, *device.Device) {
+	t.Helper()
+	sim := simulator.New()
+	dev := device.New(sim, device.DEVICE_ADDRESS)
+	if err := dev.CheckMode(false); err != nil {
+		t.Fatal(err)
+	}
+	return sim, dev
+}
+
+func TestTime(t *testing.T) {
+	_, dev := newDevice(t)
+
+	tm := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	if err := dev.SetTime(tm); err != nil {
+		t.Fatal(err)
+	}
+	rtc, err := dev.Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := rtc.Sub(tm); d < 0 || d > 2*time.Second {
+		t.Errorf("Time() = %s after SetTime(%s)", rtc, tm)
+	}
+}
+
+func TestFlash(t *testing.T) {
+	sim, dev := newDevice(t)
+	dev.SetFlashProgress(nil)
+
+	sim.EnterBootloader()
+	if err := dev.CheckMode(true); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*simulator.FLASH_PAGE_SIZE+64)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if err := dev.FlashWrite(data); err != nil {
+		t.Fatal(err)
+	}
+	read := make([]byte, len(data))
+	if err := dev.FlashRead(read); err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		if read[i] != data[i] {
+			t.Fatalf("FlashRead() byte %d = 0x%02x, expected 0x%02x", i, read[i], data[i])
+		}
+	}
+}
@@ -3,6 +3,8 @@ package device
 import (
     "time"
     "fmt"
+    "io"
+    "io/ioutil"
 )
 
 const (
@@ -27,6 +29,15 @@ const (
     APP_START_ADDR   = 0x08002000
 )
 
+// SetFlashProgress selects the writer receiving the progress bars of
+// FlashRead and FlashWrite, os.Stderr by default. A nil writer disables them.
+func (dev *Device) SetFlashProgress(w io.Writer) {
+    if w == nil {
+        w = ioutil.Discard
+    }
+    dev.progress = w
+}
+
 func (dev *Device) FlashAddress() (uint32, error) {
     var buf [4]byte
     err := dev.ReadBytes(dev.address, REG_BL_ADDR, buf[:])
@@ -70,14 +81,20 @@ func (dev *Device) waitProg(prog byte, gap time.Duration) error {
 }
 
 func (dev *Device) FlashRead(data []byte) error {
+    return dev.Atomically(func(dev *Device) error {
+        return dev.flashRead(data)
+    })
+}
+
+func (dev *Device) flashRead(data []byte) error {
     var buf [64]byte
 
     if err := dev.FlashSetAddress(APP_START_ADDR); err != nil {
        return err
     }
 
-    fmt.Printf("Reading: [")
-    defer fmt.Printf("\n")
+    fmt.Fprintf(dev.progress, "Reading: [")
+    defer fmt.Fprintf(dev.progress, "\n")
     for pos:=0; pos<len(data); pos+=64 {
         if err := dev.waitProg(PROG_BL_READ, 1 * time.Millisecond); err!=nil {
             return err
@@ -89,20 +106,20 @@ func (dev *Device) FlashRead(data []byte) error {
             return err
         }
         copy(data[pos:],buf[:])
-        fmt.Print("#")
+        fmt.Fprint(dev.progress, "#")
     }
-    fmt.Printf("]")
+    fmt.Fprintf(dev.progress, "]")
     return nil
 }
 
 func (dev *Device) flashErase(block_count int) error {
-    fmt.Printf("Erasing pages: [")
-    defer fmt.Print("\n")
+    fmt.Fprintf(dev.progress, "Erasing pages: [")
+    defer fmt.Fprint(dev.progress, "\n")
 
     for pos:=0; pos<block_count; pos++ {
         addr := APP_START_ADDR + uint32(pos*1024)
         //fmt.Printf("%x ", addr)
-        fmt.Print("#")
+        fmt.Fprint(dev.progress, "#")
         if err := dev.FlashSetAddress(addr); err != nil {
             return err
         }
@@ -110,15 +127,15 @@ func (dev *Device) flashErase(block_count int) error {
             return err
         }
     }
-    fmt.Print("]")
+    fmt.Fprint(dev.progress, "]")
     return nil
 }
 
 func (dev *Device) flashWrite(data []byte) error {
     var buf [64]byte
     
-    fmt.Printf("Writing: [")
-    defer fmt.Print("\n")
+    fmt.Fprintf(dev.progress, "Writing: [")
+    defer fmt.Fprint(dev.progress, "\n")
 
     for pos:=0; pos<len(data); pos+=64 {
         copy(buf[:],data[pos:])
@@ -131,14 +148,20 @@ func (dev *Device) flashWrite(data []byte) error {
         if err := dev.waitProg(PROG_BL_WRITE, 3 * time.Millisecond); err!=nil {
             return err
         }
-        fmt.Print("#")
+        fmt.Fprint(dev.progress, "#")
     }
-    fmt.Print("]")
+    fmt.Fprint(dev.progress, "]")
 
     return nil
 }
 
 func (dev *Device) FlashWrite(data []byte) error {
+    return dev.Atomically(func(dev *Device) error {
+        return dev.flashWriteAndVerify(data)
+    })
+}
+
+func (dev *Device) flashWriteAndVerify(data []byte) error {
 
     if err := dev.flashErase((len(data)+1023)/1024); err != nil {
         return err
@@ -153,7 +176,7 @@ func (dev *Device) FlashWrite(data []byte) error {
     }
 
     data_copy := make([]byte, len(data))
-    if err := dev.FlashRead(data_copy); err!=nil {
+    if err := dev.flashRead(data_copy); err!=nil {
         return err
     }
     for i := 0; i<len(data); i++ {
@@ -161,7 +184,7 @@ func (dev *Device) FlashWrite(data []byte) error {
             return fmt.Errorf("Inconsistent flash at byte %d, expected 0x%02x, found 0x%02x", i, data[i], data_copy[i])
         }
     }
-    fmt.Println("Flash content verified.")
+    fmt.Fprintln(dev.progress, "Flash content verified.")
     return nil
 }
 
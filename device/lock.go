@@ -0,0 +1,153 @@
+package device
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+const (
+	DEFAULT_LOCK_PATH = "/run/lock/pivoyager.lock"
+)
+
+// Lock serialises Device operations: between goroutines with a mutex, and
+// between processes with an advisory flock on a lock file. With an empty
+// path, only the mutex is used.
+type Lock struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func NewLock(path string) *Lock {
+	return &Lock{path: path}
+}
+
+func (l *Lock) Path() string {
+	return l.path
+}
+
+func (l *Lock) Lock() error {
+	l.mu.Lock()
+	if l.path == "" {
+		return nil
+	}
+	if l.file == nil {
+		file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			l.mu.Unlock()
+			return err
+		}
+		l.file = file
+	}
+	for {
+		err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EINTR {
+			l.mu.Unlock()
+			return &os.PathError{Op: "flock", Path: l.path, Err: err}
+		}
+	}
+}
+
+func (l *Lock) Unlock() {
+	if l.file != nil {
+		syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	}
+	l.mu.Unlock()
+}
+
+func (l *Lock) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// acquire takes the device lock and returns the function releasing it.
+func (dev *Device) acquire() (func(), error) {
+	if dev.lock == nil {
+		return func() {}, nil
+	}
+	if err := dev.lock.Lock(); err != nil {
+		return nil, fmt.Errorf("Could not lock device: %w", err)
+	}
+	return dev.lock.Unlock, nil
+}
+
+// Atomically runs fn while holding the device lock, so that the sequence
+// of operations it performs on the Device it receives cannot interleave
+// with operations from other goroutines or processes.
+func (dev *Device) Atomically(fn func(dev *Device) error) error {
+	release, err := dev.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	unlocked := *dev
+	unlocked.lock = nil
+	return fn(&unlocked)
+}
+
+/* Each bus transaction issued through the Device holds the lock, which
+ * makes ModifyByte's read-modify-write atomic. */
+
+func (dev *Device) ReadByte(addr byte, reg byte) (byte, error) {
+	release, err := dev.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return dev.Bus.ReadByte(addr, reg)
+}
+
+func (dev *Device) ReadBytes(addr byte, reg byte, data []byte) error {
+	release, err := dev.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return dev.Bus.ReadBytes(addr, reg, data)
+}
+
+func (dev *Device) WriteByte(addr byte, reg byte, data byte) error {
+	release, err := dev.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return dev.Bus.WriteByte(addr, reg, data)
+}
+
+func (dev *Device) WriteBytes(addr byte, reg byte, data []byte) error {
+	release, err := dev.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return dev.Bus.WriteBytes(addr, reg, data)
+}
+
+func (dev *Device) ModifyByte(addr byte, reg byte, mask byte, data byte) error {
+	release, err := dev.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return dev.Bus.ModifyByte(addr, reg, mask, data)
+}
+
+func (dev *Device) Close() error {
+	if dev.lock != nil {
+		dev.lock.Close()
+	}
+	return dev.Bus.Close()
+}
@@ -0,0 +1,83 @@
+package device_test
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockBetweenProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pivoyager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "pivoyager.lock")
+
+	// Each Lock opens the file on its own, like another process would.
+	a, b := device.NewLock(path), device.NewLock(path)
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error, 1)
+	go func() {
+		locked <- b.Lock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("the file lock was taken twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	a.Unlock()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("the file lock was not released")
+	}
+}
+
+func TestAtomically(t *testing.T) {
+	_, dev := newDevice(t)
+
+	inside := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.Atomically(func(dev *device.Device) error {
+			close(inside)
+			<-release
+			// The device passed to fn does not take the lock again.
+			_, err := dev.Status()
+			return err
+		})
+	}()
+	<-inside
+
+	status := make(chan error, 1)
+	go func() {
+		_, err := dev.Status()
+		status <- err
+	}()
+	select {
+	case <-status:
+		t.Fatal("Status() ran in the middle of Atomically")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-status; err != nil {
+		t.Fatal(err)
+	}
+}
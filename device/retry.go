@@ -0,0 +1,196 @@
+package device
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy describes how RetryBus retries failed transactions.
+type RetryPolicy struct {
+	// Attempts is the total number of attempts, including the first one.
+	// A value of 1 or less disables retries.
+	Attempts int
+	// Delay is the pause before the first retry. It is multiplied by
+	// Backoff after each retry, up to MaxDelay.
+	Delay    time.Duration
+	Backoff  float64
+	MaxDelay time.Duration
+	// Retriable lists the errno values worth retrying.
+	Retriable []syscall.Errno
+}
+
+// DefaultRetryPolicy retries bus timeouts and errors twice, which is enough
+// to get past the occasional glitch on a busy bus. NACKs (EREMOTEIO) are
+// not retried, since they mostly mean that the HAT is absent.
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  3,
+	Delay:     5 * time.Millisecond,
+	Backoff:   2,
+	MaxDelay:  100 * time.Millisecond,
+	Retriable: []syscall.Errno{syscall.ETIMEDOUT, syscall.EBUSY, syscall.EAGAIN, syscall.EIO},
+}
+
+func (p RetryPolicy) retriable(err error) bool {
+	var errno syscall.Errno
+
+	if !errors.As(err, &errno) {
+		return false
+	}
+	for _, e := range p.Retriable {
+		if e == errno {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryStats counts the transactions that went through a RetryBus.
+type RetryStats struct {
+	Operations uint64 `json:"operations"` // transactions requested
+	Errors     uint64 `json:"errors"`     // failed attempts, retried or not
+	Retries    uint64 `json:"retries"`    // attempts beyond the first one
+	Failures   uint64 `json:"failures"`   // transactions that failed after all attempts
+}
+
+// RetryBus wraps a Bus and retries transactions failing with a retriable
+// errno, according to Policy.
+type RetryBus struct {
+	Bus
+	Policy RetryPolicy
+	stats  RetryStats
+}
+
+func NewRetryBus(bus Bus, policy RetryPolicy) *RetryBus {
+	return &RetryBus{Bus: bus, Policy: policy}
+}
+
+func (r *RetryBus) Unwrap() Bus {
+	return r.Bus
+}
+
+func (r *RetryBus) Stats() RetryStats {
+	return RetryStats{
+		Operations: atomic.LoadUint64(&r.stats.Operations),
+		Errors:     atomic.LoadUint64(&r.stats.Errors),
+		Retries:    atomic.LoadUint64(&r.stats.Retries),
+		Failures:   atomic.LoadUint64(&r.stats.Failures),
+	}
+}
+
+// isCommand reports whether reg is a command register, REG_PROG or
+// REG_BL_PROG in bootloader mode, whose writes are not idempotent: a write
+// that reached the chip but lost its ACK would run the command twice.
+func isCommand(reg byte) bool {
+	return reg == REG_PROG || reg == REG_BL_PROG
+}
+
+// once runs a transaction a single time, counting it like do.
+func (r *RetryBus) once(op func() error) error {
+	atomic.AddUint64(&r.stats.Operations, 1)
+	err := op()
+	if err != nil {
+		atomic.AddUint64(&r.stats.Errors, 1)
+		atomic.AddUint64(&r.stats.Failures, 1)
+	}
+	return err
+}
+
+func (r *RetryBus) do(op func() error) error {
+	var err error
+
+	atomic.AddUint64(&r.stats.Operations, 1)
+	delay := r.Policy.Delay
+	for attempt := 1; ; attempt++ {
+		if err = op(); err == nil {
+			return nil
+		}
+		atomic.AddUint64(&r.stats.Errors, 1)
+		if attempt >= r.Policy.Attempts || !r.Policy.retriable(err) {
+			break
+		}
+		atomic.AddUint64(&r.stats.Retries, 1)
+		time.Sleep(delay)
+		if r.Policy.Backoff > 1 {
+			delay = time.Duration(float64(delay) * r.Policy.Backoff)
+			if r.Policy.MaxDelay > 0 && delay > r.Policy.MaxDelay {
+				delay = r.Policy.MaxDelay
+			}
+		}
+	}
+	atomic.AddUint64(&r.stats.Failures, 1)
+	return err
+}
+
+func (r *RetryBus) ReadByte(addr byte, reg byte) (byte, error) {
+	var b byte
+
+	err := r.do(func() (err error) {
+		b, err = r.Bus.ReadByte(addr, reg)
+		return
+	})
+	return b, err
+}
+
+func (r *RetryBus) ReadBytes(addr byte, reg byte, data []byte) error {
+	return r.do(func() error {
+		return r.Bus.ReadBytes(addr, reg, data)
+	})
+}
+
+// WriteByte retries writes, except to command registers.
+func (r *RetryBus) WriteByte(addr byte, reg byte, data byte) error {
+	op := func() error {
+		return r.Bus.WriteByte(addr, reg, data)
+	}
+	if isCommand(reg) {
+		return r.once(op)
+	}
+	return r.do(op)
+}
+
+func (r *RetryBus) WriteBytes(addr byte, reg byte, data []byte) error {
+	op := func() error {
+		return r.Bus.WriteBytes(addr, reg, data)
+	}
+	if isCommand(reg) {
+		return r.once(op)
+	}
+	return r.do(op)
+}
+
+// ModifyByte retries the whole read-modify-write sequence, which is safe
+// for registers holding a state, since the retry reads back the value
+// already written. Command registers are not retried.
+func (r *RetryBus) ModifyByte(addr byte, reg byte, mask byte, data byte) error {
+	op := func() error {
+		return r.Bus.ModifyByte(addr, reg, mask, data)
+	}
+	if isCommand(reg) {
+		return r.once(op)
+	}
+	return r.do(op)
+}
+
+// unwrapper is implemented by buses wrapping another Bus.
+type unwrapper interface {
+	Unwrap() Bus
+}
+
+// RetryStats returns the counters of the first RetryBus found in the chain
+// of buses used by dev, or zero counters if retries are not used.
+func (dev *Device) RetryStats() RetryStats {
+	bus := dev.Bus
+	for bus != nil {
+		if r, ok := bus.(*RetryBus); ok {
+			return r.Stats()
+		}
+		u, ok := bus.(unwrapper)
+		if !ok {
+			break
+		}
+		bus = u.Unwrap()
+	}
+	return RetryStats{}
+}
@@ -0,0 +1,35 @@
+package device_test
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/simulator"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	sim := simulator.New()
+	policy := device.DefaultRetryPolicy
+	policy.Delay = time.Millisecond
+	dev := device.New(device.NewRetryBus(sim, policy), device.DEVICE_ADDRESS)
+
+	sim.FailNext(2, syscall.EIO)
+	if _, err := dev.Status(); err != nil {
+		t.Errorf("Status() failed despite retries: %s", err)
+	}
+	sim.FailNext(1, syscall.EREMOTEIO)
+	if _, err := dev.Status(); err == nil {
+		t.Errorf("Status() retried a NACK")
+	}
+	// A command that failed may have run, so it is never retried.
+	sim.FailNext(1, syscall.EIO)
+	if err := dev.WriteByte(device.DEVICE_ADDRESS, device.REG_PROG, 0); err == nil {
+		t.Errorf("a write to the command register was retried")
+	}
+
+	stats := dev.RetryStats()
+	if stats.Operations != 3 || stats.Errors != 4 || stats.Retries != 2 || stats.Failures != 2 {
+		t.Errorf("RetryStats() = %+v", stats)
+	}
+}
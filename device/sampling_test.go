@@ -0,0 +1,53 @@
+package device_test
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"math"
+	"testing"
+)
+
+func TestVoltage(t *testing.T) {
+	sim, dev := newDevice(t)
+
+	for _, v := range []float64{3.3, 3.7, 4.2} {
+		sim.SetBatteryVoltage(v)
+		vbat, vref, err := dev.Voltage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(float64(vbat)-v) > 0.01 {
+			t.Errorf("Voltage() = %.3fV, expected %.3fV", vbat, v)
+		}
+		if math.Abs(float64(vref)-3.3) > 0.01 {
+			t.Errorf("Voltage() supply = %.3fV, expected 3.3V", vref)
+		}
+	}
+
+	dev.SetCalibration(device.Calibration{Gain: 1.02, Offset: -0.05})
+	sim.SetBatteryVoltage(3.7)
+	vbat, _, err := dev.Voltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := 1.02*3.7 - 0.05; math.Abs(float64(vbat)-expected) > 0.01 {
+		t.Errorf("calibrated Voltage() = %.3fV, expected %.3fV", vbat, expected)
+	}
+}
+
+func TestSampleVoltage(t *testing.T) {
+	sim, dev := newDevice(t)
+	sim.SetBatteryVoltage(3.8)
+	sim.SetADCNoise(20)
+
+	dev.SetSampling(device.Sampling{Samples: 31, Filter: device.FILTER_MEDIAN})
+	r, err := dev.ReadVoltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Samples != 31 {
+		t.Errorf("ReadVoltage() used %d samples, expected 31", r.Samples)
+	}
+	if math.Abs(float64(r.VBat)-3.8) > 0.02 {
+		t.Errorf("median of noisy readings = %.3fV, expected 3.8V", r.VBat)
+	}
+}
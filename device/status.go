@@ -0,0 +1,166 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ChargerState is the battery charger state, decoded from the pg, stat1
+// and stat2 status bits.
+type ChargerState byte
+
+const (
+	CHARGER_NA ChargerState = iota
+	CHARGER_FAULT
+	CHARGER_ERR
+	CHARGER_CHARGE_COMPLETE
+	CHARGER_LOW_BATTERY
+	CHARGER_CHARGING
+	CHARGER_DISCHARGING
+	CHARGER_NO_BATTERY
+)
+
+func (c ChargerState) String() string {
+	return batState[c&7]
+}
+
+func (c ChargerState) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *ChargerState) UnmarshalText(data []byte) error {
+	candidate := strings.ToLower(string(data))
+	for i, k := range batState {
+		if candidate == k {
+			*c = ChargerState(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid charger state: %s", data)
+}
+
+// Status is the decoded form of DeviceStatus.
+type Status struct {
+	Raw            DeviceStatus `json:"flags"`
+	PowerGood      bool         `json:"power_good"`
+	USB5V          bool         `json:"usb_5v"`
+	Charger        ChargerState `json:"charger"`
+	Initialized    bool         `json:"initialized"`
+	AlarmTriggered bool         `json:"alarm_triggered"`
+	ButtonPressed  bool         `json:"button_pressed"`
+}
+
+func (s DeviceStatus) Decode() Status {
+	return Status{
+		Raw:            s,
+		PowerGood:      (s & STAT_PG) != 0,
+		USB5V:          (s & STAT_5V) != 0,
+		Charger:        ChargerState(s & 7),
+		Initialized:    (s & STAT_INITS) != 0,
+		AlarmTriggered: (s & STAT_ALARM) != 0,
+		ButtonPressed:  (s & STAT_BUTTON) != 0,
+	}
+}
+
+func (s Status) String() string {
+	return s.Raw.String()
+}
+
+// statusFields avoids the recursion of Status.MarshalJSON into itself.
+type statusFields Status
+
+// MarshalJSON encodes all the decoded fields. It is needed because
+// MarshalText would otherwise take precedence.
+func (s Status) MarshalJSON() ([]byte, error) {
+	return json.Marshal(statusFields(s))
+}
+
+func (s *Status) UnmarshalJSON(data []byte) error {
+	var f statusFields
+
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*s = f.Raw.Decode()
+	return nil
+}
+
+// MarshalText encodes the status as its list of flags, such as "pg stat2 5v".
+func (s Status) MarshalText() ([]byte, error) {
+	return s.Raw.MarshalText()
+}
+
+func (s *Status) UnmarshalText(data []byte) error {
+	var raw DeviceStatus
+
+	if err := raw.UnmarshalText(data); err != nil {
+		return err
+	}
+	*s = raw.Decode()
+	return nil
+}
+
+// Snapshot gathers the state of the device, read in a single locked
+// sequence.
+type Snapshot struct {
+	Time            time.Time         `json:"time"` // system time when the snapshot was taken
+	Status          Status            `json:"status"`
+	Configuration   ConfigurationByte `json:"configuration"`
+	VBat            float32           `json:"vbat"`
+	VRef            float32           `json:"vref"`
+	ADC             RawVoltage        `json:"adc"`
+	RTC             time.Time         `json:"rtc"`
+	Watchdog        uint16            `json:"watchdog"`
+	Wakeup          uint16            `json:"wakeup"`
+	LowBatteryTimer uint16            `json:"low_battery_timer"`
+	Alarm           Alarm             `json:"alarm"`
+	FirmwareVersion string            `json:"firmware_version"`
+}
+
+// RTCOffset returns how far the RTC is ahead of the system clock.
+func (s Snapshot) RTCOffset() time.Duration {
+	return s.RTC.Sub(s.Time)
+}
+
+// Snapshot reads all registers at once. The voltage is read first, outside
+// of the device lock, since oversampling it may take a while.
+func (dev *Device) Snapshot() (Snapshot, error) {
+	var snap Snapshot
+
+	voltage, err := dev.ReadVoltage()
+	if err != nil {
+		return snap, err
+	}
+	snap.VBat, snap.VRef, snap.ADC = voltage.VBat, voltage.VRef, voltage.Raw
+	err = dev.Atomically(func(dev *Device) error {
+		snap.Time = time.Now().UTC()
+		status, err := dev.Status()
+		if err != nil {
+			return err
+		}
+		snap.Status = status.Decode()
+		if snap.Configuration, err = dev.Configuration(); err != nil {
+			return err
+		}
+		if snap.RTC, err = dev.Time(); err != nil {
+			return err
+		}
+		if snap.Watchdog, err = dev.Watchdog(); err != nil {
+			return err
+		}
+		if snap.Wakeup, err = dev.Wakeup(); err != nil {
+			return err
+		}
+		if snap.LowBatteryTimer, err = dev.LowBatteryTimer(); err != nil {
+			return err
+		}
+		if snap.Alarm, err = dev.Alarm(); err != nil {
+			return err
+		}
+		snap.FirmwareVersion, err = dev.FirmwareVersion()
+		return err
+	})
+	return snap, err
+}
@@ -0,0 +1,91 @@
+package device_test
+
+import (
+	"encoding/json"
+	"github.com/omzlo/pivoyager/device"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	sim, dev := newDevice(t)
+
+	tests := []struct {
+		usb     bool
+		vbat    float64
+		charger device.ChargerState
+	}{
+		{true, 3.9, device.CHARGER_CHARGING},
+		{true, 4.2, device.CHARGER_CHARGE_COMPLETE},
+		{false, 3.9, device.CHARGER_DISCHARGING},
+		{false, 3.3, device.CHARGER_LOW_BATTERY},
+	}
+	for _, test := range tests {
+		sim.SetUSBPower(test.usb)
+		sim.SetBatteryVoltage(test.vbat)
+		raw, err := dev.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := raw.Decode()
+		if status.USB5V != test.usb || status.Charger != test.charger {
+			t.Errorf("usb %v at %.1fV: got usb %v, charger %s, expected %s", test.usb, test.vbat, status.USB5V, status.Charger, test.charger)
+		}
+	}
+}
+
+func TestStatusEncoding(t *testing.T) {
+	raw := device.DeviceStatus(device.STAT_PG|device.STAT_5V|device.STAT_BUTTON) | device.DeviceStatus(device.CHARGER_CHARGING)
+	status := raw.Decode()
+	if !status.PowerGood || !status.USB5V || !status.ButtonPressed || status.AlarmTriggered || status.Charger != device.CHARGER_CHARGING {
+		t.Errorf("Decode() = %+v", status)
+	}
+
+	text, err := status.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded device.Status
+	if err := decoded.UnmarshalText(text); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != status {
+		t.Errorf("%q decoded as %+v, expected %+v", text, decoded, status)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded = device.Status{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != status {
+		t.Errorf("%s decoded as %+v, expected %+v", data, decoded, status)
+	}
+
+	var c device.ChargerState
+	if err := c.UnmarshalText([]byte(device.CHARGER_LOW_BATTERY.String())); err != nil || c != device.CHARGER_LOW_BATTERY {
+		t.Errorf("UnmarshalText(%q) = %s, %v", device.CHARGER_LOW_BATTERY, c, err)
+	}
+	if err := c.UnmarshalText([]byte("flat")); err == nil {
+		t.Errorf("UnmarshalText(\"flat\") accepted an unknown state")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	sim, dev := newDevice(t)
+	sim.SetUSBPower(false)
+	sim.SetBatteryVoltage(3.8)
+
+	snap, err := dev.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Status.USB5V || snap.Status.Charger != device.CHARGER_DISCHARGING || snap.LowBatteryTimer != 60 || snap.FirmwareVersion == "" {
+		t.Errorf("Snapshot() = %+v", snap)
+	}
+	if d := snap.VBat - 3.8; d < -0.01 || d > 0.01 {
+		t.Errorf("Snapshot() VBat = %.3f, expected 3.8", snap.VBat)
+	}
+}
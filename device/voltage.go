@@ -0,0 +1,328 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ADC_FULL_SCALE is the largest count of the 12-bit ADC.
+	ADC_FULL_SCALE = 4095
+	// VBAT_DIVIDER is the ratio of the divider between the battery and the
+	// ADC input.
+	VBAT_DIVIDER = 2
+	// VREF_CAL_VOLTAGE is the supply voltage at which the factory measured
+	// the internal reference, REG_VREF_CAL.
+	VREF_CAL_VOLTAGE = 3.3
+
+	DEFAULT_CALIBRATION_FILE = "/etc/pivoyager/calibration.json"
+	DEFAULT_SAMPLE_INTERVAL  = 10 * time.Millisecond
+	// MAX_SAMPLES bounds the number of readings averaged by Voltage.
+	MAX_SAMPLES = 64
+	// MIN_CALIBRATION_SPAN is the smallest spread, in volts, of the
+	// calibration points over which an offset is fitted along with the gain.
+	MIN_CALIBRATION_SPAN = 0.2
+)
+
+/* Raw readings */
+
+// RawVoltage holds the ADC counts behind a voltage reading: the battery
+// voltage through its divider, the internal reference, and the factory
+// calibration of the internal reference.
+type RawVoltage struct {
+	VBat uint16 `json:"vbat"`
+	VRef uint16 `json:"vref"`
+	VCal uint16 `json:"vref_cal"`
+}
+
+func (r RawVoltage) String() string {
+	return fmt.Sprintf("vbat %d, vref %d, vref_cal %d", r.VBat, r.VRef, r.VCal)
+}
+
+// Volts converts r to the battery and supply voltages, without any
+// calibration.
+func (r RawVoltage) Volts() (float64, float64) {
+	if r.VRef == 0 {
+		return 0, 0
+	}
+	ref := VREF_CAL_VOLTAGE * float64(r.VCal) / float64(r.VRef)
+	return VBAT_DIVIDER * ref * float64(r.VBat) / ADC_FULL_SCALE, ref
+}
+
+// RawVoltage returns the ADC counts of a single reading.
+func (dev *Device) RawVoltage() (RawVoltage, error) {
+	var buf [6]byte
+
+	if err := dev.ReadBytes(dev.address, REG_VBAT, buf[:]); err != nil {
+		return RawVoltage{}, err
+	}
+	return RawVoltage{
+		VBat: uint16(buf[0]) + (uint16(buf[1]) << 8),
+		VRef: uint16(buf[2]) + (uint16(buf[3]) << 8),
+		VCal: uint16(buf[4]) + (uint16(buf[5]) << 8),
+	}, nil
+}
+
+/* Oversampling */
+
+type Filter string
+
+const (
+	FILTER_MEAN   Filter = "mean"
+	FILTER_MEDIAN Filter = "median"
+)
+
+func (f *Filter) UnmarshalText(data []byte) error {
+	switch v := Filter(strings.ToLower(string(data))); v {
+	case FILTER_MEAN, FILTER_MEDIAN:
+		*f = v
+		return nil
+	}
+	return fmt.Errorf("Unknown filter '%s', expected 'mean' or 'median'", data)
+}
+
+// Sampling selects how many ADC readings Voltage combines, and how.
+type Sampling struct {
+	// Samples is the number of readings, 1 to disable oversampling.
+	Samples int
+	// Interval is the delay between two readings, leaving the firmware
+	// time to convert new values.
+	Interval time.Duration
+	// Filter combines the readings: the mean reduces the noise, the median
+	// also rejects the readings disturbed by a load spike.
+	Filter Filter
+}
+
+func DefaultSampling() Sampling {
+	return Sampling{Samples: 1, Interval: DEFAULT_SAMPLE_INTERVAL, Filter: FILTER_MEDIAN}
+}
+
+func (s Sampling) Validate() error {
+	if s.Samples < 1 || s.Samples > MAX_SAMPLES {
+		return fmt.Errorf("The number of voltage samples must be between 1 and %d", MAX_SAMPLES)
+	}
+	if s.Interval < 0 {
+		return errors.New("The voltage sampling interval cannot be negative")
+	}
+	if s.Filter != FILTER_MEAN && s.Filter != FILTER_MEDIAN {
+		return fmt.Errorf("Unknown filter '%s', expected 'mean' or 'median'", s.Filter)
+	}
+	return nil
+}
+
+func combine(values []uint16, filter Filter) uint16 {
+	if filter == FILTER_MEDIAN {
+		sorted := append([]uint16(nil), values...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		n := len(sorted)
+		if n%2 == 1 {
+			return sorted[n/2]
+		}
+		return uint16((uint32(sorted[n/2-1]) + uint32(sorted[n/2]) + 1) / 2)
+	}
+	var sum uint32
+	for _, v := range values {
+		sum += uint32(v)
+	}
+	return uint16((sum + uint32(len(values))/2) / uint32(len(values)))
+}
+
+// SampleVoltage takes s.Samples readings and combines them with s.Filter.
+// The device lock is taken for each reading, so SampleVoltage should not be
+// called from Atomically, which would hold the lock while sleeping between
+// readings.
+func (dev *Device) SampleVoltage(s Sampling) (RawVoltage, error) {
+	if s.Samples <= 1 {
+		return dev.RawVoltage()
+	}
+	vbat := make([]uint16, 0, s.Samples)
+	vref := make([]uint16, 0, s.Samples)
+	var vcal uint16
+	for i := 0; i < s.Samples; i++ {
+		if i > 0 && s.Interval > 0 {
+			time.Sleep(s.Interval)
+		}
+		r, err := dev.RawVoltage()
+		if err != nil {
+			return RawVoltage{}, err
+		}
+		vbat = append(vbat, r.VBat)
+		vref = append(vref, r.VRef)
+		vcal = r.VCal
+	}
+	return RawVoltage{combine(vbat, s.Filter), combine(vref, s.Filter), vcal}, nil
+}
+
+/* Calibration */
+
+// CalibrationPoint is a battery voltage measured with a meter, and the
+// voltage read by the PiVoyager at the same time, without calibration.
+type CalibrationPoint struct {
+	Measured float64   `json:"measured"`
+	Read     float64   `json:"read"`
+	Time     time.Time `json:"time"`
+}
+
+// Calibration corrects the battery voltage of a board: the calibrated
+// voltage is Gain * VBat + Offset.
+type Calibration struct {
+	Gain   float64 `json:"gain"`
+	Offset float64 `json:"offset"`
+	// Points are the measurements Gain and Offset were computed from.
+	Points []CalibrationPoint `json:"points,omitempty"`
+}
+
+func DefaultCalibration() Calibration {
+	return Calibration{Gain: 1}
+}
+
+func (c *Calibration) Validate() error {
+	if c.Gain < 0.8 || c.Gain > 1.2 {
+		return fmt.Errorf("Calibration gain %g is out of range", c.Gain)
+	}
+	if math.Abs(c.Offset) > 0.3 {
+		return fmt.Errorf("Calibration offset %gV is out of range", c.Offset)
+	}
+	return nil
+}
+
+// Apply returns the calibrated value of the battery voltage vbat. The zero
+// Calibration leaves it unchanged.
+func (c Calibration) Apply(vbat float64) float64 {
+	if c.Gain == 0 {
+		return vbat + c.Offset
+	}
+	return c.Gain*vbat + c.Offset
+}
+
+// AddPoint adds a measurement and recomputes the calibration. A single
+// point, or points too close to each other, only correct the gain, which
+// accounts for the tolerance of the divider and of the reference. Points
+// spread over at least MIN_CALIBRATION_SPAN volts also correct the offset,
+// with a least squares fit.
+func (c *Calibration) AddPoint(p CalibrationPoint) error {
+	if p.Measured <= 0 || p.Read <= 0 {
+		return errors.New("Calibration voltages must be positive")
+	}
+	if ratio := p.Measured / p.Read; ratio < 0.8 || ratio > 1.2 {
+		return fmt.Errorf("Measured %.3fV is too far from the %.3fV read, check the measured voltage", p.Measured, p.Read)
+	}
+	points := append(append([]CalibrationPoint(nil), c.Points...), p)
+
+	min, max := points[0].Read, points[0].Read
+	var sx, sy, sxx, sxy float64
+	for _, q := range points {
+		min = math.Min(min, q.Read)
+		max = math.Max(max, q.Read)
+		sx += q.Read
+		sy += q.Measured
+		sxx += q.Read * q.Read
+		sxy += q.Read * q.Measured
+	}
+	next := Calibration{Points: points}
+	if n := float64(len(points)); max-min >= MIN_CALIBRATION_SPAN {
+		next.Gain = (n*sxy - sx*sy) / (n*sxx - sx*sx)
+		next.Offset = (sy - next.Gain*sx) / n
+	} else {
+		// Least squares gain of a line through the origin.
+		next.Gain = sxy / sxx
+	}
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("%w, check the measured voltage", err)
+	}
+	*c = next
+	return nil
+}
+
+// LoadCalibration reads a calibration saved by Save.
+func LoadCalibration(path string) (Calibration, error) {
+	c := DefaultCalibration()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("Invalid calibration file %s: %w", path, err)
+	}
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("Invalid calibration file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes c to path, atomically.
+func (c Calibration) Save(path string) error {
+	data, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/* Voltage */
+
+// SetSampling selects how Voltage reads the ADC.
+func (dev *Device) SetSampling(s Sampling) {
+	dev.sampling = s
+}
+
+// SetCalibration sets the correction applied by Voltage to the battery
+// voltage.
+func (dev *Device) SetCalibration(c Calibration) {
+	dev.calibration = c
+}
+
+// VoltageReading details how the battery voltage was obtained.
+type VoltageReading struct {
+	VBat float32 `json:"vbat"`
+	VRef float32 `json:"vref"`
+	// Uncalibrated is the battery voltage before calibration.
+	Uncalibrated float32 `json:"uncalibrated"`
+	// Raw are the ADC counts, combined over Samples readings.
+	Raw     RawVoltage `json:"raw"`
+	Samples int        `json:"samples"`
+}
+
+// ReadVoltage reads the ADC as selected by SetSampling, and calibrates the
+// battery voltage.
+func (dev *Device) ReadVoltage() (VoltageReading, error) {
+	raw, err := dev.SampleVoltage(dev.sampling)
+	if err != nil {
+		return VoltageReading{}, err
+	}
+	vbat, vref := raw.Volts()
+	samples := dev.sampling.Samples
+	if samples < 1 {
+		samples = 1
+	}
+	return VoltageReading{
+		VBat:         float32(dev.calibration.Apply(vbat)),
+		VRef:         float32(vref),
+		Uncalibrated: float32(vbat),
+		Raw:          raw,
+		Samples:      samples,
+	}, nil
+}
+
+// Voltage returns the battery voltage, calibrated, and the supply voltage
+// of the PiVoyager. See ReadVoltage.
+func (dev *Device) Voltage() (float32, float32, error) {
+	r, err := dev.ReadVoltage()
+	return r.VBat, r.VRef, err
+}
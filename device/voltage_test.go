@@ -0,0 +1,107 @@
+package device
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCombine(t *testing.T) {
+	tests := []struct {
+		values   []uint16
+		filter   Filter
+		expected uint16
+	}{
+		{[]uint16{10, 2000, 12}, FILTER_MEDIAN, 12},
+		{[]uint16{10, 12, 2000, 14}, FILTER_MEDIAN, 13},
+		{[]uint16{10, 11}, FILTER_MEAN, 11},
+		{[]uint16{4095, 4095, 4095}, FILTER_MEAN, 4095},
+	}
+	for _, test := range tests {
+		if v := combine(test.values, test.filter); v != test.expected {
+			t.Errorf("combine(%v, %s) = %d, expected %d", test.values, test.filter, v, test.expected)
+		}
+	}
+}
+
+func TestCalibrationGain(t *testing.T) {
+	c := DefaultCalibration()
+
+	if err := c.AddPoint(CalibrationPoint{Measured: 4.0, Read: 3.9}); err != nil {
+		t.Fatal(err)
+	}
+	// A single point only corrects the gain.
+	if math.Abs(c.Gain-4.0/3.9) > 1e-9 || c.Offset != 0 {
+		t.Errorf("calibration = %g * v + %g, expected %g * v", c.Gain, c.Offset, 4.0/3.9)
+	}
+	if err := c.AddPoint(CalibrationPoint{Measured: 4.05, Read: 3.95}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Offset != 0 || len(c.Points) != 2 {
+		t.Errorf("points closer than %gV corrected the offset: %+v", MIN_CALIBRATION_SPAN, c)
+	}
+}
+
+func TestCalibrationLeastSquares(t *testing.T) {
+	c := DefaultCalibration()
+
+	// Readings of measured = 1.01 * read - 0.03.
+	for _, p := range []CalibrationPoint{{Measured: 3.303, Read: 3.3}, {Measured: 3.707, Read: 3.7}, {Measured: 4.111, Read: 4.1}, {Measured: 3.909, Read: 3.9}} {
+		if err := c.AddPoint(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if math.Abs(c.Gain-1.01) > 1e-6 || math.Abs(c.Offset+0.03) > 1e-6 {
+		t.Errorf("calibration = %g * v + %g, expected 1.01 * v - 0.03", c.Gain, c.Offset)
+	}
+	if v := c.Apply(3.5); math.Abs(v-3.505) > 0.001 {
+		t.Errorf("Apply(3.5) = %g, expected 3.505", v)
+	}
+}
+
+func TestCalibrationRejected(t *testing.T) {
+	c := DefaultCalibration()
+
+	if err := c.AddPoint(CalibrationPoint{Measured: 5.0, Read: 3.7}); err == nil {
+		t.Errorf("AddPoint accepted a measure 35%% off")
+	}
+	if err := c.AddPoint(CalibrationPoint{Measured: 0, Read: 3.7}); err == nil {
+		t.Errorf("AddPoint accepted a null measure")
+	}
+	if len(c.Points) != 0 || c.Gain != 1 {
+		t.Errorf("rejected points changed the calibration: %+v", c)
+	}
+}
+
+func TestLoadCalibration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pivoyager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "calibration.json")
+
+	c := DefaultCalibration()
+	if err := c.AddPoint(CalibrationPoint{Measured: 3.8, Read: 3.75}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadCalibration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Gain != c.Gain || loaded.Offset != c.Offset || len(loaded.Points) != 1 {
+		t.Errorf("LoadCalibration() = %+v, saved %+v", loaded, c)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"gain": 3}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCalibration(path); err == nil {
+		t.Errorf("LoadCalibration() accepted a gain of 3")
+	}
+}
@@ -0,0 +1,205 @@
+// Package exporter exposes the state of a PiVoyager as Prometheus metrics,
+// in the Prometheus text exposition format.
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ADDRESS = ":9105"
+	METRICS_PATH    = "/metrics"
+	CONTENT_TYPE    = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+type Exporter struct {
+	Device *device.Device
+	// Version of pivoyager, reported by pivoyager_build_info.
+	Version string
+	Logger  *log.Logger
+
+	mu           sync.Mutex
+	scrapeErrors uint64
+}
+
+func New(dev *device.Device, version string) *Exporter {
+	return &Exporter{Device: dev, Version: version}
+}
+
+func (e *Exporter) logf(format string, args ...interface{}) {
+	if e.Logger != nil {
+		e.Logger.Printf(format, args...)
+	}
+}
+
+// metrics writes metric families in the text exposition format.
+type metrics struct {
+	w io.Writer
+}
+
+func (m metrics) family(name string, typ string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes one sample of a family. labels alternates label names and
+// values.
+func (m metrics) sample(name string, value float64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(m.w, "%s %g\n", name, value)
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], escape(labels[i+1])))
+	}
+	fmt.Fprintf(m.w, "%s{%s} %g\n", name, strings.Join(pairs, ","), value)
+}
+
+func (m metrics) gauge(name string, help string, value float64, labels ...string) {
+	m.family(name, "gauge", help)
+	m.sample(name, value, labels...)
+}
+
+func (m metrics) counter(name string, help string, value uint64) {
+	m.family(name, "counter", help)
+	m.sample(name, float64(value))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Write reads the device and writes its metrics to w.
+func (e *Exporter) Write(w io.Writer) error {
+	start := time.Now()
+	snap, err := e.Device.Snapshot()
+	duration := time.Since(start)
+
+	e.mu.Lock()
+	if err != nil {
+		e.scrapeErrors++
+	}
+	scrapeErrors := e.scrapeErrors
+	e.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	m := metrics{bw}
+
+	m.gauge("pivoyager_up", "Whether the PiVoyager could be read.", boolValue(err == nil))
+	m.gauge("pivoyager_scrape_duration_seconds", "Time taken to read the PiVoyager.", duration.Seconds())
+	m.counter("pivoyager_scrape_errors_total", "Number of times the PiVoyager could not be read.", scrapeErrors)
+	m.gauge("pivoyager_build_info", "Version of pivoyager.", 1, "version", e.Version)
+
+	stats := e.Device.RetryStats()
+	m.counter("pivoyager_i2c_operations_total", "Number of i2c transactions issued.", stats.Operations)
+	m.counter("pivoyager_i2c_errors_total", "Number of failed i2c attempts, including retried ones.", stats.Errors)
+	m.counter("pivoyager_i2c_retries_total", "Number of i2c attempts that were retried.", stats.Retries)
+	m.counter("pivoyager_i2c_failures_total", "Number of i2c transactions that failed after all retries.", stats.Failures)
+
+	if err != nil {
+		e.logf("Failed to read pivoyager: %s", err)
+		return bw.Flush()
+	}
+
+	m.gauge("pivoyager_battery_voltage_volts", "Battery voltage.", float64(snap.VBat))
+	m.gauge("pivoyager_vref_volts", "Reference voltage of the PiVoyager.", float64(snap.VRef))
+	m.family("pivoyager_adc_counts", "gauge", "Raw ADC counts behind the voltages.")
+	m.sample("pivoyager_adc_counts", float64(snap.ADC.VBat), "channel", "vbat")
+	m.sample("pivoyager_adc_counts", float64(snap.ADC.VRef), "channel", "vref")
+	m.sample("pivoyager_adc_counts", float64(snap.ADC.VCal), "channel", "vref_cal")
+
+	m.family("pivoyager_status", "gauge", "Status bits of the PiVoyager.")
+	for i := uint(0); i < 8; i++ {
+		bit := device.DeviceStatus(1) << i
+		if bit == device.STAT_RESERVED {
+			continue
+		}
+		m.sample("pivoyager_status", boolValue(snap.Status.Raw&bit != 0), "flag", bit.ToStrings()[0])
+	}
+
+	m.family("pivoyager_charger_state", "gauge", "State of the battery charger, 1 for the current state.")
+	for c := device.ChargerState(0); c < 8; c++ {
+		m.sample("pivoyager_charger_state", boolValue(snap.Status.Charger == c), "state", c.String())
+	}
+
+	m.family("pivoyager_configuration", "gauge", "Configuration options, 1 if enabled.")
+	for i := uint(0); i < 8; i++ {
+		option := device.ConfigurationByte(1) << i
+		name := option.ToStrings()[0]
+		if name == "undefined" {
+			continue
+		}
+		m.sample("pivoyager_configuration", boolValue(snap.Configuration&option != 0), "option", name)
+	}
+
+	m.gauge("pivoyager_watchdog_timeout_seconds", "Watchdog timeout.", float64(snap.Watchdog))
+	m.gauge("pivoyager_wakeup_delay_seconds", "Delay before waking up the Pi with timer-wakeup.", float64(snap.Wakeup))
+	m.gauge("pivoyager_low_battery_timer_seconds", "Delay before cutting power on low battery.", float64(snap.LowBatteryTimer))
+	m.gauge("pivoyager_rtc_offset_seconds", "How far the PiVoyager RTC is ahead of the system clock.", snap.RTCOffset().Seconds())
+	m.gauge("pivoyager_firmware_info", "Firmware version of the PiVoyager.", 1, "version", snap.FirmwareVersion)
+	return bw.Flush()
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	e.Write(w)
+}
+
+// Handler returns a handler serving the metrics on METRICS_PATH, and a
+// link to them on "/".
+func (e *Exporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, e)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "<html><head><title>PiVoyager exporter</title></head><body><a href=\"%s\">Metrics</a></body></html>\n", METRICS_PATH)
+	})
+	return mux
+}
+
+// ListenAndServe serves the metrics on the TCP address addr until ctx is
+// cancelled.
+func (e *Exporter) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: e.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	e.logf("Serving metrics on %s%s", ln.Addr(), METRICS_PATH)
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
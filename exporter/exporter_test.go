@@ -0,0 +1,122 @@
+package exporter
+
+import (
+	"bufio"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/simulator"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scrape fetches the metrics served by e, indexed by name and labels.
+func scrape(t *testing.T, e *Exporter) map[string]float64 {
+	t.Helper()
+	srv := httptest.NewServer(e.Handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + METRICS_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != CONTENT_TYPE {
+		t.Fatalf("GET %s: %s, %s", METRICS_PATH, resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Invalid sample %q: %s", line, err)
+		}
+		metrics[line[:i]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	sim := simulator.New()
+	policy := device.DefaultRetryPolicy
+	policy.Delay = time.Millisecond
+	dev := device.New(device.NewRetryBus(sim, policy), device.DEVICE_ADDRESS)
+	sim.SetUSBPower(false)
+	sim.SetBatteryVoltage(3.8)
+	if err := dev.SetWatchdog(30, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetWakeup(600, 0); err != nil {
+		t.Fatal(err)
+	}
+	sim.FailNext(1, syscall.EIO)
+
+	metrics := scrape(t, New(dev, "test"))
+
+	expected := map[string]float64{
+		"pivoyager_up":                                 1,
+		`pivoyager_build_info{version="test"}`:         1,
+		`pivoyager_status{flag="pg"}`:                  0,
+		`pivoyager_status{flag="stat1"}`:               1,
+		`pivoyager_status{flag="stat2"}`:               1,
+		`pivoyager_status{flag="5v"}`:                  0,
+		`pivoyager_charger_state{state="discharging"}`: 1,
+		`pivoyager_charger_state{state="charging"}`:    0,
+		`pivoyager_charger_state{state="low battery"}`: 0,
+		"pivoyager_watchdog_timeout_seconds":           30,
+		"pivoyager_wakeup_delay_seconds":               600,
+		"pivoyager_low_battery_timer_seconds":          60,
+		"pivoyager_i2c_errors_total":                   1,
+		"pivoyager_i2c_retries_total":                  1,
+		"pivoyager_i2c_failures_total":                 0,
+		"pivoyager_scrape_errors_total":                0,
+	}
+	for name, value := range expected {
+		if v, ok := metrics[name]; !ok || v != value {
+			t.Errorf("%s = %g (found: %t), expected %g", name, v, ok, value)
+		}
+	}
+	if _, ok := metrics[`pivoyager_status{flag="reserved"}`]; ok {
+		t.Errorf("the reserved status bit is exported")
+	}
+	if metrics["pivoyager_i2c_operations_total"] == 0 {
+		t.Errorf("pivoyager_i2c_operations_total is 0")
+	}
+	if v := metrics["pivoyager_battery_voltage_volts"]; v < 3.79 || v > 3.81 {
+		t.Errorf("pivoyager_battery_voltage_volts = %g, expected 3.8", v)
+	}
+	if v := metrics["pivoyager_vref_volts"]; v < 3.2 || v > 3.4 {
+		t.Errorf("pivoyager_vref_volts = %g, expected 3.3", v)
+	}
+}
+
+func TestScrapeError(t *testing.T) {
+	sim := simulator.New()
+	e := New(device.New(sim, device.DEVICE_ADDRESS), "test")
+	sim.FailNext(1, syscall.EIO)
+
+	metrics := scrape(t, e)
+	if metrics["pivoyager_up"] != 0 || metrics["pivoyager_scrape_errors_total"] != 1 {
+		t.Errorf("pivoyager_up = %g, pivoyager_scrape_errors_total = %g after a failed scrape", metrics["pivoyager_up"], metrics["pivoyager_scrape_errors_total"])
+	}
+	if _, ok := metrics["pivoyager_battery_voltage_volts"]; ok {
+		t.Errorf("voltages are exported after a failed scrape")
+	}
+
+	metrics = scrape(t, e)
+	if metrics["pivoyager_up"] != 1 || metrics["pivoyager_scrape_errors_total"] != 1 {
+		t.Errorf("pivoyager_up = %g, pivoyager_scrape_errors_total = %g after a successful scrape", metrics["pivoyager_up"], metrics["pivoyager_scrape_errors_total"])
+	}
+}
@@ -0,0 +1,135 @@
+// Package gpio drives GPIO output lines through the Linux GPIO character
+// device (/dev/gpiochipN), using the v2 uAPI of linux/gpio.h. It does not
+// need cgo nor the deprecated sysfs interface.
+package gpio
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	DEFAULT_CHIP = "/dev/gpiochip0"
+)
+
+// Structures and constants from linux/gpio.h
+const (
+	GPIO_MAX_NAME_SIZE         = 32
+	GPIO_V2_LINES_MAX          = 64
+	GPIO_V2_LINE_NUM_ATTRS_MAX = 10
+
+	GPIO_V2_LINE_FLAG_INPUT  = 1 << 2
+	GPIO_V2_LINE_FLAG_OUTPUT = 1 << 3
+
+	GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES = 2
+
+	GPIO_V2_GET_LINE_IOCTL        = 0xC250B407 // _IOWR(0xB4, 0x07, struct gpio_v2_line_request)
+	GPIO_V2_LINE_SET_VALUES_IOCTL = 0xC010B40F // _IOWR(0xB4, 0x0F, struct gpio_v2_line_values)
+)
+
+type lineAttribute struct {
+	id      uint32
+	padding uint32
+	value   uint64
+}
+
+type lineConfigAttribute struct {
+	attr lineAttribute
+	mask uint64
+}
+
+type lineConfig struct {
+	flags    uint64
+	numAttrs uint32
+	padding  [5]uint32
+	attrs    [GPIO_V2_LINE_NUM_ATTRS_MAX]lineConfigAttribute
+}
+
+type lineRequest struct {
+	offsets         [GPIO_V2_LINES_MAX]uint32
+	consumer        [GPIO_MAX_NAME_SIZE]byte
+	config          lineConfig
+	numLines        uint32
+	eventBufferSize uint32
+	padding         [5]uint32
+	fd              int32
+}
+
+type lineValues struct {
+	bits uint64
+	mask uint64
+}
+
+// Line is a GPIO output line.
+type Line interface {
+	SetValue(high bool) error
+	Close() error
+}
+
+// OutputLine is a line requested from a GPIO chip.
+type OutputLine struct {
+	fd     int
+	chip   string
+	offset uint32
+}
+
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// RequestOutput requests line offset of the GPIO chip at path as an
+// output, initially high if high is true and low otherwise. The line is
+// reserved for consumer until closed.
+func RequestOutput(path string, offset uint32, consumer string, high bool) (*OutputLine, error) {
+	var req lineRequest
+
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer syscall.Close(fd)
+
+	req.offsets[0] = offset
+	req.numLines = 1
+	copy(req.consumer[:GPIO_MAX_NAME_SIZE-1], consumer)
+	req.config.flags = GPIO_V2_LINE_FLAG_OUTPUT
+	req.config.numAttrs = 1
+	req.config.attrs[0].attr.id = GPIO_V2_LINE_ATTR_ID_OUTPUT_VALUES
+	if high {
+		req.config.attrs[0].attr.value = 1
+	}
+	req.config.attrs[0].mask = 1
+
+	if err := ioctl(fd, GPIO_V2_GET_LINE_IOCTL, unsafe.Pointer(&req)); err != nil {
+		return nil, fmt.Errorf("Could not request line %d of %s: %w", offset, path, err)
+	}
+	return &OutputLine{fd: int(req.fd), chip: path, offset: offset}, nil
+}
+
+func (l *OutputLine) SetValue(high bool) error {
+	values := lineValues{mask: 1}
+
+	if high {
+		values.bits = 1
+	}
+	if err := ioctl(l.fd, GPIO_V2_LINE_SET_VALUES_IOCTL, unsafe.Pointer(&values)); err != nil {
+		return fmt.Errorf("Could not set line %d of %s: %w", l.offset, l.chip, err)
+	}
+	return nil
+}
+
+// Close releases the line. Closing a released line does nothing.
+func (l *OutputLine) Close() error {
+	if l.fd < 0 {
+		return nil
+	}
+	err := syscall.Close(l.fd)
+	l.fd = -1
+	return err
+}
@@ -0,0 +1,308 @@
+// Package history keeps a log of the samples and power events of the
+// monitor, as line-delimited JSON files rotated by size and age, and
+// queries it after the fact, e.g. to find the outages of the USB power.
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_PATH         = "/var/lib/pivoyager/history.jsonl"
+	DEFAULT_INTERVAL     = time.Minute
+	DEFAULT_MAX_SIZE     = 1 << 20
+	DEFAULT_MAX_FILE_AGE = 24 * time.Hour
+	DEFAULT_RETENTION    = 90 * 24 * time.Hour
+
+	// TIME_FORMAT is the start time in the name of rotated files.
+	TIME_FORMAT = "20060102T150405Z"
+)
+
+// Record is a line of the log: a periodic sample if Event is empty, or the
+// sample that caused an event.
+type Record struct {
+	Time     time.Time           `json:"time"`
+	Event    string              `json:"event,omitempty"`
+	USBPower bool                `json:"usb_power"`
+	Charger  device.ChargerState `json:"charger"`
+	Status   device.DeviceStatus `json:"status"`
+	VBat     float32             `json:"vbat"`
+	VRef     float32             `json:"vref"`
+	Charge   float64             `json:"charge"`
+	Message  string              `json:"message,omitempty"`
+}
+
+func NewRecord(s monitor.Sample, event string) Record {
+	return Record{
+		Time:     s.Time,
+		Event:    event,
+		USBPower: s.Status.USB5V,
+		Charger:  s.Status.Charger,
+		Status:   s.Status.Raw,
+		VBat:     s.VBat,
+		VRef:     s.VRef,
+		Charge:   math.Round(s.Charge.Percent*10) / 10,
+	}
+}
+
+// HasReading reports whether r holds a reading of the device, which is
+// not the case of device errors.
+func (r Record) HasReading() bool {
+	return r.Event != monitor.EVENT_DEVICE_ERROR
+}
+
+// Log appends the samples of a monitor, every Interval, and all its events
+// to the file at Path. Once the file grows over MaxSize or holds records
+// spanning more than MaxFileAge, it is renamed after the time of its first
+// record, e.g. history-20201231T235959Z.jsonl, and a new file is started.
+// Rotated files are removed once older than Retention.
+type Log struct {
+	Path       string
+	Interval   time.Duration
+	MaxSize    int64
+	MaxFileAge time.Duration
+	Retention  time.Duration
+	Logger     *log.Logger
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	started time.Time
+	sampled time.Time
+	failing bool
+}
+
+func New(path string) *Log {
+	if path == "" {
+		path = DEFAULT_PATH
+	}
+	return &Log{
+		Path:       path,
+		Interval:   DEFAULT_INTERVAL,
+		MaxSize:    DEFAULT_MAX_SIZE,
+		MaxFileAge: DEFAULT_MAX_FILE_AGE,
+		Retention:  DEFAULT_RETENTION,
+	}
+}
+
+func (l *Log) logf(format string, args ...interface{}) {
+	if l.Logger != nil {
+		l.Logger.Printf(format, args...)
+	}
+}
+
+// HandleSample logs s if the last sample was logged more than Interval
+// ago.
+func (l *Log) HandleSample(s monitor.Sample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s.Time.Sub(l.sampled) < l.Interval {
+		return
+	}
+	l.sampled = s.Time
+	l.append(NewRecord(s, ""), false)
+}
+
+// HandleEvent logs e, and flushes it to the storage at once.
+func (l *Log) HandleEvent(e monitor.Event) {
+	r := NewRecord(e.Sample, e.Type)
+	r.Message = e.Message
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.append(r, true)
+}
+
+// Write appends r to the log.
+func (l *Log) Write(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.write(r, false)
+}
+
+// append writes r, logging errors once until writing succeeds again.
+func (l *Log) append(r Record, sync bool) {
+	if err := l.write(r, sync); err != nil {
+		if !l.failing {
+			l.logf("Failed to write history to %s: %s", l.Path, err)
+		}
+		l.failing = true
+		return
+	}
+	if l.failing {
+		l.logf("Writing history to %s again", l.Path)
+	}
+	l.failing = false
+}
+
+func (l *Log) write(r Record, sync bool) error {
+	data, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+	if l.size > 0 && (l.size+int64(len(data)) > l.MaxSize || (l.MaxFileAge > 0 && r.Time.Sub(l.started) >= l.MaxFileAge)) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if l.size == 0 {
+		l.started = r.Time
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if sync {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+func (l *Log) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.Path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.size = info.Size()
+	l.started = firstTime(l.Path, info.ModTime())
+	// A line cut short by a power loss would swallow the next record.
+	if l.size > 0 && !endsWithNewline(f, l.size) {
+		n, _ := f.Write([]byte{'\n'})
+		l.size += int64(n)
+	}
+	return nil
+}
+
+func endsWithNewline(f *os.File, size int64) bool {
+	var last [1]byte
+
+	r, err := os.Open(f.Name())
+	if err != nil {
+		return true
+	}
+	defer r.Close()
+	if _, err := r.ReadAt(last[:], size-1); err != nil {
+		return true
+	}
+	return last[0] == '\n'
+}
+
+// firstTime returns the time of the first record of the file at path, or
+// def if it cannot be read.
+func firstTime(path string, def time.Time) time.Time {
+	var r Record
+
+	f, err := os.Open(path)
+	if err != nil {
+		return def
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, &r) != nil {
+		return def
+	}
+	return r.Time
+}
+
+// rotate renames the current file after its start time, opens a new one
+// and removes the files older than Retention.
+func (l *Log) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	ext := filepath.Ext(l.Path)
+	base := strings.TrimSuffix(l.Path, ext)
+	name := fmt.Sprintf("%s-%s%s", base, l.started.UTC().Format(TIME_FORMAT), ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s-%s-%d%s", base, l.started.UTC().Format(TIME_FORMAT), i, ext)
+	}
+	if err := os.Rename(l.Path, name); err != nil {
+		return err
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	l.prune()
+	return nil
+}
+
+func (l *Log) prune() {
+	if l.Retention <= 0 {
+		return
+	}
+	files, err := Files(l.Path)
+	if err != nil {
+		return
+	}
+	limit := time.Now().Add(-l.Retention)
+	for _, name := range files {
+		if name == l.Path {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil && info.ModTime().Before(limit) {
+			if err := os.Remove(name); err != nil {
+				l.logf("Failed to remove old history %s: %s", name, err)
+			}
+		}
+	}
+}
+
+// Close closes the current file. The log can be written to again, which
+// reopens it.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Files returns the files of the log at path, oldest first: the rotated
+// files, followed by the current one if it exists.
+func Files(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	rotated, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	if _, err := os.Stat(path); err == nil {
+		rotated = append(rotated, path)
+	}
+	return rotated, nil
+}
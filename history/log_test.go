@@ -0,0 +1,138 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempLog(t *testing.T) (*Log, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "pivoyager")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(filepath.Join(dir, "history.jsonl")), func() { os.RemoveAll(dir) }
+}
+
+func TestLogRotateByAge(t *testing.T) {
+	l, cleanup := tempLog(t)
+	defer cleanup()
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, h := range []int{0, 12, 24, 30, 48} {
+		if err := l.Write(Record{Time: t0.Add(time.Duration(h) * time.Hour), USBPower: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	files, err := Files(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"history-20210101T000000Z.jsonl", "history-20210102T000000Z.jsonl", "history.jsonl"}
+	if len(files) != len(expected) {
+		t.Fatalf("Files() = %v, expected %v", files, expected)
+	}
+	for i, name := range files {
+		if filepath.Base(name) != expected[i] {
+			t.Errorf("Files()[%d] = %s, expected %s", i, filepath.Base(name), expected[i])
+		}
+	}
+
+	records, err := ReadAll(l.Path, t0.Add(20*time.Hour), t0.Add(40*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !records[0].Time.Equal(t0.Add(24*time.Hour)) || !records[1].Time.Equal(t0.Add(30*time.Hour)) {
+		t.Errorf("ReadAll() = %v, expected the records at 24h and 30h", records)
+	}
+}
+
+func TestLogRotateBySize(t *testing.T) {
+	l, cleanup := tempLog(t)
+	defer cleanup()
+	l.MaxSize = 400
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 10; i++ {
+		if err := l.Write(Record{Time: t0.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+
+	files, err := Files(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 3 {
+		t.Errorf("Files() = %v, expected several rotated files", files)
+	}
+	for _, name := range files {
+		if info, err := os.Stat(name); err != nil || info.Size() > l.MaxSize {
+			t.Errorf("%s is larger than %d bytes", name, l.MaxSize)
+		}
+	}
+	records, err := ReadAll(l.Path, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 10 {
+		t.Fatalf("ReadAll() returned %d records, expected 10", len(records))
+	}
+	for i, r := range records {
+		if !r.Time.Equal(t0.Add(time.Duration(i) * time.Minute)) {
+			t.Errorf("record %d at %s, out of order", i, r.Time)
+		}
+	}
+}
+
+func TestLogPrune(t *testing.T) {
+	l, cleanup := tempLog(t)
+	defer cleanup()
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	old := filepath.Join(filepath.Dir(l.Path), "history-20200101T000000Z.jsonl")
+	if err := ioutil.WriteFile(old, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-l.Retention - time.Hour)
+	if err := os.Chtimes(old, stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	for _, h := range []int{0, 25} {
+		if err := l.Write(Record{Time: t0.Add(time.Duration(h) * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l.Close()
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed after %s", old, l.Retention)
+	}
+}
+
+func TestLogTruncatedLine(t *testing.T) {
+	l, cleanup := tempLog(t)
+	defer cleanup()
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// A power loss cut the last line short.
+	if err := ioutil.WriteFile(l.Path, []byte(`{"time":"2021-01-01T00:00:00Z"}`+"\n"+`{"time":"2021-01-01T00:0`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(Record{Time: t0.Add(time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	records, err := ReadAll(l.Path, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || !records[1].Time.Equal(t0.Add(time.Minute)) {
+		t.Errorf("ReadAll() = %v, expected the records at 0 and 1 minute", records)
+	}
+}
@@ -0,0 +1,217 @@
+package history
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DEFAULT_MAX_GAP is the longest time between two records of an
+	// outage, beyond which the log is considered stopped.
+	DEFAULT_MAX_GAP = 5 * time.Minute
+)
+
+// fileStart returns the start time in the name of a rotated file.
+func fileStart(name string, path string) (time.Time, bool) {
+	ext := filepath.Ext(path)
+	prefix := strings.TrimSuffix(path, ext) + "-"
+	if !strings.HasPrefix(name, prefix) || len(name) < len(prefix)+len(TIME_FORMAT) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(TIME_FORMAT, name[len(prefix):len(prefix)+len(TIME_FORMAT)])
+	return t, err == nil
+}
+
+// Read calls fn for each record of the log at path between from and to,
+// in order. A zero from or to leaves the range open. Lines that cannot be
+// decoded, such as a line cut short by a power loss, are skipped.
+func Read(path string, from time.Time, to time.Time, fn func(r Record) error) error {
+	files, err := Files(path)
+	if err != nil {
+		return err
+	}
+	for i, name := range files {
+		// Skip the files that start after the range, or that end before
+		// it, since the next file starts then.
+		if start, ok := fileStart(name, path); ok && !to.IsZero() && start.After(to) {
+			break
+		}
+		if i+1 < len(files) && !from.IsZero() {
+			if next, ok := fileStart(files[i+1], path); ok && next.Before(from) {
+				continue
+			}
+		}
+		if err := readFile(name, from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFile(name string, from time.Time, to time.Time, fn func(r Record) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || r.Time.IsZero() {
+			continue
+		}
+		if (!from.IsZero() && r.Time.Before(from)) || (!to.IsZero() && r.Time.After(to)) {
+			continue
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadAll returns the records of the log at path between from and to.
+func ReadAll(path string, from time.Time, to time.Time) ([]Record, error) {
+	var records []Record
+
+	err := Read(path, from, to, func(r Record) error {
+		records = append(records, r)
+		return nil
+	})
+	return records, err
+}
+
+/* Outages */
+
+// How an outage ended.
+const (
+	ENDED_ONGOING  = "ongoing"
+	ENDED_RESTORED = "power_restored"
+	// ENDED_STOPPED means that the log stopped during the outage, e.g. the
+	// system was shut down or the battery ran out.
+	ENDED_STOPPED = "log_stopped"
+)
+
+// Outage is a period without USB power.
+type Outage struct {
+	Start time.Time `json:"start"`
+	// End is when the power was restored, or the last record of the
+	// outage if the log stopped or the outage is ongoing.
+	End time.Time `json:"end"`
+	// Duration is in seconds.
+	Duration   float64 `json:"duration"`
+	MinVoltage float32 `json:"min_voltage"`
+	MinCharge  float64 `json:"min_charge"`
+	Ended      string  `json:"ended"`
+	// LowBattery tells whether a low battery was reported.
+	LowBattery bool `json:"low_battery"`
+}
+
+func (o *Outage) close(end time.Time, ended string) {
+	o.End = end
+	o.Duration = end.Sub(o.Start).Seconds()
+	o.Ended = ended
+}
+
+// Outages finds the outages of the USB power in records, sorted by time.
+// A gap longer than maxGap between two records ends the current outage
+// with ENDED_STOPPED.
+func Outages(records []Record, maxGap time.Duration) []Outage {
+	var outages []Outage
+	var cur *Outage
+	var last time.Time
+
+	for _, r := range records {
+		if !r.HasReading() {
+			continue
+		}
+		if cur != nil && maxGap > 0 && r.Time.Sub(last) > maxGap {
+			cur.close(last, ENDED_STOPPED)
+			outages = append(outages, *cur)
+			cur = nil
+		}
+		switch {
+		case cur == nil && !r.USBPower:
+			cur = &Outage{Start: r.Time, MinVoltage: r.VBat, MinCharge: r.Charge}
+		case cur != nil && r.USBPower:
+			cur.close(r.Time, ENDED_RESTORED)
+			outages = append(outages, *cur)
+			cur = nil
+		}
+		if cur != nil {
+			if r.VBat < cur.MinVoltage {
+				cur.MinVoltage = r.VBat
+			}
+			if r.Charge < cur.MinCharge {
+				cur.MinCharge = r.Charge
+			}
+			if r.Charger == device.CHARGER_LOW_BATTERY || r.Event == monitor.EVENT_LOW_BATTERY {
+				cur.LowBattery = true
+			}
+		}
+		last = r.Time
+	}
+	if cur != nil {
+		cur.close(last, ENDED_ONGOING)
+		outages = append(outages, *cur)
+	}
+	return outages
+}
+
+/* Export */
+
+var recordHeader = []string{"time", "event", "usb_power", "charger", "status", "vbat", "vref", "charge", "message"}
+
+// WriteCSV writes records as CSV, with a header line.
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write(recordHeader)
+	for _, r := range records {
+		status, _ := r.Status.MarshalText()
+		cw.Write([]string{
+			r.Time.Format(time.RFC3339),
+			r.Event,
+			strconv.FormatBool(r.USBPower),
+			r.Charger.String(),
+			string(status),
+			strconv.FormatFloat(float64(r.VBat), 'f', 3, 32),
+			strconv.FormatFloat(float64(r.VRef), 'f', 3, 32),
+			strconv.FormatFloat(r.Charge, 'f', 1, 64),
+			r.Message,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var outageHeader = []string{"start", "end", "duration", "min_voltage", "min_charge", "ended", "low_battery"}
+
+// WriteOutagesCSV writes outages as CSV, with a header line.
+func WriteOutagesCSV(w io.Writer, outages []Outage) error {
+	cw := csv.NewWriter(w)
+	cw.Write(outageHeader)
+	for _, o := range outages {
+		cw.Write([]string{
+			o.Start.Format(time.RFC3339),
+			o.End.Format(time.RFC3339),
+			strconv.FormatFloat(o.Duration, 'f', 0, 64),
+			strconv.FormatFloat(float64(o.MinVoltage), 'f', 3, 32),
+			strconv.FormatFloat(o.MinCharge, 'f', 1, 64),
+			o.Ended,
+			strconv.FormatBool(o.LowBattery),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,45 @@
+package history
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"testing"
+	"time"
+)
+
+func TestOutages(t *testing.T) {
+	t0 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time {
+		return t0.Add(time.Duration(minutes) * time.Minute)
+	}
+	records := []Record{
+		{Time: at(0), USBPower: true, VBat: 4.1, Charge: 95},
+		{Time: at(1), Event: monitor.EVENT_ON_BATTERY, VBat: 4.0, Charge: 90},
+		{Time: at(2), VBat: 3.8, Charge: 60},
+		{Time: at(3), Event: monitor.EVENT_DEVICE_ERROR},
+		{Time: at(4), VBat: 3.9, Charge: 70},
+		{Time: at(5), Event: monitor.EVENT_ON_MAINS, USBPower: true, VBat: 4.0, Charge: 75},
+		// The log stopped during the second outage.
+		{Time: at(10), VBat: 3.7, Charge: 40},
+		{Time: at(11), Charger: device.CHARGER_LOW_BATTERY, VBat: 3.3, Charge: 2},
+		// The third one is still going on.
+		{Time: at(60), VBat: 3.9, Charge: 70},
+		{Time: at(62), VBat: 3.85, Charge: 65},
+	}
+
+	outages := Outages(records, DEFAULT_MAX_GAP)
+	expected := []Outage{
+		{Start: at(1), End: at(5), Duration: 240, MinVoltage: 3.8, MinCharge: 60, Ended: ENDED_RESTORED},
+		{Start: at(10), End: at(11), Duration: 60, MinVoltage: 3.3, MinCharge: 2, Ended: ENDED_STOPPED, LowBattery: true},
+		{Start: at(60), End: at(62), Duration: 120, MinVoltage: 3.85, MinCharge: 65, Ended: ENDED_ONGOING},
+	}
+	if len(outages) != len(expected) {
+		t.Fatalf("Outages() = %+v, expected %+v", outages, expected)
+	}
+	for i, o := range outages {
+		e := expected[i]
+		if !o.Start.Equal(e.Start) || !o.End.Equal(e.End) || o.Duration != e.Duration || o.MinVoltage != e.MinVoltage || o.MinCharge != e.MinCharge || o.Ended != e.Ended || o.LowBattery != e.LowBattery {
+			t.Errorf("outage %d = %+v, expected %+v", i, o, e)
+		}
+	}
+}
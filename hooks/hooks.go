@@ -0,0 +1,213 @@
+// Package hooks runs user commands when the monitor reports power events.
+// Each command receives the event in PIVOYAGER_* environment variables and
+// as JSON on its standard input.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/pivoyager/monitor"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEOUT     = 30 * time.Second
+	DEFAULT_CONCURRENCY = 4
+	QUEUE_SIZE          = 64
+)
+
+// Hook is a command run on an event, either a shell snippet run with
+// /bin/sh -c, or an executable and its arguments.
+type Hook struct {
+	Shell string
+	Exec  []string
+	// Timeout, if not zero, overrides the timeout of the runner.
+	Timeout time.Duration
+}
+
+func (h Hook) String() string {
+	if h.Shell != "" {
+		return h.Shell
+	}
+	return strings.Join(h.Exec, " ")
+}
+
+func (h Hook) command() *exec.Cmd {
+	if h.Shell != "" {
+		return exec.Command("/bin/sh", "-c", h.Shell)
+	}
+	return exec.Command(h.Exec[0], h.Exec[1:]...)
+}
+
+type job struct {
+	hook  Hook
+	event monitor.Event
+}
+
+// Runner runs the hooks registered for each event type, at most
+// Concurrency at a time.
+type Runner struct {
+	Timeout     time.Duration
+	Concurrency int
+	Logger      *log.Logger
+
+	mu    sync.Mutex
+	hooks map[string][]Hook
+	queue chan job
+}
+
+func New() *Runner {
+	return &Runner{
+		Timeout:     DEFAULT_TIMEOUT,
+		Concurrency: DEFAULT_CONCURRENCY,
+		hooks:       make(map[string][]Hook),
+		queue:       make(chan job, QUEUE_SIZE),
+	}
+}
+
+func (r *Runner) logf(format string, args ...interface{}) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, args...)
+	}
+}
+
+// Add registers h for the events of type event, one of
+// monitor.EventTypes.
+func (r *Runner) Add(event string, h Hook) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks[event] = append(r.hooks[event], h)
+}
+
+// HandleEvent queues the hooks registered for e. They are dropped if too
+// many hooks are already waiting to run.
+func (r *Runner) HandleEvent(e monitor.Event) {
+	r.mu.Lock()
+	hooks := r.hooks[e.Type]
+	r.mu.Unlock()
+
+	for _, h := range hooks {
+		select {
+		case r.queue <- job{h, e}:
+		default:
+			r.logf("Hook %s %q dropped, too many hooks pending", e.Type, h)
+		}
+	}
+}
+
+// Run runs the queued hooks until ctx is cancelled, and then waits for the
+// running ones to complete.
+func (r *Runner) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	workers := r.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-r.queue:
+					r.RunHook(j.hook, j.event)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// RunHook runs h for e and logs how it ended. It returns the exit code of
+// the command, or -1 if it could not be run or was killed.
+func (r *Runner) RunHook(h Hook, e monitor.Event) int {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = r.Timeout
+	}
+	stdin, _ := json.Marshal(&e)
+
+	cmd := h.command()
+	cmd.Env = append(os.Environ(), Env(e)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	// Run the hook in its own process group, so that a timeout also kills
+	// the processes started by a shell.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		r.logf("Hook %s %q could not be started: %s", e.Type, h, err)
+		return -1
+	}
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	timedOut := !timer.Stop()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	switch {
+	case timedOut:
+		r.logf("Hook %s %q killed after %s", e.Type, h, timeout)
+		return -1
+	case err == nil:
+		r.logf("Hook %s %q exited with status 0 in %s", e.Type, h, elapsed)
+		return 0
+	}
+	code := cmd.ProcessState.ExitCode()
+	if code < 0 {
+		r.logf("Hook %s %q failed: %s", e.Type, h, err)
+	} else {
+		r.logf("Hook %s %q exited with status %d in %s", e.Type, h, code, elapsed)
+	}
+	return code
+}
+
+func boolEnv(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// Env returns the environment variables describing e.
+func Env(e monitor.Event) []string {
+	s := e.Sample
+	env := []string{
+		"PIVOYAGER_EVENT=" + e.Type,
+		"PIVOYAGER_TIME=" + s.Time.Format(time.RFC3339),
+		"PIVOYAGER_STATUS=" + s.Status.Raw.String(),
+		"PIVOYAGER_CHARGER=" + s.Status.Charger.String(),
+		"PIVOYAGER_USB_POWER=" + boolEnv(s.Status.USB5V),
+		"PIVOYAGER_BUTTON=" + boolEnv(s.Status.ButtonPressed),
+		"PIVOYAGER_ALARM=" + boolEnv(s.Status.AlarmTriggered),
+		fmt.Sprintf("PIVOYAGER_VBAT=%.2f", s.VBat),
+		fmt.Sprintf("PIVOYAGER_VREF=%.2f", s.VRef),
+		fmt.Sprintf("PIVOYAGER_CHARGE=%.0f", s.Charge.Percent),
+		fmt.Sprintf("PIVOYAGER_CHARGE_CONFIDENCE=%.2f", s.Charge.Confidence),
+	}
+	if left := e.Sample.Runtime.TimeToEmpty; left > 0 {
+		env = append(env, fmt.Sprintf("PIVOYAGER_TIME_TO_EMPTY=%.0f", left.Seconds()))
+	}
+	if e.Previous != nil {
+		env = append(env, "PIVOYAGER_PREVIOUS_CHARGER="+e.Previous.Status.Charger.String())
+	}
+	if e.Message != "" {
+		env = append(env, "PIVOYAGER_MESSAGE="+e.Message)
+	}
+	return env
+}
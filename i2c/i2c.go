@@ -1,7 +1,7 @@
 package i2c
 
 /*
-   This code largely borrows from i2c-dev.h, from:
+   The SMBus structures and constants below are taken from i2c-dev.h:
        Copyright (C) 1995-97 Simon G. Vogl
        Copyright (C) 1998-99 Frodo Looijaard <frodol@dds.nl>
 
@@ -23,250 +23,262 @@ package i2c
    MA 02110-1301 USA.
 */
 
-/*
-#include <stdint.h>
-#include <stdio.h>
-#include <unistd.h>
-#include <fcntl.h>
-#include <sys/ioctl.h>
-#include <stdlib.h>
-#include <errno.h>
-#include <string.h>
-
-#define I2C_SMBUS_BLOCK_MAX 32  // As specified in SMBus standard
-#define I2C_SMBUS_I2C_BLOCK_MAX 32  // Not specified but we use same structure
-union i2c_smbus_data {
-    uint8_t byte;
-    uint16_t word;
-    uint8_t block[I2C_SMBUS_BLOCK_MAX + 2]; // block[0] is used for length
-    // and one more for PEC
-};
-
-// This is the structure as used in the I2C_SMBUS ioctl call
-struct i2c_smbus_ioctl_data {
-    char read_write;
-    uint8_t command;
-    int size;
-    union i2c_smbus_data *data;
-};
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	I2C_SMBUS_BLOCK_MAX     = 32 // As specified in SMBus standard
+	I2C_SMBUS_I2C_BLOCK_MAX = 32 // Not specified but we use same structure
+)
 
 // smbus_access read or write markers
-#define I2C_SMBUS_READ  1
-#define I2C_SMBUS_WRITE 0
+const (
+	I2C_SMBUS_READ  = 1
+	I2C_SMBUS_WRITE = 0
+)
 
 // SMBus transaction types (size parameter in the above functions)
-//    Note: these no longer correspond to the (arbitrary) PIIX4 internal codes!
-#define I2C_SMBUS_QUICK         0
-#define I2C_SMBUS_BYTE          1
-#define I2C_SMBUS_BYTE_DATA     2
-#define I2C_SMBUS_WORD_DATA     3
-#define I2C_SMBUS_PROC_CALL     4
-#define I2C_SMBUS_BLOCK_DATA        5
-#define I2C_SMBUS_I2C_BLOCK_BROKEN  6
-#define I2C_SMBUS_BLOCK_PROC_CALL   7
-#define I2C_SMBUS_I2C_BLOCK_DATA    8
+const (
+	I2C_SMBUS_QUICK            = 0
+	I2C_SMBUS_BYTE             = 1
+	I2C_SMBUS_BYTE_DATA        = 2
+	I2C_SMBUS_WORD_DATA        = 3
+	I2C_SMBUS_PROC_CALL        = 4
+	I2C_SMBUS_BLOCK_DATA       = 5
+	I2C_SMBUS_I2C_BLOCK_BROKEN = 6
+	I2C_SMBUS_BLOCK_PROC_CALL  = 7
+	I2C_SMBUS_I2C_BLOCK_DATA   = 8
+)
 
 // ioctl stuff
-#define I2C_SLAVE   0x0703  // Change slave address
-                // Attn.: Slave address is 7 or 10 bits
-#define I2C_SMBUS   0x0720  // SMBus-level access
+const (
+	I2C_SLAVE = 0x0703 // Change slave address, 7 or 10 bits
+	I2C_SMBUS = 0x0720 // SMBus-level access
+)
 
+// smbusData mirrors union i2c_smbus_data: block[0] is used for length
+// and one more byte is reserved for PEC.
+type smbusData [I2C_SMBUS_BLOCK_MAX + 2]byte
+
+// smbusIoctlData mirrors struct i2c_smbus_ioctl_data. Go's alignment rules
+// give it the same layout as the C structure on both 32 and 64 bit targets.
+type smbusIoctlData struct {
+	readWrite uint8
+	command   uint8
+	size      uint32
+	data      *smbusData
+}
 
+var (
+	ReadError   = errors.New("I2C read error")
+	WriteError  = errors.New("I2C write error")
+	LengthError = errors.New("I2C buffer must be at most 32 bytes long")
+)
 
-static int i2c_set_slave_address(int file, int address)
-{
-    if (ioctl(file, I2C_SLAVE, address) < 0) {
-        fprintf(stderr,
-                "Error: Could not set address to 0x%02x: %s\n",
-                address, strerror(errno));
-        return -errno;
-    }
-    return 0;
-}
+const (
+	OP_READ  = "read"
+	OP_WRITE = "write"
+)
 
-static int i2c_smbus_access(int file, char read_write, uint8_t command,
-        int size, union i2c_smbus_data *data)
-{
-    struct i2c_smbus_ioctl_data args;
+// Error describes a failed i2c transaction. Err is usually the
+// syscall.Errno returned by the kernel, or LengthError, so errors.Is and
+// errors.As can be used to inspect it. An Error also matches ReadError or
+// WriteError according to its Op.
+type Error struct {
+	Op    string // OP_READ or OP_WRITE
+	Ioctl string // "I2C_SLAVE" if selecting the address failed, "I2C_SMBUS" otherwise
+	Addr  byte
+	Reg   byte
+	Len   int
+	Err   error
+}
 
-    args.read_write = read_write;
-    args.command = command;
-    args.size = size;
-    args.data = data;
-    return ioctl(file,I2C_SMBUS,&args);
+func (e *Error) Error() string {
+	if e.Ioctl == "I2C_SLAVE" {
+		return fmt.Sprintf("I2C %s error: could not set address to 0x%02x: %s", e.Op, e.Addr, e.Err)
+	}
+	return fmt.Sprintf("I2C %s error at address 0x%02x, register 0x%02x (%d bytes): %s", e.Op, e.Addr, e.Reg, e.Len, e.Err)
 }
 
-//*******************************************************************
+func (e *Error) Unwrap() error {
+	return e.Err
+}
 
-int i2c_open_dev(int bus)
-{
-    char filename[100];
-    int file;
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ReadError:
+		return e.Op == OP_READ
+	case WriteError:
+		return e.Op == OP_WRITE
+	}
+	return false
+}
 
-    snprintf(filename, 100, "/dev/i2c-%d", bus);
-    filename[99]=0;
-    file = open(filename, O_RDWR);
+// Temporary reports whether the error is a bus glitch that may go away if
+// the transaction is retried.
+func (e *Error) Temporary() bool {
+	var errno syscall.Errno
+	if !errors.As(e.Err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.ETIMEDOUT, syscall.EBUSY, syscall.EAGAIN, syscall.EIO:
+		return true
+	}
+	return false
+}
 
-    return file;
+// NotPresent reports whether err shows that no device answers at the
+// target address, typically because the HAT is not plugged in, or that
+// the i2c bus itself does not exist.
+func NotPresent(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.EREMOTEIO, syscall.ENXIO, syscall.ENODEV, syscall.ENOENT:
+		return true
+	}
+	return false
 }
 
-int i2c_read_byte_data(int file, uint8_t addr, uint8_t reg)
-{
-    union i2c_smbus_data data;
-    int res;
+// Temporary reports whether err is an i2c error that may go away if the
+// transaction is retried.
+func Temporary(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Temporary()
+}
 
-    if ((res = i2c_set_slave_address(file, addr))<0) {
-        return res;
-    }
+type Bus int
 
-    if (i2c_smbus_access(file, I2C_SMBUS_READ, reg, I2C_SMBUS_BYTE_DATA,&data))
-        return -1;
-    return 0x0FF & data.byte;
+// BusPath returns the path of the device node of i2c bus number dev.
+func BusPath(dev int) string {
+	return fmt.Sprintf("/dev/i2c-%d", dev)
 }
 
-int i2c_write_byte_data(int file, uint8_t addr, uint8_t reg, uint8_t byte)
-{
-    union i2c_smbus_data data;
-    int res;
-
-    if ((res = i2c_set_slave_address(file, addr))<0) {
-        return res;
-    }
+// OpenBus opens i2c bus number dev, i.e. /dev/i2c-<dev>.
+func OpenBus(dev int) (Bus, error) {
+	return Open(BusPath(dev))
+}
 
-    data.byte = byte;
+// Open opens the i2c device node at path, such as /dev/i2c-3.
+func Open(path string) (Bus, error) {
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return Bus(fd), nil
+}
 
-    if (i2c_smbus_access(file, I2C_SMBUS_WRITE, reg, I2C_SMBUS_BYTE_DATA,&data))
-        return -1;
-    return 0;
+func (i2c Bus) Close() error {
+	return syscall.Close(int(i2c))
 }
 
-int i2c_read_block(int file, uint8_t addr, uint8_t reg, uint8_t *buf, uint8_t count)
-{
-    if (count>32 || count<1)
-    {
-        fprintf(stderr, "i2c block cannot be empty or more than 32 bytes.\n");
-        return -1;
-    }
-
-    union i2c_smbus_data data;
-    int res;
-
-    if ((res = i2c_set_slave_address(file, addr))<0) {
-        return res;
-    }
-
-    uint32_t size;
-    if (count==32)
-        size = I2C_SMBUS_I2C_BLOCK_BROKEN;
-    else
-        size = I2C_SMBUS_I2C_BLOCK_DATA;
-
-    data.block[0] = count;
-
-    if (i2c_smbus_access(file, I2C_SMBUS_READ, reg, size, &data)) {
-        return -1;
-    }
-    for (int i=1;i<=data.block[0];i++)
-        buf[i-1] = data.block[i];
-    return data.block[0];
+func (i2c Bus) ioctl(req uintptr, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i2c), req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
 }
 
-int i2c_write_block(int file, uint8_t addr, uint8_t reg, uint8_t *buf, uint8_t count)
-{
-    if (count>32 || count<1)
-    {
-        fprintf(stderr, "i2c block cannot be empty or more than 32 bytes.\n");
-        return -1;
-    }
-
-    union i2c_smbus_data data;
-    int res;
-
-    if ((res = i2c_set_slave_address(file, addr))<0) {
-        return res;
-    }
-
-    uint32_t size;
-    if (count==32)
-        size = I2C_SMBUS_I2C_BLOCK_BROKEN;
-    else
-        size = I2C_SMBUS_I2C_BLOCK_DATA;
-
-    data.block[0] = count;
-    for (int i=1;i<=count;i++)
-        data.block[i] = buf[i-1];
-
-    if (i2c_smbus_access(file, I2C_SMBUS_WRITE, reg, size, &data))
-        return -1;
-    return 0;
+func (i2c Bus) setSlaveAddress(addr byte) error {
+	return i2c.ioctl(I2C_SLAVE, uintptr(addr))
 }
 
-*/
-// #cgo CFLAGS: -std=c99
-import "C"
+func (i2c Bus) smbusAccess(readWrite uint8, command byte, size uint32, data *smbusData) error {
+	args := smbusIoctlData{
+		readWrite: readWrite,
+		command:   command,
+		size:      size,
+		data:      data,
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(i2c), I2C_SMBUS, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
 
-import "errors"
+func blockSize(count int) uint32 {
+	if count == I2C_SMBUS_I2C_BLOCK_MAX {
+		return I2C_SMBUS_I2C_BLOCK_BROKEN
+	}
+	return I2C_SMBUS_I2C_BLOCK_DATA
+}
 
-var (
-	ReadError   = errors.New("I2C read error")
-	WriteError  = errors.New("I2C write error")
-	LengthError = errors.New("I2C buffer must be at most 32 bytes long")
-)
+// transfer selects the slave address and runs a single SMBus transaction,
+// wrapping any failure in an *Error.
+func (i2c Bus) transfer(op string, addr byte, reg byte, length int, size uint32, data *smbusData) error {
+	var readWrite uint8 = I2C_SMBUS_WRITE
 
-type Bus C.int
+	if op == OP_READ {
+		readWrite = I2C_SMBUS_READ
+	}
+	if err := i2c.setSlaveAddress(addr); err != nil {
+		return &Error{Op: op, Ioctl: "I2C_SLAVE", Addr: addr, Reg: reg, Len: length, Err: err}
+	}
+	if err := i2c.smbusAccess(readWrite, reg, size, data); err != nil {
+		return &Error{Op: op, Ioctl: "I2C_SMBUS", Addr: addr, Reg: reg, Len: length, Err: err}
+	}
+	return nil
+}
 
-func OpenBus(dev int) Bus {
-	r := C.i2c_open_dev(C.int(dev))
-	if r < 0 {
-		return -1
+func checkLength(op string, addr byte, reg byte, length int) error {
+	if length > I2C_SMBUS_I2C_BLOCK_MAX {
+		return &Error{Op: op, Addr: addr, Reg: reg, Len: length, Err: LengthError}
+	}
+	if length == 0 {
+		return &Error{Op: op, Addr: addr, Reg: reg, Len: length, Err: syscall.EINVAL}
 	}
-	return Bus(r)
+	return nil
 }
 
 func (i2c Bus) ReadByte(addr byte, reg byte) (byte, error) {
-	r := C.i2c_read_byte_data(C.int(i2c), C.uchar(addr), C.uchar(reg))
-	if r < 0 {
-		return 0, ReadError
+	var data smbusData
+
+	if err := i2c.transfer(OP_READ, addr, reg, 1, I2C_SMBUS_BYTE_DATA, &data); err != nil {
+		return 0, err
 	}
-	return byte(r), nil
+	return data[0], nil
 }
 
 func (i2c Bus) ReadBytes(addr byte, reg byte, data []byte) error {
-	var buf [32]C.uchar
-	if len(data) > 32 {
-		return LengthError
-	}
-	r := C.i2c_read_block(C.int(i2c), C.uchar(addr), C.uchar(reg), &buf[0], C.uchar(len(data)))
-	if r < 0 {
-		return ReadError
+	var buf smbusData
+
+	if err := checkLength(OP_READ, addr, reg, len(data)); err != nil {
+		return err
 	}
-	for i := 0; i < len(data); i++ {
-		data[i] = byte(buf[i])
+	buf[0] = byte(len(data))
+	if err := i2c.transfer(OP_READ, addr, reg, len(data), blockSize(len(data)), &buf); err != nil {
+		return err
 	}
+	copy(data, buf[1:1+buf[0]])
 	return nil
 }
 
 func (i2c Bus) WriteByte(addr byte, reg byte, data byte) error {
-	r := C.i2c_write_byte_data(C.int(i2c), C.uchar(addr), C.uchar(reg), C.uchar(data))
-	if r < 0 {
-		return WriteError
-	}
-	return nil
+	var buf smbusData
+
+	buf[0] = data
+	return i2c.transfer(OP_WRITE, addr, reg, 1, I2C_SMBUS_BYTE_DATA, &buf)
 }
 
 func (i2c Bus) WriteBytes(addr byte, reg byte, data []byte) error {
-	var buf [32]C.uchar
-	if len(data) > 32 {
-		return LengthError
-	}
-	for i := 0; i < len(data); i++ {
-		buf[i] = C.uchar(data[i])
-	}
-	r := C.i2c_write_block(C.int(i2c), C.uchar(addr), C.uchar(reg), &buf[0], C.uchar(len(data)))
-	if r < 0 {
-		return WriteError
+	var buf smbusData
+
+	if err := checkLength(OP_WRITE, addr, reg, len(data)); err != nil {
+		return err
 	}
-	return nil
+	buf[0] = byte(len(data))
+	copy(buf[1:], data)
+	return i2c.transfer(OP_WRITE, addr, reg, len(data), blockSize(len(data)), &buf)
 }
 
 func (i2c Bus) ModifyByte(addr byte, reg byte, mask byte, data byte) error {
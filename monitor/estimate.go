@@ -0,0 +1,81 @@
+package monitor
+
+import (
+	"errors"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"time"
+)
+
+// BatteryMode tells the state of charge estimation which curve applies to
+// the charger state c.
+func BatteryMode(c device.ChargerState) battery.Mode {
+	switch c {
+	case device.CHARGER_CHARGE_COMPLETE:
+		return battery.MODE_FULL
+	case device.CHARGER_CHARGING:
+		return battery.MODE_CHARGING
+	case device.CHARGER_DISCHARGING, device.CHARGER_LOW_BATTERY:
+		return battery.MODE_DISCHARGING
+	}
+	return battery.MODE_UNKNOWN
+}
+
+// StateOfCharge estimates the battery charge of dev from a single reading,
+// with model, or battery.DefaultModel() if nil. The monitor smooths the
+// estimate over successive readings, which is more accurate.
+func StateOfCharge(dev *device.Device, model *battery.Model) (battery.Estimate, error) {
+	if model == nil {
+		model = battery.DefaultModel()
+	}
+	status, err := dev.Status()
+	if err != nil {
+		return battery.Estimate{}, err
+	}
+	vbat, _, err := dev.Voltage()
+	if err != nil {
+		return battery.Estimate{}, err
+	}
+	return model.Estimate(float64(vbat), BatteryMode(status.Decode().Charger)), nil
+}
+
+// Runtime estimates the time left before the battery of dev is empty or
+// full. It reads the device every interval for the given duration, feeding
+// the estimates of model into rt, and returns the last ones. With a zero
+// duration, the runtime is predicted from a single reading and the rates
+// learned by rt.
+func Runtime(dev *device.Device, model *battery.Model, rt *battery.Runtime, duration time.Duration, interval time.Duration) (battery.Estimate, battery.Remaining, error) {
+	if duration <= 0 {
+		est, err := StateOfCharge(dev, model)
+		if err != nil {
+			return est, battery.Remaining{}, err
+		}
+		return est, rt.Rates.Predict(est, rt.Reserve), nil
+	}
+	if interval <= 0 {
+		return battery.Estimate{}, battery.Remaining{}, errors.New("The sampling interval must be positive")
+	}
+
+	var est battery.Estimate
+	var rem battery.Remaining
+
+	estimator := battery.NewEstimator(model)
+	start := time.Now()
+	for {
+		status, err := dev.Status()
+		if err != nil {
+			return est, rem, err
+		}
+		vbat, _, err := dev.Voltage()
+		if err != nil {
+			return est, rem, err
+		}
+		now := time.Now()
+		est = estimator.Update(now, float64(vbat), BatteryMode(status.Decode().Charger))
+		rem = rt.Update(now, est)
+		if now.Sub(start) >= duration {
+			return est, rem, nil
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,59 @@
+package monitor
+
+import (
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/simulator"
+	"testing"
+	"time"
+)
+
+func TestBatteryMode(t *testing.T) {
+	tests := map[device.ChargerState]battery.Mode{
+		device.CHARGER_CHARGE_COMPLETE: battery.MODE_FULL,
+		device.CHARGER_CHARGING:        battery.MODE_CHARGING,
+		device.CHARGER_DISCHARGING:     battery.MODE_DISCHARGING,
+		device.CHARGER_LOW_BATTERY:     battery.MODE_DISCHARGING,
+		device.CHARGER_FAULT:           battery.MODE_UNKNOWN,
+		device.CHARGER_NO_BATTERY:      battery.MODE_UNKNOWN,
+	}
+	for c, mode := range tests {
+		if m := BatteryMode(c); m != mode {
+			t.Errorf("BatteryMode(%s) = %s, expected %s", c, m, mode)
+		}
+	}
+}
+
+func TestStateOfCharge(t *testing.T) {
+	sim := simulator.New()
+	dev := device.New(sim, device.DEVICE_ADDRESS)
+	model := battery.DefaultModel()
+	sim.SetUSBPower(false)
+	sim.SetBatteryVoltage(3.84 - model.Load*model.InternalResistance)
+
+	est, err := StateOfCharge(dev, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Mode != battery.MODE_DISCHARGING || est.Percent < 48 || est.Percent > 52 {
+		t.Errorf("StateOfCharge() = %+v, expected about 50%% discharging", est)
+	}
+}
+
+func TestRuntime(t *testing.T) {
+	sim := simulator.New()
+	dev := device.New(sim, device.DEVICE_ADDRESS)
+	sim.SetUSBPower(false)
+	rt := battery.NewRuntime(battery.Rates{Discharge: 20})
+
+	est, rem, err := Runtime(dev, nil, rt, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rem.Source != "learned" || rem.TimeToEmpty <= 0 || est.Mode != battery.MODE_DISCHARGING {
+		t.Errorf("Runtime() = %+v, %+v, expected a prediction from the learned rate", est, rem)
+	}
+	if _, _, err := Runtime(dev, nil, rt, time.Minute, 0); err == nil {
+		t.Errorf("Runtime() accepted a zero sampling interval")
+	}
+}
@@ -0,0 +1,148 @@
+package monitor
+
+import (
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"time"
+)
+
+// Event types
+const (
+	EVENT_ON_BATTERY      = "on_battery"      // USB power lost
+	EVENT_ON_MAINS        = "on_mains"        // USB power restored
+	EVENT_CHARGER_CHANGED = "charger_changed" // any change of the charger state
+	EVENT_CHARGE_COMPLETE = "charge_complete"
+	EVENT_LOW_BATTERY     = "low_battery"
+	EVENT_BUTTON_PRESSED  = "button_pressed"
+	EVENT_ALARM_FIRED     = "alarm_fired"
+	EVENT_BATTERY_FAULT   = "battery_fault"  // charger reports "fault" or "err"
+	EVENT_BATTERY_HEALTH  = "battery_health" // battery looks worn or faulty
+	EVENT_DEVICE_ERROR    = "device_error"   // the device could not be polled
+)
+
+var EventTypes = []string{
+	EVENT_ON_BATTERY,
+	EVENT_ON_MAINS,
+	EVENT_CHARGER_CHANGED,
+	EVENT_CHARGE_COMPLETE,
+	EVENT_LOW_BATTERY,
+	EVENT_BUTTON_PRESSED,
+	EVENT_ALARM_FIRED,
+	EVENT_BATTERY_FAULT,
+	EVENT_BATTERY_HEALTH,
+	EVENT_DEVICE_ERROR,
+}
+
+// Sample is the state of the PiVoyager at a given time.
+type Sample struct {
+	Time   time.Time     `json:"time"`
+	Status device.Status `json:"status"`
+	VBat   float32       `json:"vbat"`
+	VRef   float32       `json:"vref"`
+	// Charge is the state of charge estimated by the monitor.
+	Charge battery.Estimate `json:"charge"`
+	// Runtime is the time left before the battery is empty or full.
+	Runtime battery.Remaining `json:"runtime"`
+}
+
+// OnBattery reports whether the Pi runs from the battery.
+func (s Sample) OnBattery() bool {
+	return !s.Status.USB5V
+}
+
+// Charging reports whether the charger is charging the battery.
+func (s Sample) Charging() bool {
+	return s.Status.Charger == device.CHARGER_CHARGING
+}
+
+// LowBattery reports whether the charger reports a low battery or, if
+// threshold is not zero, the Pi runs from a battery below threshold volts.
+func (s Sample) LowBattery(threshold float32) bool {
+	if s.Status.Charger == device.CHARGER_LOW_BATTERY {
+		return true
+	}
+	return threshold > 0 && s.OnBattery() && s.VBat < threshold
+}
+
+type Event struct {
+	Type     string  `json:"type"`
+	Sample   Sample  `json:"sample"`
+	Previous *Sample `json:"previous,omitempty"`
+	Message  string  `json:"message,omitempty"`
+}
+
+// Handler receives the events detected by a Monitor. HandleEvent is called
+// from the polling goroutine and should not block for long.
+type Handler interface {
+	HandleEvent(e Event)
+}
+
+type HandlerFunc func(e Event)
+
+func (f HandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// SampleHandler can be implemented by handlers that also need every sample.
+type SampleHandler interface {
+	HandleSample(s Sample)
+}
+
+func isFault(c device.ChargerState) bool {
+	return c == device.CHARGER_FAULT || c == device.CHARGER_ERR
+}
+
+// transitions returns the events caused by going from prev to cur. If prev
+// is nil, cur is the first sample and events describe the initial state.
+func transitions(prev *Sample, cur Sample, lowBattery float32) []Event {
+	var events []Event
+
+	add := func(t string) {
+		events = append(events, Event{Type: t, Sample: cur, Previous: prev})
+	}
+
+	if prev == nil {
+		if cur.OnBattery() {
+			add(EVENT_ON_BATTERY)
+		}
+		if cur.LowBattery(lowBattery) {
+			add(EVENT_LOW_BATTERY)
+		}
+		if isFault(cur.Status.Charger) {
+			add(EVENT_BATTERY_FAULT)
+		}
+		if cur.Status.ButtonPressed {
+			add(EVENT_BUTTON_PRESSED)
+		}
+		if cur.Status.AlarmTriggered {
+			add(EVENT_ALARM_FIRED)
+		}
+		return events
+	}
+
+	if cur.OnBattery() && !prev.OnBattery() {
+		add(EVENT_ON_BATTERY)
+	}
+	if !cur.OnBattery() && prev.OnBattery() {
+		add(EVENT_ON_MAINS)
+	}
+	if cur.Status.Charger != prev.Status.Charger {
+		add(EVENT_CHARGER_CHANGED)
+		if cur.Status.Charger == device.CHARGER_CHARGE_COMPLETE {
+			add(EVENT_CHARGE_COMPLETE)
+		}
+		if isFault(cur.Status.Charger) && !isFault(prev.Status.Charger) {
+			add(EVENT_BATTERY_FAULT)
+		}
+	}
+	if cur.LowBattery(lowBattery) && !prev.LowBattery(lowBattery) {
+		add(EVENT_LOW_BATTERY)
+	}
+	if cur.Status.ButtonPressed && !prev.Status.ButtonPressed {
+		add(EVENT_BUTTON_PRESSED)
+	}
+	if cur.Status.AlarmTriggered && !prev.Status.AlarmTriggered {
+		add(EVENT_ALARM_FIRED)
+	}
+	return events
+}
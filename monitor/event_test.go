@@ -0,0 +1,76 @@
+package monitor
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"testing"
+)
+
+func sample(usb bool, charger device.ChargerState, vbat float32) Sample {
+	raw := device.DeviceStatus(charger)
+	if usb {
+		raw |= device.STAT_5V
+	}
+	return Sample{Status: raw.Decode(), VBat: vbat}
+}
+
+func types(events []Event) []string {
+	var t []string
+	for _, e := range events {
+		t = append(t, e.Type)
+	}
+	return t
+}
+
+func TestTransitions(t *testing.T) {
+	charging := sample(true, device.CHARGER_CHARGING, 3.9)
+	full := sample(true, device.CHARGER_CHARGE_COMPLETE, 4.2)
+	discharging := sample(false, device.CHARGER_DISCHARGING, 3.9)
+	low := sample(false, device.CHARGER_DISCHARGING, 3.5)
+
+	tests := []struct {
+		prev     *Sample
+		cur      Sample
+		expected []string
+	}{
+		{nil, charging, nil},
+		{nil, low, []string{EVENT_ON_BATTERY, EVENT_LOW_BATTERY}},
+		{&charging, charging, nil},
+		{&charging, full, []string{EVENT_CHARGER_CHANGED, EVENT_CHARGE_COMPLETE}},
+		{&full, discharging, []string{EVENT_ON_BATTERY, EVENT_CHARGER_CHANGED}},
+		{&discharging, low, []string{EVENT_LOW_BATTERY}},
+		{&low, low, nil},
+		{&low, charging, []string{EVENT_ON_MAINS, EVENT_CHARGER_CHANGED}},
+	}
+	for i, test := range tests {
+		got := types(transitions(test.prev, test.cur, 3.6))
+		if len(got) != len(test.expected) {
+			t.Errorf("test %d: transitions() = %v, expected %v", i, got, test.expected)
+			continue
+		}
+		for j := range got {
+			if got[j] != test.expected[j] {
+				t.Errorf("test %d: transitions() = %v, expected %v", i, got, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestLowBattery(t *testing.T) {
+	tests := []struct {
+		s         Sample
+		threshold float32
+		expected  bool
+	}{
+		{sample(false, device.CHARGER_LOW_BATTERY, 3.5), 0, true},
+		{sample(false, device.CHARGER_DISCHARGING, 3.5), 0, false},
+		{sample(false, device.CHARGER_DISCHARGING, 3.5), 3.6, true},
+		// The voltage only matters on battery.
+		{sample(true, device.CHARGER_CHARGING, 3.5), 3.6, false},
+	}
+	for _, test := range tests {
+		if low := test.s.LowBattery(test.threshold); low != test.expected {
+			t.Errorf("LowBattery(%g) = %v for %s at %gV", test.threshold, low, test.s.Status, test.s.VBat)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+// Package monitor polls a PiVoyager and reports power transitions, such as
+// USB power being lost or the button being pressed, to a set of handlers.
+package monitor
+
+import (
+	"context"
+	"github.com/omzlo/pivoyager/battery"
+	"github.com/omzlo/pivoyager/device"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_INTERVAL = 5 * time.Second
+)
+
+type Monitor struct {
+	Device   *device.Device
+	Interval time.Duration
+	// LowBatteryVoltage, if not zero, triggers EVENT_LOW_BATTERY when the
+	// battery voltage drops below it on battery power, in addition to the
+	// charger reporting a low battery.
+	LowBatteryVoltage float32
+	// ClearFlags clears the button and alarm status flags once reported, so
+	// that the next press or alarm is detected as well.
+	ClearFlags bool
+	// Battery estimates the state of charge of each sample.
+	Battery *battery.Estimator
+	// Runtime estimates the time left on battery, or before a full charge.
+	Runtime *battery.Runtime
+	// Health tracks the cycles and faults of the battery, and raises
+	// EVENT_BATTERY_HEALTH when it looks worn or faulty.
+	Health *battery.Tracker
+	Logger *log.Logger
+
+	mu       sync.Mutex
+	handlers []Handler
+	latest   *Sample
+	failing  bool
+}
+
+func New(dev *device.Device, interval time.Duration) *Monitor {
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+	return &Monitor{
+		Device:   dev,
+		Interval: interval,
+		Battery:  battery.NewEstimator(nil),
+		Runtime:  battery.NewRuntime(battery.Rates{}),
+		Health:   battery.NewTracker(battery.Health{}),
+	}
+}
+
+// Handle registers h to receive events. If h also implements
+// SampleHandler, it receives every sample as well.
+func (m *Monitor) Handle(h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers = append(m.handlers, h)
+}
+
+// Latest returns the last sample read, if any.
+func (m *Monitor) Latest() (Sample, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latest == nil {
+		return Sample{}, false
+	}
+	return *m.latest, true
+}
+
+// Resume makes s the previous sample, e.g. the last sample of the monitor
+// replaced on a reload, so that the first poll only reports the changes
+// since s rather than the initial state.
+func (m *Monitor) Resume(s Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latest = &s
+}
+
+func (m *Monitor) logf(format string, args ...interface{}) {
+	if m.Logger != nil {
+		m.Logger.Printf(format, args...)
+	}
+}
+
+// Read takes a sample from the device, without dispatching it. The status
+// and the voltage are read in turn, without holding the device lock in
+// between, since oversampling the voltage may take a while.
+func (m *Monitor) Read() (Sample, error) {
+	var s Sample
+
+	status, err := m.Device.Status()
+	if err != nil {
+		return s, err
+	}
+	s.Time = time.Now()
+	s.Status = status.Decode()
+	s.VBat, s.VRef, err = m.Device.Voltage()
+	return s, err
+}
+
+// Poll takes a sample and dispatches it, along with the events it causes,
+// to the handlers.
+func (m *Monitor) Poll() (Sample, error) {
+	s, err := m.Read()
+	if err != nil {
+		m.mu.Lock()
+		first := !m.failing
+		m.failing = true
+		m.mu.Unlock()
+		if first {
+			m.logf("Failed to poll pivoyager: %s", err)
+			m.dispatch(nil, []Event{{Type: EVENT_DEVICE_ERROR, Sample: Sample{Time: time.Now()}, Message: err.Error()}})
+		}
+		return s, err
+	}
+
+	m.mu.Lock()
+	if m.failing {
+		m.logf("Polling pivoyager again")
+	}
+	m.failing = false
+	s.Charge = m.Battery.Update(s.Time, float64(s.VBat), BatteryMode(s.Status.Charger))
+	s.Runtime = m.Runtime.Update(s.Time, s.Charge)
+	m.Health.SetDischargeRate(m.Runtime.Rates.Discharge)
+	warnings := m.Health.Update(s.Time, s.Charge, isFault(s.Status.Charger))
+	prev := m.latest
+	events := transitions(prev, s, m.LowBatteryVoltage)
+	for _, w := range warnings {
+		events = append(events, Event{Type: EVENT_BATTERY_HEALTH, Sample: s, Previous: prev, Message: w.Message})
+	}
+	latest := s
+	m.latest = &latest
+	m.mu.Unlock()
+
+	m.dispatch(&s, events)
+
+	if m.ClearFlags {
+		m.clearFlags(s)
+	}
+	return s, nil
+}
+
+func (m *Monitor) clearFlags(s Sample) {
+	var prog byte
+
+	if s.Status.ButtonPressed {
+		prog |= device.PROG_CLEAR_BUTTON
+	}
+	if s.Status.AlarmTriggered {
+		prog |= device.PROG_CLEAR_ALARM
+	}
+	if prog == 0 {
+		return
+	}
+	if err := m.Device.Program(prog); err != nil {
+		m.logf("Failed to clear status flags: %s", err)
+		return
+	}
+	m.mu.Lock()
+	if m.latest != nil {
+		m.latest.Status = (m.latest.Status.Raw &^ (device.STAT_BUTTON | device.STAT_ALARM)).Decode()
+	}
+	m.mu.Unlock()
+}
+
+func (m *Monitor) dispatch(s *Sample, events []Event) {
+	m.mu.Lock()
+	handlers := append([]Handler(nil), m.handlers...)
+	m.mu.Unlock()
+
+	for _, h := range handlers {
+		if sh, ok := h.(SampleHandler); ok && s != nil {
+			sh.HandleSample(*s)
+		}
+	}
+	for _, e := range events {
+		for _, h := range handlers {
+			h.HandleEvent(e)
+		}
+	}
+}
+
+// Run polls the device every Interval until ctx is cancelled.
+func (m *Monitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		m.Poll()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// LogHandler returns a handler writing each event to logger.
+func LogHandler(logger *log.Logger) Handler {
+	return HandlerFunc(func(e Event) {
+		if e.Message != "" {
+			logger.Printf("Event %s: %s", e.Type, e.Message)
+			return
+		}
+		logger.Printf("Event %s: %s, battery %s, VBat %.2fV", e.Type, e.Sample.Status, e.Sample.Status.Charger, e.Sample.VBat)
+	})
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/simulator"
+	"syscall"
+	"testing"
+)
+
+func newMonitor() (*simulator.PiVoyager, *Monitor, *[]string) {
+	sim := simulator.New()
+	m := New(device.New(sim, device.DEVICE_ADDRESS), 0)
+	var events []string
+	m.Handle(HandlerFunc(func(e Event) {
+		events = append(events, e.Type)
+	}))
+	return sim, m, &events
+}
+
+func TestPoll(t *testing.T) {
+	sim, m, events := newMonitor()
+	m.ClearFlags = true
+
+	if _, err := m.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	sim.SetUSBPower(false)
+	sim.PressButton()
+	s, err := m.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.OnBattery() || s.Charge.Percent == 0 {
+		t.Errorf("Poll() = %+v, expected a sample on battery with its charge", s)
+	}
+	sim.FailNext(1, syscall.EIO)
+	if _, err := m.Poll(); err == nil {
+		t.Fatal("Poll() did not report the bus error")
+	}
+	// The button flag was cleared once reported.
+	if _, err := m.Poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{EVENT_ON_BATTERY, EVENT_CHARGER_CHANGED, EVENT_BUTTON_PRESSED, EVENT_DEVICE_ERROR}
+	if len(*events) != len(expected) {
+		t.Fatalf("events = %v, expected %v", *events, expected)
+	}
+	for i := range expected {
+		if (*events)[i] != expected[i] {
+			t.Errorf("events = %v, expected %v", *events, expected)
+			break
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	sim, m, _ := newMonitor()
+	sim.SetUSBPower(false)
+	s, err := m.Poll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A monitor replacing m on a reload does not report the outage again.
+	_, resumed, events := newMonitor()
+	resumed.Device = m.Device
+	resumed.Resume(s)
+	if _, err := resumed.Poll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(*events) != 0 {
+		t.Errorf("the resumed monitor reported %v", *events)
+	}
+}
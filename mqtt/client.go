@@ -0,0 +1,468 @@
+// Package mqtt is a minimal MQTT 3.1.1 client, publishing and subscribing
+// at QoS 0, though it acknowledges the messages a broker delivers at a
+// higher QoS, and a publisher exposing the PiVoyager to Home Assistant.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BROKER     = "localhost:1883"
+	DEFAULT_KEEP_ALIVE = 60 * time.Second
+)
+
+// Packet types
+const (
+	CONNECT     = 1
+	CONNACK     = 2
+	PUBLISH     = 3
+	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
+	SUBSCRIBE   = 8
+	SUBACK      = 9
+	UNSUBSCRIBE = 10
+	PINGREQ     = 12
+	PINGRESP    = 13
+	DISCONNECT  = 14
+)
+
+var connackErrors = []string{
+	"",
+	"unacceptable protocol version",
+	"identifier rejected",
+	"server unavailable",
+	"bad user name or password",
+	"not authorized",
+}
+
+var ClientClosed = errors.New("MQTT client closed")
+
+type Message struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+type Options struct {
+	// Broker is the TCP address of the broker, optionally prefixed with
+	// "tcp://" or "mqtt://".
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+	// Will, if not nil, is published by the broker if the connection is
+	// lost.
+	Will *Message
+	// OnMessage is called, from the reading goroutine, for each message
+	// received on the subscribed topics.
+	OnMessage func(m Message)
+}
+
+type Client struct {
+	opts Options
+	conn net.Conn
+
+	mu     sync.Mutex // serialises writes
+	nextID uint16
+
+	pending sync.Mutex
+	// subacks are the subscriptions waiting for their SUBACK, by packet
+	// identifier.
+	subacks map[uint16]chan error
+	// unreleased are the identifiers of the QoS 2 messages delivered but not
+	// released by the broker yet, which must not be delivered twice.
+	unreleased map[uint16]struct{}
+
+	done    chan struct{}
+	errOnce sync.Once
+	err     error
+}
+
+/* Encoding */
+
+type packet struct {
+	header byte
+	body   []byte
+}
+
+func (p *packet) byte(b byte) {
+	p.body = append(p.body, b)
+}
+
+func (p *packet) uint16(v uint16) {
+	p.body = append(p.body, byte(v>>8), byte(v))
+}
+
+func (p *packet) string(s string) {
+	p.uint16(uint16(len(s)))
+	p.body = append(p.body, s...)
+}
+
+func (p *packet) bytes(b []byte) {
+	p.body = append(p.body, b...)
+}
+
+func (p *packet) encode() []byte {
+	buf := []byte{p.header}
+	n := len(p.body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(buf, p.body...)
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := 0
+	for shift := uint(0); ; shift += 7 {
+		if shift > 21 {
+			return nil, errors.New("Malformed MQTT remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{header: header, body: body}, nil
+}
+
+/* Connection */
+
+func brokerAddress(broker string) string {
+	if broker == "" {
+		return DEFAULT_BROKER
+	}
+	for _, prefix := range []string{"tcp://", "mqtt://"} {
+		broker = strings.TrimPrefix(broker, prefix)
+	}
+	if _, _, err := net.SplitHostPort(broker); err != nil {
+		return net.JoinHostPort(broker, "1883")
+	}
+	return broker
+}
+
+// Connect connects to the broker and starts reading incoming packets.
+func Connect(ctx context.Context, opts Options) (*Client, error) {
+	if opts.KeepAlive <= 0 {
+		opts.KeepAlive = DEFAULT_KEEP_ALIVE
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", brokerAddress(opts.Broker))
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		opts:       opts,
+		conn:       conn,
+		done:       make(chan struct{}),
+		subacks:    make(map[uint16]chan error),
+		unreleased: make(map[uint16]struct{}),
+	}
+
+	p := &packet{header: CONNECT << 4}
+	p.string("MQTT")
+	// Protocol level 4 is MQTT 3.1.1.
+	p.byte(4)
+	flags := byte(0x02) // clean session
+	if opts.Will != nil {
+		flags |= 0x04
+		if opts.Will.Retain {
+			flags |= 0x20
+		}
+	}
+	if opts.Username != "" {
+		flags |= 0x80
+		if opts.Password != "" {
+			flags |= 0x40
+		}
+	}
+	p.byte(flags)
+	p.uint16(uint16(opts.KeepAlive / time.Second))
+	p.string(opts.ClientID)
+	if opts.Will != nil {
+		p.string(opts.Will.Topic)
+		p.uint16(uint16(len(opts.Will.Payload)))
+		p.bytes(opts.Will.Payload)
+	}
+	if opts.Username != "" {
+		p.string(opts.Username)
+		if opts.Password != "" {
+			p.string(opts.Password)
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	r := bufio.NewReader(conn)
+	if _, err := conn.Write(p.encode()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack.header>>4 != CONNACK || len(ack.body) != 2 {
+		conn.Close()
+		return nil, errors.New("MQTT broker did not acknowledge the connection")
+	}
+	if code := ack.body[1]; code != 0 {
+		conn.Close()
+		if int(code) < len(connackErrors) {
+			return nil, fmt.Errorf("MQTT connection refused: %s", connackErrors[code])
+		}
+		return nil, fmt.Errorf("MQTT connection refused: code %d", code)
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.read(r)
+	go c.ping()
+	return c, nil
+}
+
+func (c *Client) fail(err error) {
+	c.errOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+// Done is closed once the connection is lost or closed. Err then returns
+// why.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Client) write(p *packet) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.opts.KeepAlive))
+	if _, err := c.conn.Write(p.encode()); err != nil {
+		c.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) read(r *bufio.Reader) {
+	for {
+		// The broker answers pings, so it cannot stay silent that long.
+		c.conn.SetReadDeadline(time.Now().Add(c.opts.KeepAlive * 3 / 2))
+		p, err := readPacket(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		switch p.header >> 4 {
+		case PUBLISH:
+			c.receive(p)
+		case PUBREL:
+			if len(p.body) < 2 {
+				c.fail(errors.New("Malformed MQTT PUBREL"))
+				return
+			}
+			id := uint16(p.body[0])<<8 | uint16(p.body[1])
+			c.pending.Lock()
+			delete(c.unreleased, id)
+			c.pending.Unlock()
+			comp := &packet{header: PUBCOMP << 4}
+			comp.uint16(id)
+			c.write(comp)
+		case SUBACK:
+			// A packet identifier and at least one return code.
+			if len(p.body) < 3 {
+				c.fail(errors.New("Malformed MQTT SUBACK"))
+				return
+			}
+			var err error
+			for _, code := range p.body[2:] {
+				if code == 0x80 {
+					err = errors.New("MQTT subscription refused")
+				}
+			}
+			id := uint16(p.body[0])<<8 | uint16(p.body[1])
+			c.pending.Lock()
+			if ack, ok := c.subacks[id]; ok {
+				ack <- err
+				delete(c.subacks, id)
+			}
+			c.pending.Unlock()
+			if err != nil {
+				c.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) receive(p *packet) {
+	if len(p.body) < 2 {
+		return
+	}
+	n := int(p.body[0])<<8 | int(p.body[1])
+	if len(p.body) < 2+n {
+		return
+	}
+	m := Message{Topic: string(p.body[2 : 2+n]), Retain: p.header&0x01 != 0}
+	rest := p.body[2+n:]
+	switch qos := (p.header >> 1) & 3; qos {
+	case 1, 2:
+		if len(rest) < 2 {
+			return
+		}
+		id := uint16(rest[0])<<8 | uint16(rest[1])
+		rest = rest[2:]
+		if qos == 1 {
+			ack := &packet{header: PUBACK << 4}
+			ack.uint16(id)
+			c.write(ack)
+			break
+		}
+		// Exactly once: the message is delivered on its first PUBLISH, and
+		// only acknowledged again if the broker resends it before PUBREL.
+		c.pending.Lock()
+		_, delivered := c.unreleased[id]
+		c.unreleased[id] = struct{}{}
+		c.pending.Unlock()
+		rec := &packet{header: PUBREC << 4}
+		rec.uint16(id)
+		c.write(rec)
+		if delivered {
+			return
+		}
+	case 3:
+		// Reserved, a protocol violation.
+		return
+	}
+	m.Payload = rest
+	if c.opts.OnMessage != nil {
+		c.opts.OnMessage(m)
+	}
+}
+
+func (c *Client) ping() {
+	ticker := time.NewTicker(c.opts.KeepAlive * 3 / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if c.write(&packet{header: PINGREQ << 4}) != nil {
+				return
+			}
+		}
+	}
+}
+
+// Publish publishes payload on topic, at QoS 0.
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	p := &packet{header: PUBLISH << 4}
+	if retain {
+		p.header |= 0x01
+	}
+	p.string(topic)
+	p.bytes(payload)
+	return c.write(p)
+}
+
+// Subscribe subscribes to the topic filters, at QoS 0, and waits for the
+// broker to acknowledge the subscription.
+func (c *Client) Subscribe(filters ...string) error {
+	c.mu.Lock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	id := c.nextID
+	c.mu.Unlock()
+
+	ack := make(chan error, 1)
+	c.pending.Lock()
+	c.subacks[id] = ack
+	c.pending.Unlock()
+	defer func() {
+		c.pending.Lock()
+		delete(c.subacks, id)
+		c.pending.Unlock()
+	}()
+
+	p := &packet{header: SUBSCRIBE<<4 | 0x02}
+	p.uint16(id)
+	for _, f := range filters {
+		p.string(f)
+		p.byte(0)
+	}
+	if err := c.write(p); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.opts.KeepAlive)
+	defer timer.Stop()
+	select {
+	case err := <-ack:
+		return err
+	case <-c.done:
+		return c.err
+	case <-timer.C:
+		err := errors.New("MQTT broker did not acknowledge the subscription")
+		c.fail(err)
+		return err
+	}
+}
+
+// Close disconnects from the broker. The will is not published.
+func (c *Client) Close() error {
+	err := c.write(&packet{header: DISCONNECT << 4})
+	c.fail(ClientClosed)
+	return err
+}
@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestPacketEncoding(t *testing.T) {
+	for _, length := range []int{0, 127, 128, 16383, 16384, 200000} {
+		p := &packet{header: PUBLISH << 4, body: bytes.Repeat([]byte{0x5A}, length)}
+		data := p.encode()
+		decoded, err := readPacket(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("readPacket() of %d bytes: %s", length, err)
+		}
+		if decoded.header != p.header || !bytes.Equal(decoded.body, p.body) {
+			t.Errorf("readPacket() of %d bytes did not decode the encoded packet", length)
+		}
+	}
+}
+
+func TestMalformedLength(t *testing.T) {
+	data := []byte{PUBLISH << 4, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}
+	if _, err := readPacket(bufio.NewReader(bytes.NewReader(data))); err == nil {
+		t.Errorf("readPacket() accepted a remaining length of 5 bytes")
+	}
+}
+
+func TestBrokerAddress(t *testing.T) {
+	tests := map[string]string{
+		"":                   DEFAULT_BROKER,
+		"broker":             "broker:1883",
+		"tcp://broker:1884":  "broker:1884",
+		"mqtt://192.168.1.2": "192.168.1.2:1883",
+		"[fe80::1]:8883":     "[fe80::1]:8883",
+	}
+	for broker, expected := range tests {
+		if addr := brokerAddress(broker); addr != expected {
+			t.Errorf("brokerAddress(%q) = %q, expected %q", broker, addr, expected)
+		}
+	}
+}
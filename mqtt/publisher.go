@@ -0,0 +1,442 @@
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TOPIC            = "pivoyager"
+	DEFAULT_DISCOVERY_PREFIX = "homeassistant"
+	DEFAULT_INTERVAL         = 60 * time.Second
+	MAX_BACKOFF              = 60 * time.Second
+	QUEUE_SIZE               = 64
+)
+
+// Topics, relative to Publisher.Topic.
+const (
+	TOPIC_AVAILABILITY = "availability" // "online" or "offline", retained
+	TOPIC_STATE        = "state"        // JSON state, retained
+	TOPIC_VOLTAGE      = "voltage"      // battery voltage, retained
+	TOPIC_POWER        = "power"        // "ON" on USB power, "OFF" on battery, retained
+	TOPIC_EVENT        = "event"        // JSON monitor.Event
+	TOPIC_BUTTON       = "button"       // {"event_type":"press"}, for the Home Assistant event entity
+	TOPIC_COMMAND      = "command"      // command/shutdown, command/wakeup, command/alarm
+)
+
+// Shutdowner shuts the system down on behalf of the shutdown command.
+type Shutdowner interface {
+	Shutdown(reason string, stayOff bool) error
+}
+
+// State is the JSON payload published on TOPIC_STATE.
+type State struct {
+	Time     time.Time           `json:"time"`
+	USBPower bool                `json:"usb_power"`
+	Charger  device.ChargerState `json:"charger"`
+	VBat     float64             `json:"vbat"`
+	VRef     float64             `json:"vref"`
+	Charge   float64             `json:"charge"`
+	// ChargeConfidence, from 0 to 1, is how much Charge can be trusted.
+	ChargeConfidence float64 `json:"charge_confidence"`
+	// TimeToEmpty and TimeToFull are in seconds, rounded to the minute, and
+	// omitted when unknown.
+	TimeToEmpty int64 `json:"time_to_empty,omitempty"`
+	TimeToFull  int64 `json:"time_to_full,omitempty"`
+	Button      bool  `json:"button"`
+	Alarm       bool  `json:"alarm"`
+}
+
+func NewState(s monitor.Sample) State {
+	return State{
+		Time:             s.Time,
+		USBPower:         s.Status.USB5V,
+		Charger:          s.Status.Charger,
+		VBat:             round(s.VBat),
+		VRef:             round(s.VRef),
+		Charge:           math.Round(s.Charge.Percent),
+		ChargeConfidence: s.Charge.Confidence,
+		TimeToEmpty:      roundMinute(s.Runtime.TimeToEmpty),
+		TimeToFull:       roundMinute(s.Runtime.TimeToFull),
+		Button:           s.Status.ButtonPressed,
+		Alarm:            s.Status.AlarmTriggered,
+	}
+}
+
+func round(v float32) float64 {
+	return math.Round(float64(v)*100) / 100
+}
+
+func roundMinute(d time.Duration) int64 {
+	return int64(d.Round(time.Minute) / time.Second)
+}
+
+// Publisher publishes the samples and events of a monitor to an MQTT
+// broker, announces them to Home Assistant through MQTT discovery, and runs
+// the commands received on the command topics.
+type Publisher struct {
+	// Options to connect to the broker. Will and OnMessage are set by the
+	// publisher.
+	Options Options
+	// Topic is the prefix of all the topics published, e.g. pivoyager/pi.
+	Topic string
+	// DiscoveryPrefix is the Home Assistant discovery prefix. Discovery is
+	// disabled if empty.
+	DiscoveryPrefix string
+	// NodeID identifies the PiVoyager in Home Assistant.
+	NodeID string
+	// Name is the device name shown in Home Assistant.
+	Name     string
+	Firmware string
+	// Interval is the longest time between two publications of the state,
+	// which is otherwise only published when it changes.
+	Interval time.Duration
+	// Commands subscribes to the command topics and runs the commands
+	// received on them.
+	Commands bool
+	// Device, if not nil, runs the wakeup and alarm commands.
+	Device *device.Device
+	// Shutdown, if not nil, runs the shutdown command.
+	Shutdown Shutdowner
+	Logger   *log.Logger
+
+	queue     chan Message
+	mu        sync.Mutex
+	latest    *State
+	published time.Time
+}
+
+func NewPublisher(opts Options, topic string, nodeID string) *Publisher {
+	if topic == "" {
+		topic = DEFAULT_TOPIC
+	}
+	return &Publisher{
+		Options:         opts,
+		Topic:           strings.TrimSuffix(topic, "/"),
+		DiscoveryPrefix: DEFAULT_DISCOVERY_PREFIX,
+		NodeID:          nodeID,
+		Name:            "PiVoyager",
+		Interval:        DEFAULT_INTERVAL,
+		queue:           make(chan Message, QUEUE_SIZE),
+	}
+}
+
+func (p *Publisher) logf(format string, args ...interface{}) {
+	if p.Logger != nil {
+		p.Logger.Printf(format, args...)
+	}
+}
+
+func (p *Publisher) topic(name string) string {
+	return p.Topic + "/" + name
+}
+
+// enqueue queues m for publication. Messages are dropped while the queue is
+// full, e.g. when the broker is unreachable: the state is republished on
+// reconnection anyway.
+func (p *Publisher) enqueue(m Message) {
+	select {
+	case p.queue <- m:
+	default:
+	}
+}
+
+func (p *Publisher) stateMessages(st State) []Message {
+	data, _ := json.Marshal(&st)
+	power := "OFF"
+	if st.USBPower {
+		power = "ON"
+	}
+	return []Message{
+		{Topic: p.topic(TOPIC_STATE), Payload: data, Retain: true},
+		{Topic: p.topic(TOPIC_VOLTAGE), Payload: []byte(strconv.FormatFloat(st.VBat, 'f', 2, 64)), Retain: true},
+		{Topic: p.topic(TOPIC_POWER), Payload: []byte(power), Retain: true},
+	}
+}
+
+// HandleSample publishes the state if it changed or if it was last
+// published more than Interval ago.
+func (p *Publisher) HandleSample(s monitor.Sample) {
+	st := NewState(s)
+
+	p.mu.Lock()
+	changed := p.latest == nil || !sameState(*p.latest, st) || s.Time.Sub(p.published) >= p.Interval
+	p.latest = &st
+	if changed {
+		p.published = s.Time
+	}
+	p.mu.Unlock()
+
+	if changed {
+		for _, m := range p.stateMessages(st) {
+			p.enqueue(m)
+		}
+	}
+}
+
+func sameState(a State, b State) bool {
+	a.Time = b.Time
+	return a == b
+}
+
+// HandleEvent publishes e on TOPIC_EVENT, and button presses on
+// TOPIC_BUTTON.
+func (p *Publisher) HandleEvent(e monitor.Event) {
+	if e.Type == monitor.EVENT_CHARGER_CHANGED {
+		return
+	}
+	data, _ := json.Marshal(&e)
+	p.enqueue(Message{Topic: p.topic(TOPIC_EVENT), Payload: data})
+	if e.Type == monitor.EVENT_BUTTON_PRESSED {
+		p.enqueue(Message{Topic: p.topic(TOPIC_BUTTON), Payload: []byte(`{"event_type":"press"}`)})
+	}
+}
+
+// Run publishes to the broker until ctx is cancelled, reconnecting with an
+// increasing delay whenever the connection is lost.
+func (p *Publisher) Run(ctx context.Context) error {
+	backoff := time.Second
+	for {
+		connected, err := p.session(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if connected {
+			backoff = time.Second
+		}
+		p.logf("MQTT connection to %s failed: %s, retrying in %s", brokerAddress(p.Options.Broker), err, backoff)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+}
+
+// session connects to the broker and publishes until ctx is cancelled or
+// the connection is lost. It reports whether the connection succeeded.
+func (p *Publisher) session(ctx context.Context) (bool, error) {
+	availability := p.topic(TOPIC_AVAILABILITY)
+
+	opts := p.Options
+	opts.Will = &Message{Topic: availability, Payload: []byte("offline"), Retain: true}
+	opts.OnMessage = p.receive
+	c, err := Connect(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+	defer c.Close()
+	p.logf("Connected to MQTT broker %s", brokerAddress(opts.Broker))
+
+	if p.Commands {
+		if err := c.Subscribe(p.topic(TOPIC_COMMAND) + "/+"); err != nil {
+			return true, err
+		}
+	}
+	if p.DiscoveryPrefix != "" {
+		for _, m := range p.Discovery() {
+			if err := c.Publish(m.Topic, m.Payload, m.Retain); err != nil {
+				return true, err
+			}
+		}
+	}
+	p.mu.Lock()
+	latest := p.latest
+	p.mu.Unlock()
+	if latest != nil {
+		for _, m := range p.stateMessages(*latest) {
+			if err := c.Publish(m.Topic, m.Payload, m.Retain); err != nil {
+				return true, err
+			}
+		}
+	}
+	if err := c.Publish(availability, []byte("online"), true); err != nil {
+		return true, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.Publish(availability, []byte("offline"), true)
+			return true, nil
+		case <-c.Done():
+			return true, c.Err()
+		case m := <-p.queue:
+			if err := c.Publish(m.Topic, m.Payload, m.Retain); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+/* Home Assistant discovery */
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// Discovery returns the retained Home Assistant discovery messages
+// describing the entities of the PiVoyager.
+func (p *Publisher) Discovery() []Message {
+	var msgs []Message
+
+	dev := &discoveryDevice{
+		Identifiers:  []string{"pivoyager_" + p.NodeID},
+		Name:         p.Name,
+		Manufacturer: "Omzlo",
+		Model:        "PiVoyager",
+		SWVersion:    p.Firmware,
+	}
+	add := func(component string, object string, config map[string]interface{}) {
+		config["unique_id"] = "pivoyager_" + p.NodeID + "_" + object
+		config["object_id"] = "pivoyager_" + p.NodeID + "_" + object
+		config["availability_topic"] = p.topic(TOPIC_AVAILABILITY)
+		config["device"] = dev
+		data, _ := json.Marshal(config)
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", p.DiscoveryPrefix, component, p.NodeID, object)
+		msgs = append(msgs, Message{Topic: topic, Payload: data, Retain: true})
+	}
+
+	add("sensor", "battery", map[string]interface{}{
+		"name":                "Battery",
+		"device_class":        "battery",
+		"unit_of_measurement": "%",
+		"state_class":         "measurement",
+		"state_topic":         p.topic(TOPIC_STATE),
+		"value_template":      "{{ value_json.charge }}",
+	})
+	add("sensor", "battery_voltage", map[string]interface{}{
+		"name":                "Battery voltage",
+		"device_class":        "voltage",
+		"unit_of_measurement": "V",
+		"state_class":         "measurement",
+		"state_topic":         p.topic(TOPIC_VOLTAGE),
+	})
+	add("sensor", "time_to_empty", map[string]interface{}{
+		"name":                "Time to empty",
+		"device_class":        "duration",
+		"unit_of_measurement": "s",
+		"state_topic":         p.topic(TOPIC_STATE),
+		"value_template":      "{{ value_json.time_to_empty | default(None) }}",
+	})
+	add("sensor", "time_to_full", map[string]interface{}{
+		"name":                "Time to full",
+		"device_class":        "duration",
+		"unit_of_measurement": "s",
+		"state_topic":         p.topic(TOPIC_STATE),
+		"value_template":      "{{ value_json.time_to_full | default(None) }}",
+	})
+	add("sensor", "charger", map[string]interface{}{
+		"name":           "Charger",
+		"icon":           "mdi:battery-charging",
+		"state_topic":    p.topic(TOPIC_STATE),
+		"value_template": "{{ value_json.charger }}",
+	})
+	add("binary_sensor", "power", map[string]interface{}{
+		"name":         "Power connected",
+		"device_class": "power",
+		"state_topic":  p.topic(TOPIC_POWER),
+	})
+	add("event", "button", map[string]interface{}{
+		"name":         "Button",
+		"device_class": "button",
+		"event_types":  []string{"press"},
+		"state_topic":  p.topic(TOPIC_BUTTON),
+	})
+	if p.Commands && p.Shutdown != nil {
+		add("button", "shutdown", map[string]interface{}{
+			"name":          "Shut down",
+			"icon":          "mdi:power",
+			"command_topic": p.topic(TOPIC_COMMAND) + "/shutdown",
+			"payload_press": "return",
+		})
+	}
+	return msgs
+}
+
+/* Commands */
+
+func (p *Publisher) receive(m Message) {
+	prefix := p.topic(TOPIC_COMMAND) + "/"
+	if !p.Commands || !strings.HasPrefix(m.Topic, prefix) {
+		return
+	}
+	// Ignore commands retained by mistake, which would be run again on
+	// every connection.
+	if m.Retain {
+		p.logf("Ignoring retained MQTT command on %s", m.Topic)
+		return
+	}
+	name := strings.TrimPrefix(m.Topic, prefix)
+	arg := strings.TrimSpace(string(m.Payload))
+	// Shutting down takes a while, and must not block the connection.
+	go func() {
+		if err := p.Command(name, arg); err != nil {
+			p.logf("MQTT command %s '%s' failed: %s", name, arg, err)
+			return
+		}
+		p.logf("MQTT command %s '%s' done", name, arg)
+	}()
+}
+
+// Command runs a command received on TOPIC_COMMAND/name:
+//
+//	shutdown [return|stayoff]   shut down, waking up as configured, or not
+//	wakeup <seconds>            wake up after seconds, 0 to disable
+//	alarm <alarm>               wake up on alarm, e.g. "*-7-0-0", or "off"
+func (p *Publisher) Command(name string, arg string) error {
+	switch name {
+	case "shutdown":
+		if p.Shutdown == nil {
+			return fmt.Errorf("Shutdown is not enabled")
+		}
+		switch arg {
+		case "", "return":
+			return p.Shutdown.Shutdown("MQTT shutdown command", false)
+		case "stayoff":
+			return p.Shutdown.Shutdown("MQTT shutdown command", true)
+		}
+		return fmt.Errorf("Expected 'return' or 'stayoff', got '%s'", arg)
+	case "wakeup":
+		if p.Device == nil {
+			return fmt.Errorf("Device commands are not enabled")
+		}
+		delay, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return fmt.Errorf("Invalid wakeup delay '%s'", arg)
+		}
+		if delay == 0 {
+			return p.Device.ModifyConfiguration(device.CONF_WAKE_AFTER, 0)
+		}
+		return p.Device.SetWakeup(uint16(delay), device.CONF_WAKE_AFTER)
+	case "alarm":
+		if p.Device == nil {
+			return fmt.Errorf("Device commands are not enabled")
+		}
+		if arg == "off" || arg == "" {
+			return p.Device.ModifyConfiguration(device.CONF_WAKE_ALARM, 0)
+		}
+		var alarm device.Alarm
+		if err := alarm.UnmarshalText([]byte(arg)); err != nil {
+			return err
+		}
+		return p.Device.SetAlarm(alarm, device.CONF_WAKE_ALARM)
+	}
+	return fmt.Errorf("Unknown command '%s'", name)
+}
@@ -0,0 +1,191 @@
+// Package nis implements the Network Information Server protocol of
+// apcupsd, so that apcaccess and other tools polling apcupsd can read the
+// PiVoyager status.
+//
+// Each request and each line of the response is a record made of its
+// length, as a big-endian 16-bit integer, followed by the text. A response
+// ends with an empty record.
+package nis
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/monitor"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ADDRESS = "127.0.0.1:3551"
+	DEFAULT_EVENTS  = 50
+	MAX_REQUEST     = 512
+	IDLE_TIMEOUT    = 30 * time.Second
+)
+
+// Source provides the latest sample of the PiVoyager, such as a
+// monitor.Monitor.
+type Source interface {
+	Latest() (monitor.Sample, bool)
+}
+
+type Server struct {
+	// Name of the UPS, reported as UPSNAME.
+	Name string
+	// Version is the version of pivoyager.
+	Version string
+	Source  Source
+	// ShuttingDown, if not nil, reports whether the system is shutting
+	// down.
+	ShuttingDown func() bool
+	// TimeLeft, if not nil, estimates the runtime left on battery.
+	TimeLeft func(s monitor.Sample) (time.Duration, bool)
+	// Static records added to the status, such as FIRMWARE.
+	Static map[string]string
+	// LowBatteryVoltage is the threshold of the monitor, reporting LOWBATT
+	// in the status.
+	LowBatteryVoltage float32
+	// MaxAge, if not zero, is the age after which a sample is stale.
+	MaxAge time.Duration
+	// MaxEvents is the number of events kept in the event log.
+	MaxEvents int
+	Logger    *log.Logger
+
+	mu        sync.Mutex
+	start     time.Time
+	events    []string
+	transfers transfers
+	conns     map[net.Conn]struct{}
+}
+
+func NewServer(name string, source Source) *Server {
+	return &Server{Name: name, Source: source, MaxEvents: DEFAULT_EVENTS, start: time.Now()}
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.Logger != nil {
+		srv.Logger.Printf(format, args...)
+	}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients until
+// ctx is cancelled.
+func (srv *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ctx, ln)
+}
+
+// Serve serves clients connecting to ln until ctx is cancelled. It closes
+// ln and all connections before returning.
+func (srv *Server) Serve(ctx context.Context, ln net.Listener) error {
+	var wg sync.WaitGroup
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		srv.mu.Lock()
+		for c := range srv.conns {
+			c.Close()
+		}
+		srv.mu.Unlock()
+	}()
+
+	srv.logf("NIS server listening on %s", ln.Addr())
+	srv.addEvent(time.Now(), "pivoyager NIS server startup succeeded")
+	defer wg.Wait()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		srv.mu.Lock()
+		if srv.conns == nil {
+			srv.conns = make(map[net.Conn]struct{})
+		}
+		srv.conns[c] = struct{}{}
+		srv.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv.serve(c)
+			srv.mu.Lock()
+			delete(srv.conns, c)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+func (srv *Server) serve(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		c.SetDeadline(time.Now().Add(IDLE_TIMEOUT))
+		req, err := readRecord(r)
+		if err != nil {
+			// Connections are closed when the server stops.
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				srv.logf("NIS client %s: %s", c.RemoteAddr(), err)
+			}
+			return
+		}
+
+		var lines []string
+		switch req {
+		case "status":
+			lines = srv.Status()
+		case "events":
+			lines = srv.Events()
+		default:
+			lines = []string{fmt.Sprintf("Invalid command %q\n", req)}
+		}
+		for _, line := range lines {
+			writeRecord(w, line)
+		}
+		writeRecord(w, "")
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func readRecord(r io.Reader) (string, error) {
+	var length uint16
+
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if length > MAX_REQUEST {
+		return "", fmt.Errorf("Request too long (%d bytes)", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func writeRecord(w io.Writer, s string) error {
+	if err := binary.Write(w, binary.BigEndian, uint16(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
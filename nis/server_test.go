@@ -0,0 +1,127 @@
+package nis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSource struct {
+	sample monitor.Sample
+}
+
+func (src *testSource) Latest() (monitor.Sample, bool) {
+	return src.sample, !src.sample.Time.IsZero()
+}
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+
+	for _, s := range []string{"status", "", "BATTV    : 4.02 Volts\n"} {
+		if err := writeRecord(&buf, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte{0, 6, 's'}) {
+		t.Errorf("writeRecord() wrote %q, expected a big-endian length first", buf.Bytes())
+	}
+	for _, expected := range []string{"status", "", "BATTV    : 4.02 Volts\n"} {
+		s, err := readRecord(&buf)
+		if err != nil || s != expected {
+			t.Errorf("readRecord() = %q, %v, expected %q", s, err, expected)
+		}
+	}
+
+	if _, err := readRecord(bytes.NewReader([]byte{0x02, 0x01, 'x'})); err == nil {
+		t.Errorf("readRecord() accepted a request longer than %d bytes", MAX_REQUEST)
+	}
+	if _, err := readRecord(bytes.NewReader([]byte{0, 6, 's', 't'})); err == nil {
+		t.Errorf("readRecord() accepted a truncated record")
+	}
+}
+
+// request sends req on c and returns the records of the
+// response, up to the empty record ending it.
+func request(t *testing.T, c net.Conn, r *bufio.Reader, req string) []string {
+	t.Helper()
+	var lines []string
+
+	if err := writeRecord(c, req); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		line, err := readRecord(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestServe(t *testing.T) {
+	src := &testSource{}
+	src.sample.Time = time.Now()
+	src.sample.Status = device.DeviceStatus(device.STAT_STAT1 | device.STAT_STAT2).Decode()
+	src.sample.VBat = 3.5
+	srv := NewServer("test", src)
+	srv.LowBatteryVoltage = 3.6
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- srv.Serve(ctx, ln)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	status := strings.Join(request(t, c, r, "status"), "")
+	for _, line := range []string{"UPSNAME  : test\n", "STATUS   : ONBATT LOWBATT\n", "BATTV    : 3.50 Volts\n", "STATFLAG : 0x00000050\n"} {
+		if !strings.Contains(status, line) {
+			t.Errorf("status does not contain %q:\n%s", line, status)
+		}
+	}
+	if !strings.HasPrefix(status, "APC      : ") || !strings.Contains(status, "END APC  : ") {
+		t.Errorf("status is not framed by APC and END APC:\n%s", status)
+	}
+
+	// The voltage alone is not low on USB power.
+	src.sample.Status = device.DeviceStatus(device.STAT_PG | device.STAT_5V | device.STAT_STAT1).Decode()
+	status = strings.Join(request(t, c, r, "status"), "")
+	if !strings.Contains(status, "STATUS   : ONLINE\n") {
+		t.Errorf("status reports a low battery on USB power:\n%s", status)
+	}
+
+	srv.HandleEvent(monitor.Event{Type: monitor.EVENT_ON_BATTERY, Sample: src.sample})
+	events := request(t, c, r, "events")
+	if len(events) != 2 || !strings.HasSuffix(events[0], "startup succeeded\n") || !strings.HasSuffix(events[1], "Running on UPS batteries.\n") {
+		t.Errorf("events = %q", events)
+	}
+
+	if lines := request(t, c, r, "bogus"); len(lines) != 1 || !strings.HasPrefix(lines[0], "Invalid command") {
+		t.Errorf("response to an invalid command = %q", lines)
+	}
+}
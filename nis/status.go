@@ -0,0 +1,191 @@
+package nis
+
+import (
+	"fmt"
+	"github.com/omzlo/pivoyager/monitor"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DATE_FORMAT = "2006-01-02 15:04:05 -0700"
+)
+
+// STATFLAG bits, as defined by apcupsd.
+const (
+	STATFLAG_ONLINE   = 0x08
+	STATFLAG_ONBATT   = 0x10
+	STATFLAG_BATTLOW  = 0x40
+	STATFLAG_COMMLOST = 0x400
+	STATFLAG_SHUTDOWN = 0x800
+)
+
+// transfers keeps track of the transfers to and from the battery.
+type transfers struct {
+	count     int
+	lastOn    time.Time
+	lastOff   time.Time
+	cumulated time.Duration
+	onBattery bool
+}
+
+// record formats a status line the way apcupsd does, e.g.
+// "BATTV    : 4.02 Volts\n".
+func record(key string, value string) string {
+	return fmt.Sprintf("%-9s: %s\n", key, value)
+}
+
+// Status returns the lines of the status report.
+func (srv *Server) Status() []string {
+	var lines []string
+	var flags int
+	var status []string
+
+	now := time.Now()
+	add := func(key string, format string, args ...interface{}) {
+		lines = append(lines, record(key, fmt.Sprintf(format, args...)))
+	}
+
+	s, ok := srv.Source.Latest()
+	stale := !ok || (srv.MaxAge > 0 && now.Sub(s.Time) > srv.MaxAge)
+	shuttingDown := srv.ShuttingDown != nil && srv.ShuttingDown()
+
+	if ok && s.OnBattery() {
+		status = append(status, "ONBATT")
+		flags |= STATFLAG_ONBATT
+	} else if ok {
+		status = append(status, "ONLINE")
+		flags |= STATFLAG_ONLINE
+	}
+	if ok && s.LowBattery(srv.LowBatteryVoltage) {
+		status = append(status, "LOWBATT")
+		flags |= STATFLAG_BATTLOW
+	}
+	if stale {
+		status = append(status, "COMMLOST")
+		flags |= STATFLAG_COMMLOST
+	}
+	if shuttingDown {
+		status = append(status, "SHUTTING DOWN")
+		flags |= STATFLAG_SHUTDOWN
+	}
+
+	hostname, _ := os.Hostname()
+
+	srv.mu.Lock()
+	xfers := srv.transfers
+	start := srv.start
+	srv.mu.Unlock()
+
+	add("APC", "001,036,0000")
+	add("DATE", "%s", now.Format(DATE_FORMAT))
+	add("HOSTNAME", "%s", hostname)
+	add("VERSION", "pivoyager %s", srv.Version)
+	add("UPSNAME", "%s", srv.Name)
+	add("CABLE", "I2C")
+	add("DRIVER", "pivoyager")
+	add("UPSMODE", "Stand Alone")
+	add("STARTTIME", "%s", start.Format(DATE_FORMAT))
+	add("MODEL", "PiVoyager")
+	add("STATUS", "%s", strings.Join(status, " "))
+	if ok {
+		if s.Status.USB5V {
+			add("LINEV", "5.0 Volts")
+		} else {
+			add("LINEV", "0.0 Volts")
+		}
+		add("BCHARGE", "%.1f Percent", s.Charge.Percent)
+		if srv.TimeLeft != nil {
+			if left, ok := srv.TimeLeft(s); ok {
+				add("TIMELEFT", "%.1f Minutes", left.Minutes())
+			}
+		}
+		add("BATTV", "%.2f Volts", s.VBat)
+	}
+	add("NOMBATTV", "3.70 Volts")
+	add("NOMINV", "5 Volts")
+	if xfers.count > 0 {
+		add("LASTXFER", "USB power lost")
+	} else {
+		add("LASTXFER", "No transfers since turnon")
+	}
+	add("NUMXFERS", "%d", xfers.count)
+	if !xfers.lastOn.IsZero() {
+		add("XONBATT", "%s", xfers.lastOn.Format(DATE_FORMAT))
+	}
+	tonbatt := time.Duration(0)
+	cumonbatt := xfers.cumulated
+	if xfers.onBattery {
+		tonbatt = now.Sub(xfers.lastOn)
+		cumonbatt += tonbatt
+	}
+	add("TONBATT", "%d Seconds", int(tonbatt.Seconds()))
+	add("CUMONBATT", "%d Seconds", int(cumonbatt.Seconds()))
+	if !xfers.lastOff.IsZero() {
+		add("XOFFBATT", "%s", xfers.lastOff.Format(DATE_FORMAT))
+	}
+	add("STATFLAG", "0x%08X", flags)
+	keys := make([]string, 0, len(srv.Static))
+	for key := range srv.Static {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		add(key, "%s", srv.Static[key])
+	}
+	add("END APC", "%s", time.Now().Format(DATE_FORMAT))
+	return lines
+}
+
+var eventMessages = map[string]string{
+	monitor.EVENT_ON_BATTERY:      "Power failure. Running on UPS batteries.",
+	monitor.EVENT_ON_MAINS:        "Mains returned. No longer on UPS batteries.",
+	monitor.EVENT_LOW_BATTERY:     "Battery power exhausted.",
+	monitor.EVENT_CHARGE_COMPLETE: "Battery charge complete.",
+	monitor.EVENT_BATTERY_FAULT:   "Battery fault.",
+	monitor.EVENT_BATTERY_HEALTH:  "UPS battery must be replaced.",
+	monitor.EVENT_BUTTON_PRESSED:  "Button pressed.",
+	monitor.EVENT_ALARM_FIRED:     "Alarm fired.",
+	monitor.EVENT_DEVICE_ERROR:    "Communications with UPS lost.",
+}
+
+// HandleEvent records e in the event log and keeps track of the transfers
+// to battery.
+func (srv *Server) HandleEvent(e monitor.Event) {
+	srv.mu.Lock()
+	switch e.Type {
+	case monitor.EVENT_ON_BATTERY:
+		srv.transfers.count++
+		srv.transfers.lastOn = e.Sample.Time
+		srv.transfers.onBattery = true
+	case monitor.EVENT_ON_MAINS:
+		if srv.transfers.onBattery {
+			srv.transfers.cumulated += e.Sample.Time.Sub(srv.transfers.lastOn)
+		}
+		srv.transfers.lastOff = e.Sample.Time
+		srv.transfers.onBattery = false
+	}
+	srv.mu.Unlock()
+
+	if msg, ok := eventMessages[e.Type]; ok {
+		srv.addEvent(e.Sample.Time, msg)
+	}
+}
+
+func (srv *Server) addEvent(tm time.Time, msg string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.events = append(srv.events, fmt.Sprintf("%s  %s\n", tm.Format(DATE_FORMAT), msg))
+	if srv.MaxEvents > 0 && len(srv.events) > srv.MaxEvents {
+		srv.events = srv.events[len(srv.events)-srv.MaxEvents:]
+	}
+}
+
+// Events returns the lines of the event log, oldest first.
+func (srv *Server) Events() []string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return append([]string(nil), srv.events...)
+}
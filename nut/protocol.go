@@ -0,0 +1,77 @@
+package nut
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors of the NUT network protocol, sent as "ERR <error>".
+const (
+	ERR_ACCESS_DENIED          = "ACCESS-DENIED"
+	ERR_UNKNOWN_UPS            = "UNKNOWN-UPS"
+	ERR_VAR_NOT_SUPPORTED      = "VAR-NOT-SUPPORTED"
+	ERR_CMD_NOT_SUPPORTED      = "CMD-NOT-SUPPORTED"
+	ERR_INVALID_ARGUMENT       = "INVALID-ARGUMENT"
+	ERR_INSTCMD_FAILED         = "INSTCMD-FAILED"
+	ERR_SET_FAILED             = "SET-FAILED"
+	ERR_READONLY               = "READONLY"
+	ERR_UNKNOWN_COMMAND        = "UNKNOWN-COMMAND"
+	ERR_USERNAME_REQUIRED      = "USERNAME-REQUIRED"
+	ERR_PASSWORD_REQUIRED      = "PASSWORD-REQUIRED"
+	ERR_ALREADY_LOGGED_IN      = "ALREADY-LOGGED-IN"
+	ERR_ALREADY_SET_USERNAME   = "ALREADY-SET-USERNAME"
+	ERR_ALREADY_SET_PASSWORD   = "ALREADY-SET-PASSWORD"
+	ERR_DATA_STALE             = "DATA-STALE"
+	ERR_FEATURE_NOT_CONFIGURED = "FEATURE-NOT-CONFIGURED"
+)
+
+var unterminatedQuote = errors.New("Unterminated quoted string")
+
+// tokenize splits a request line into words. Words containing spaces are
+// enclosed in double quotes, in which a backslash escapes the next
+// character.
+func tokenize(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	var inWord, quoted, escaped bool
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			if quoted {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			quoted = !quoted
+		case (c == ' ' || c == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, unterminatedQuote
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// quote encloses s in double quotes, escaping quotes and backslashes.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
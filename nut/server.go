@@ -0,0 +1,575 @@
+// Package nut implements the network protocol of Network UPS Tools (upsd),
+// so that NUT clients such as upsmon, upsc or the Home Assistant NUT
+// integration can monitor the PiVoyager like any other UPS.
+package nut
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/monitor"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_ADDRESS  = "127.0.0.1:3493"
+	DEFAULT_NAME     = "pivoyager"
+	PROTOCOL_VERSION = "1.3"
+)
+
+// Source provides the latest sample of the PiVoyager, such as a
+// monitor.Monitor.
+type Source interface {
+	Latest() (monitor.Sample, bool)
+}
+
+// Shutdowner shuts the system down on behalf of instant commands.
+type Shutdowner interface {
+	Shutdown(reason string, stayOff bool) error
+	ShuttingDown() bool
+}
+
+// User is an account allowed to log in, like an entry of upsd.users.
+type User struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// Primary allows PRIMARY (or MASTER) and FSD.
+	Primary bool `json:"primary"`
+	// InstCmds allows instant commands.
+	InstCmds bool `json:"instcmds"`
+}
+
+type Server struct {
+	// Name of the UPS, as in "LIST UPS".
+	Name        string
+	Description string
+	// Version is the version of pivoyager, reported as driver.version.
+	Version string
+	Source  Source
+	// Shutdown, if not nil, runs the instant commands.
+	Shutdown Shutdowner
+	Users    []User
+	// Static variables added to those derived from the samples, such as
+	// ups.firmware.
+	Static map[string]string
+	// LowBatteryVoltage is the threshold of the monitor, reporting LB in
+	// ups.status.
+	LowBatteryVoltage float32
+	// MaxAge, if not zero, is the age after which a sample is stale.
+	MaxAge time.Duration
+	Logger *log.Logger
+
+	mu    sync.Mutex
+	fsd   bool
+	conns map[*conn]struct{}
+}
+
+func NewServer(name string, source Source) *Server {
+	if name == "" {
+		name = DEFAULT_NAME
+	}
+	return &Server{Name: name, Description: "PiVoyager UPS", Source: source}
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.Logger != nil {
+		srv.Logger.Printf(format, args...)
+	}
+}
+
+// ForcedShutdown reports whether a primary requested a forced shutdown
+// (FSD), or the system itself is shutting down.
+func (srv *Server) ForcedShutdown() bool {
+	srv.mu.Lock()
+	fsd := srv.fsd
+	srv.mu.Unlock()
+	return fsd || (srv.Shutdown != nil && srv.Shutdown.ShuttingDown())
+}
+
+func (srv *Server) user(name, password string) *User {
+	for i := range srv.Users {
+		if srv.Users[i].Name == name && srv.Users[i].Password == password {
+			return &srv.Users[i]
+		}
+	}
+	return nil
+}
+
+func (srv *Server) commands() []string {
+	if srv.Shutdown == nil {
+		return nil
+	}
+	return []string{CMD_SHUTDOWN_RETURN, CMD_SHUTDOWN_STAYOFF}
+}
+
+func (srv *Server) sample() (monitor.Sample, bool) {
+	s, ok := srv.Source.Latest()
+	if !ok || (srv.MaxAge > 0 && time.Since(s.Time) > srv.MaxAge) {
+		return s, false
+	}
+	return s, true
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients until
+// ctx is cancelled.
+func (srv *Server) ListenAndServe(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return srv.Serve(ctx, ln)
+}
+
+// Serve serves clients connecting to ln until ctx is cancelled. It closes
+// ln and all connections before returning.
+func (srv *Server) Serve(ctx context.Context, ln net.Listener) error {
+	var wg sync.WaitGroup
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		srv.mu.Lock()
+		for c := range srv.conns {
+			c.Close()
+		}
+		srv.mu.Unlock()
+	}()
+
+	srv.logf("NUT server listening on %s", ln.Addr())
+	defer wg.Wait()
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		c := &conn{Conn: nc, srv: srv, w: bufio.NewWriter(nc)}
+		srv.mu.Lock()
+		if srv.conns == nil {
+			srv.conns = make(map[*conn]struct{})
+		}
+		srv.conns[c] = struct{}{}
+		srv.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.serve()
+			srv.mu.Lock()
+			delete(srv.conns, c)
+			srv.mu.Unlock()
+		}()
+	}
+}
+
+func (srv *Server) numLogins() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	n := 0
+	for c := range srv.conns {
+		if c.loggedIn {
+			n++
+		}
+	}
+	return n
+}
+
+func (srv *Server) clients() []string {
+	var clients []string
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		if c.loggedIn {
+			clients = append(clients, c.host())
+		}
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+type conn struct {
+	net.Conn
+	srv      *Server
+	w        *bufio.Writer
+	username string
+	password string
+	// loggedIn is protected by srv.mu, as it is read by other connections.
+	loggedIn bool
+	quit     bool
+}
+
+func (c *conn) host() string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+func (c *conn) serve() {
+	defer c.Close()
+
+	scanner := bufio.NewScanner(c)
+	for !c.quit && scanner.Scan() {
+		words, err := tokenize(scanner.Text())
+		if err != nil {
+			c.error(ERR_INVALID_ARGUMENT)
+		} else if len(words) > 0 {
+			c.handle(strings.ToUpper(words[0]), words[1:])
+		}
+		if c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) reply(format string, args ...interface{}) {
+	fmt.Fprintf(c.w, format+"\n", args...)
+}
+
+func (c *conn) error(e string) {
+	c.reply("ERR %s", e)
+}
+
+func (c *conn) user() *User {
+	if c.username == "" || c.password == "" {
+		return nil
+	}
+	return c.srv.user(c.username, c.password)
+}
+
+// checkUPS replies with an error and returns false if name is not the UPS
+// served.
+func (c *conn) checkUPS(name string) bool {
+	if name != c.srv.Name {
+		c.error(ERR_UNKNOWN_UPS)
+		return false
+	}
+	return true
+}
+
+func (c *conn) handle(cmd string, args []string) {
+	switch cmd {
+	case "VER":
+		c.reply("pivoyager upsd %s", c.srv.Version)
+	case "NETVER":
+		c.reply("%s", PROTOCOL_VERSION)
+	case "HELP":
+		c.reply("Commands: HELP VER NETVER GET LIST SET INSTCMD LOGIN LOGOUT USERNAME PASSWORD STARTTLS PRIMARY FSD")
+	case "STARTTLS":
+		c.error(ERR_FEATURE_NOT_CONFIGURED)
+	case "USERNAME":
+		c.setCredential(&c.username, args, ERR_ALREADY_SET_USERNAME)
+	case "PASSWORD":
+		c.setCredential(&c.password, args, ERR_ALREADY_SET_PASSWORD)
+	case "LOGIN":
+		c.login(args)
+	case "LOGOUT":
+		c.reply("OK Goodbye")
+		c.quit = true
+	case "PRIMARY", "MASTER":
+		c.grantPrimary(cmd, args)
+	case "FSD":
+		c.forceShutdown(args)
+	case "INSTCMD":
+		c.instcmd(args)
+	case "SET":
+		c.set(args)
+	case "GET":
+		c.get(args)
+	case "LIST":
+		c.list(args)
+	default:
+		c.error(ERR_UNKNOWN_COMMAND)
+	}
+}
+
+func (c *conn) setCredential(field *string, args []string, already string) {
+	if len(args) != 1 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	if *field != "" {
+		c.error(already)
+		return
+	}
+	*field = args[0]
+	c.reply("OK")
+}
+
+func (c *conn) login(args []string) {
+	if len(args) != 1 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	if !c.checkUPS(args[0]) {
+		return
+	}
+	switch {
+	case c.username == "":
+		c.error(ERR_USERNAME_REQUIRED)
+		return
+	case c.password == "":
+		c.error(ERR_PASSWORD_REQUIRED)
+		return
+	case c.user() == nil:
+		c.error(ERR_ACCESS_DENIED)
+		return
+	}
+	c.srv.mu.Lock()
+	already := c.loggedIn
+	c.loggedIn = true
+	c.srv.mu.Unlock()
+	if already {
+		c.error(ERR_ALREADY_LOGGED_IN)
+		return
+	}
+	c.srv.logf("NUT client %s logged in as %s", c.host(), c.username)
+	c.reply("OK")
+}
+
+func (c *conn) grantPrimary(cmd string, args []string) {
+	if len(args) != 1 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	if !c.checkUPS(args[0]) {
+		return
+	}
+	if u := c.user(); u == nil || !u.Primary {
+		c.error(ERR_ACCESS_DENIED)
+		return
+	}
+	c.reply("OK %s-GRANTED", cmd)
+}
+
+func (c *conn) forceShutdown(args []string) {
+	if len(args) != 1 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	if !c.checkUPS(args[0]) {
+		return
+	}
+	if u := c.user(); u == nil || !u.Primary {
+		c.error(ERR_ACCESS_DENIED)
+		return
+	}
+	c.srv.mu.Lock()
+	c.srv.fsd = true
+	c.srv.mu.Unlock()
+	c.srv.logf("NUT client %s (%s) set the forced shutdown flag", c.host(), c.username)
+	c.reply("OK FSD-SET")
+}
+
+func (c *conn) instcmd(args []string) {
+	if len(args) < 2 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	if !c.checkUPS(args[0]) {
+		return
+	}
+	if u := c.user(); u == nil || !u.InstCmds {
+		c.error(ERR_ACCESS_DENIED)
+		return
+	}
+
+	var stayOff bool
+	switch args[1] {
+	case CMD_SHUTDOWN_RETURN:
+		stayOff = false
+	case CMD_SHUTDOWN_STAYOFF:
+		stayOff = true
+	default:
+		c.error(ERR_CMD_NOT_SUPPORTED)
+		return
+	}
+	if c.srv.Shutdown == nil {
+		c.error(ERR_CMD_NOT_SUPPORTED)
+		return
+	}
+	if c.srv.Shutdown.ShuttingDown() {
+		c.error(ERR_INSTCMD_FAILED)
+		return
+	}
+
+	reason := fmt.Sprintf("NUT instant command %s from %s (%s)", args[1], c.host(), c.username)
+	c.srv.logf("%s", reason)
+	// Shutting down takes a while, running the hooks: reply right away.
+	go func() {
+		if err := c.srv.Shutdown.Shutdown(reason, stayOff); err != nil {
+			c.srv.logf("NUT instant command %s failed: %s", args[1], err)
+		}
+	}()
+	c.reply("OK")
+}
+
+func (c *conn) set(args []string) {
+	if len(args) < 4 || strings.ToUpper(args[0]) != "VAR" {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	if !c.checkUPS(args[1]) {
+		return
+	}
+	if _, ok := variableDescriptions[args[2]]; !ok {
+		c.error(ERR_VAR_NOT_SUPPORTED)
+		return
+	}
+	c.error(ERR_READONLY)
+}
+
+func (c *conn) variables() (map[string]string, bool) {
+	s, ok := c.srv.sample()
+	if !ok {
+		c.error(ERR_DATA_STALE)
+		return nil, false
+	}
+	return c.srv.Variables(s), true
+}
+
+func isNumber(name string) bool {
+	switch name {
+	case "battery.charge", "battery.runtime", "battery.voltage":
+		return true
+	}
+	return false
+}
+
+func (c *conn) get(args []string) {
+	if len(args) < 2 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	what := strings.ToUpper(args[0])
+	ups := args[1]
+	if !c.checkUPS(ups) {
+		return
+	}
+
+	switch {
+	case what == "UPSDESC" && len(args) == 2:
+		c.reply("UPSDESC %s %s", ups, quote(c.srv.Description))
+	case what == "NUMLOGINS" && len(args) == 2:
+		c.reply("NUMLOGINS %s %d", ups, c.srv.numLogins())
+	case what == "VAR" && len(args) == 3:
+		vars, ok := c.variables()
+		if !ok {
+			return
+		}
+		v, ok := vars[args[2]]
+		if !ok {
+			c.error(ERR_VAR_NOT_SUPPORTED)
+			return
+		}
+		c.reply("VAR %s %s %s", ups, args[2], quote(v))
+	case what == "TYPE" && len(args) == 3:
+		vars, ok := c.variables()
+		if !ok {
+			return
+		}
+		v, ok := vars[args[2]]
+		switch {
+		case !ok:
+			c.error(ERR_VAR_NOT_SUPPORTED)
+		case isNumber(args[2]):
+			c.reply("TYPE %s %s NUMBER", ups, args[2])
+		default:
+			c.reply("TYPE %s %s STRING:%d", ups, args[2], len(v))
+		}
+	case what == "DESC" && len(args) == 3:
+		desc, ok := variableDescriptions[args[2]]
+		if !ok {
+			desc = "Description unavailable"
+		}
+		c.reply("DESC %s %s %s", ups, args[2], quote(desc))
+	case what == "CMDDESC" && len(args) == 3:
+		desc, ok := commandDescriptions[args[2]]
+		if !ok {
+			desc = "Description unavailable"
+		}
+		c.reply("CMDDESC %s %s %s", ups, args[2], quote(desc))
+	default:
+		c.error(ERR_INVALID_ARGUMENT)
+	}
+}
+
+func (c *conn) list(args []string) {
+	if len(args) == 0 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	what := strings.ToUpper(args[0])
+
+	if what == "UPS" && len(args) == 1 {
+		c.reply("BEGIN LIST UPS")
+		c.reply("UPS %s %s", c.srv.Name, quote(c.srv.Description))
+		c.reply("END LIST UPS")
+		return
+	}
+	if len(args) < 2 {
+		c.error(ERR_INVALID_ARGUMENT)
+		return
+	}
+	ups := args[1]
+	if !c.checkUPS(ups) {
+		return
+	}
+
+	switch {
+	case what == "VAR" && len(args) == 2:
+		vars, ok := c.variables()
+		if !ok {
+			return
+		}
+		names := make([]string, 0, len(vars))
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		c.reply("BEGIN LIST VAR %s", ups)
+		for _, name := range names {
+			c.reply("VAR %s %s %s", ups, name, quote(vars[name]))
+		}
+		c.reply("END LIST VAR %s", ups)
+	case what == "CMD" && len(args) == 2:
+		c.reply("BEGIN LIST CMD %s", ups)
+		for _, cmd := range c.srv.commands() {
+			c.reply("CMD %s %s", ups, cmd)
+		}
+		c.reply("END LIST CMD %s", ups)
+	case what == "CLIENT" && len(args) == 2:
+		c.reply("BEGIN LIST CLIENT %s", ups)
+		for _, host := range c.srv.clients() {
+			c.reply("CLIENT %s %s", ups, host)
+		}
+		c.reply("END LIST CLIENT %s", ups)
+	case what == "RW" && len(args) == 2:
+		// All variables are read-only.
+		c.reply("BEGIN LIST RW %s", ups)
+		c.reply("END LIST RW %s", ups)
+	case (what == "ENUM" || what == "RANGE") && len(args) == 3:
+		if _, ok := variableDescriptions[args[2]]; !ok {
+			c.error(ERR_VAR_NOT_SUPPORTED)
+			return
+		}
+		c.reply("BEGIN LIST %s %s %s", what, ups, args[2])
+		c.reply("END LIST %s %s %s", what, ups, args[2])
+	default:
+		c.error(ERR_INVALID_ARGUMENT)
+	}
+}
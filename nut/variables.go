@@ -0,0 +1,94 @@
+package nut
+
+import (
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"strings"
+)
+
+// Instant commands
+const (
+	CMD_SHUTDOWN_RETURN  = "shutdown.return"
+	CMD_SHUTDOWN_STAYOFF = "shutdown.stayoff"
+)
+
+var commandDescriptions = map[string]string{
+	CMD_SHUTDOWN_RETURN:  "Shut down the system and restart it when power returns",
+	CMD_SHUTDOWN_STAYOFF: "Shut down the system and keep it off",
+}
+
+var variableDescriptions = map[string]string{
+	"ups.status":             "UPS status",
+	"ups.mfr":                "UPS manufacturer",
+	"ups.model":              "UPS model",
+	"ups.firmware":           "UPS firmware",
+	"battery.charge":         "Battery charge (percent)",
+	"battery.voltage":        "Battery voltage (V)",
+	"battery.charger.status": "Status of the battery charger",
+	"battery.runtime":        "Battery runtime (seconds)",
+	"device.mfr":             "Device manufacturer",
+	"device.model":           "Device model",
+	"device.type":            "Device type",
+	"driver.name":            "Driver name",
+	"driver.version":         "Driver version",
+}
+
+// Status returns ups.status for s, e.g. "OB DISCHRG LB". The battery is low
+// as for the events of the monitor, with lowBattery as LowBatteryVoltage.
+func Status(s monitor.Sample, fsd bool, lowBattery float32) string {
+	var flags []string
+
+	if fsd {
+		flags = append(flags, "FSD")
+	}
+	if s.OnBattery() {
+		flags = append(flags, "OB", "DISCHRG")
+	} else {
+		flags = append(flags, "OL")
+	}
+	if s.Charging() {
+		flags = append(flags, "CHRG")
+	}
+	if s.LowBattery(lowBattery) {
+		flags = append(flags, "LB")
+	}
+	return strings.Join(flags, " ")
+}
+
+func chargerStatus(s monitor.Sample) string {
+	switch {
+	case s.Charging():
+		return "charging"
+	case s.OnBattery():
+		return "discharging"
+	case s.Status.Charger == device.CHARGER_CHARGE_COMPLETE:
+		return "floating"
+	}
+	return "resting"
+}
+
+// Variables returns the NUT variables describing s, on top of the static
+// variables of the server.
+func (srv *Server) Variables(s monitor.Sample) map[string]string {
+	vars := map[string]string{
+		"device.mfr":     "Omzlo",
+		"device.model":   "PiVoyager",
+		"device.type":    "ups",
+		"ups.mfr":        "Omzlo",
+		"ups.model":      "PiVoyager",
+		"driver.name":    "pivoyager",
+		"driver.version": srv.Version,
+	}
+	for k, v := range srv.Static {
+		vars[k] = v
+	}
+	vars["ups.status"] = Status(s, srv.ForcedShutdown(), srv.LowBatteryVoltage)
+	vars["battery.voltage"] = fmt.Sprintf("%.2f", s.VBat)
+	vars["battery.charge"] = fmt.Sprintf("%.0f", s.Charge.Percent)
+	vars["battery.charger.status"] = chargerStatus(s)
+	if s.Runtime.TimeToEmpty > 0 {
+		vars["battery.runtime"] = fmt.Sprintf("%.0f", s.Runtime.TimeToEmpty.Seconds())
+	}
+	return vars
+}
@@ -0,0 +1,51 @@
+package nut
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/monitor"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	sample := func(status device.DeviceStatus, vbat float32) monitor.Sample {
+		return monitor.Sample{Status: status.Decode(), VBat: vbat}
+	}
+
+	tests := []struct {
+		s          monitor.Sample
+		fsd        bool
+		lowBattery float32
+		expected   string
+	}{
+		{sample(device.STAT_5V|device.DeviceStatus(device.CHARGER_CHARGING), 3.9), false, 0, "OL CHRG"},
+		{sample(device.STAT_5V|device.DeviceStatus(device.CHARGER_CHARGE_COMPLETE), 4.2), false, 0, "OL"},
+		{sample(device.DeviceStatus(device.CHARGER_DISCHARGING), 3.7), false, 0, "OB DISCHRG"},
+		{sample(device.DeviceStatus(device.CHARGER_DISCHARGING), 3.5), false, 3.6, "OB DISCHRG LB"},
+		{sample(device.DeviceStatus(device.CHARGER_LOW_BATTERY), 3.3), true, 0, "FSD OB DISCHRG LB"},
+	}
+	for _, test := range tests {
+		if status := Status(test.s, test.fsd, test.lowBattery); status != test.expected {
+			t.Errorf("Status(%s, %v, %g) = %q, expected %q", test.s.Status, test.fsd, test.lowBattery, status, test.expected)
+		}
+	}
+}
+
+func TestVariables(t *testing.T) {
+	srv := NewServer("", nil)
+	srv.Version = "1.0"
+	srv.LowBatteryVoltage = 3.6
+	s := monitor.Sample{Status: device.DeviceStatus(device.CHARGER_DISCHARGING).Decode(), VBat: 3.55}
+
+	vars := srv.Variables(s)
+	if vars["ups.status"] != "OB DISCHRG LB" || vars["battery.voltage"] != "3.55" || vars["driver.version"] != "1.0" {
+		t.Errorf("Variables() = %v", vars)
+	}
+	if _, ok := vars["input.voltage"]; ok {
+		t.Errorf("Variables() reports input.voltage, which the PiVoyager does not measure")
+	}
+	for name := range vars {
+		if _, ok := variableDescriptions[name]; !ok {
+			t.Errorf("%s has no description", name)
+		}
+	}
+}
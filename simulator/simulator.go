@@ -0,0 +1,672 @@
+// Package simulator provides an in-memory PiVoyager that implements
+// device.Bus, so that device.Device and the pivoyager commands can be
+// exercised without any hardware.
+//
+// The simulator models the register map of the normal firmware (see
+// device/device.go) and of the bootloader (see device/flash.go). Time is
+// driven by the Now function, which defaults to time.Now, and can be moved
+// forward with Advance: the RTC, the alarm, the watchdog, the wakeup timer
+// and the low battery timer are all updated one simulated second at a time.
+package simulator
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/gpio"
+	"github.com/omzlo/pivoyager/i2c"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	REGISTER_COUNT    = 40
+	BL_REGISTER_COUNT = device.REG_BL_DATA + 64
+
+	FLASH_SIZE      = 24 * 1024
+	FLASH_PAGE_SIZE = 1024
+
+	FIRMWARE_VERSION   = 0x0105
+	BOOTLOADER_VERSION = 0x01
+
+	LOW_BATTERY_VOLTAGE     = 3.4
+	CHARGE_COMPLETE_VOLTAGE = 4.15
+)
+
+type PiVoyager struct {
+	mu sync.Mutex
+
+	// Now is the source of time of the simulator.
+	Now func() time.Time
+
+	address    byte
+	offset     time.Duration
+	last       time.Time
+	bootloader bool
+
+	regs   [REGISTER_COUNT]byte
+	blRegs [BL_REGISTER_COUNT]byte
+	flash  [FLASH_SIZE]byte
+	mcuid  uint32
+
+	rtc        time.Time
+	alarmArmed bool
+
+	battery  device.ChargerState
+	usb      bool
+	vbat     float64
+	vdd      float64
+	vrefCal  uint16
+	noise    int
+	stat     byte
+	powered  bool
+	counters struct {
+		watchdog int
+		wakeup   int
+		lbo      int
+	}
+	powerCycles int
+
+	faults   int
+	faultErr syscall.Errno
+}
+
+// New creates a simulated PiVoyager in normal mode, powered from USB,
+// answering on device.DEVICE_ADDRESS.
+func New() *PiVoyager {
+	s := &PiVoyager{
+		Now:     time.Now,
+		address: device.DEVICE_ADDRESS,
+		rtc:     time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+		usb:     true,
+		vbat:    4.0,
+		vdd:     3.3,
+		vrefCal: 1489,
+		powered: true,
+		mcuid:   0x20364b50,
+	}
+	s.last = s.Now()
+	for i := range s.flash {
+		s.flash[i] = 0xFF
+	}
+	s.setUint16(device.REG_FW_VERSION, FIRMWARE_VERSION)
+	s.setUint16(device.REG_LBO_TIMER, 60)
+	s.updateBattery()
+	return s
+}
+
+// SetAddress changes the i2c address the simulator answers on.
+func (s *PiVoyager) SetAddress(addr byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.address = addr
+}
+
+/* Bus implementation */
+
+func (s *PiVoyager) ReadByte(addr byte, reg byte) (byte, error) {
+	var buf [1]byte
+
+	if err := s.read(addr, reg, buf[:]); err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (s *PiVoyager) ReadBytes(addr byte, reg byte, data []byte) error {
+	if len(data) > i2c.I2C_SMBUS_I2C_BLOCK_MAX {
+		return &i2c.Error{Op: i2c.OP_READ, Addr: addr, Reg: reg, Len: len(data), Err: i2c.LengthError}
+	}
+	return s.read(addr, reg, data)
+}
+
+func (s *PiVoyager) WriteByte(addr byte, reg byte, data byte) error {
+	return s.write(addr, reg, []byte{data})
+}
+
+func (s *PiVoyager) WriteBytes(addr byte, reg byte, data []byte) error {
+	if len(data) > i2c.I2C_SMBUS_I2C_BLOCK_MAX {
+		return &i2c.Error{Op: i2c.OP_WRITE, Addr: addr, Reg: reg, Len: len(data), Err: i2c.LengthError}
+	}
+	return s.write(addr, reg, data)
+}
+
+func (s *PiVoyager) ModifyByte(addr byte, reg byte, mask byte, data byte) error {
+	r, err := s.ReadByte(addr, reg)
+	if err != nil {
+		return err
+	}
+	return s.WriteByte(addr, reg, (r&(^mask))|(data&mask))
+}
+
+func (s *PiVoyager) Close() error {
+	return nil
+}
+
+// nack returns the error the kernel reports when the device does not
+// acknowledge a transaction.
+func nack(op string, addr byte, reg byte, length int) error {
+	return &i2c.Error{Op: op, Ioctl: "I2C_SMBUS", Addr: addr, Reg: reg, Len: length, Err: syscall.EREMOTEIO}
+}
+
+// fault consumes one injected fault, if any.
+func (s *PiVoyager) fault(op string, addr byte, reg byte, length int) error {
+	if s.faults == 0 {
+		return nil
+	}
+	s.faults--
+	return &i2c.Error{Op: op, Ioctl: "I2C_SMBUS", Addr: addr, Reg: reg, Len: length, Err: s.faultErr}
+}
+
+func (s *PiVoyager) read(addr byte, reg byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tick()
+	if err := s.fault(i2c.OP_READ, addr, reg, len(data)); err != nil {
+		return err
+	}
+	if addr != s.address || len(data) == 0 {
+		return nack(i2c.OP_READ, addr, reg, len(data))
+	}
+	if s.bootloader {
+		if int(reg)+len(data) > BL_REGISTER_COUNT {
+			return nack(i2c.OP_READ, addr, reg, len(data))
+		}
+		copy(data, s.blRegs[reg:])
+		return nil
+	}
+	if int(reg)+len(data) > REGISTER_COUNT {
+		return nack(i2c.OP_READ, addr, reg, len(data))
+	}
+	s.refresh()
+	copy(data, s.regs[reg:])
+	return nil
+}
+
+func (s *PiVoyager) write(addr byte, reg byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tick()
+	if err := s.fault(i2c.OP_WRITE, addr, reg, len(data)); err != nil {
+		return err
+	}
+	if addr != s.address || len(data) == 0 {
+		return nack(i2c.OP_WRITE, addr, reg, len(data))
+	}
+	if s.bootloader {
+		if int(reg)+len(data) > BL_REGISTER_COUNT {
+			return nack(i2c.OP_WRITE, addr, reg, len(data))
+		}
+		for i, b := range data {
+			s.writeBootloaderRegister(int(reg)+i, b)
+		}
+		return nil
+	}
+	if int(reg)+len(data) > REGISTER_COUNT {
+		return nack(i2c.OP_WRITE, addr, reg, len(data))
+	}
+	for i, b := range data {
+		s.writeRegister(int(reg)+i, b)
+	}
+	return nil
+}
+
+func (s *PiVoyager) writeRegister(reg int, b byte) {
+	switch {
+	case reg == device.REG_CONF:
+		s.regs[reg] = b
+	case reg == device.REG_PROG:
+		s.program(b)
+	case reg >= device.REG_SET_TIME && reg < device.REG_SET_TIME+8:
+		s.regs[reg] = b
+	case reg == device.REG_WATCH || reg == device.REG_WATCH+1:
+		s.regs[reg] = b
+		s.counters.watchdog = int(s.uint16At(device.REG_WATCH))
+	case reg == device.REG_WAKE || reg == device.REG_WAKE+1:
+		s.regs[reg] = b
+	case reg >= device.REG_ALARM && reg < device.REG_ALARM+4:
+		s.regs[reg] = b
+	case reg == device.REG_BOOT || reg == device.REG_BOOT+1:
+		s.regs[reg] = b
+	case reg == device.REG_LBO_TIMER || reg == device.REG_LBO_TIMER+1:
+		s.regs[reg] = b
+		s.counters.lbo = int(s.uint16At(device.REG_LBO_TIMER))
+	default:
+		// read-only register: writes are ignored.
+	}
+}
+
+func (s *PiVoyager) program(b byte) {
+	if (b & device.PROG_CLEAR_ALARM) != 0 {
+		s.stat &= ^byte(device.STAT_ALARM)
+	}
+	if (b & device.PROG_CLEAR_BUTTON) != 0 {
+		s.stat &= ^byte(device.STAT_BUTTON)
+	}
+	if (b & device.PROG_CALENDAR) != 0 {
+		r := s.regs[device.REG_SET_TIME:]
+		s.rtc = time.Date(2000+device.FromBCD(r[6]), time.Month(device.FromBCD(r[5]&0x1F)), device.FromBCD(r[4]),
+			device.FromBCD(r[2]), device.FromBCD(r[1]), device.FromBCD(r[0]), 0, time.UTC)
+		s.stat |= device.STAT_INITS
+	}
+	if (b & device.PROG_ALARM) != 0 {
+		s.alarmArmed = true
+	}
+	if (b & device.PROG_BOOTLOADER) != 0 {
+		s.enterBootloader()
+	}
+}
+
+/* Register refresh */
+
+func (s *PiVoyager) setUint16(reg int, v uint16) {
+	s.regs[reg] = byte(v)
+	s.regs[reg+1] = byte(v >> 8)
+}
+
+func (s *PiVoyager) uint16At(reg int) uint16 {
+	return uint16(s.regs[reg]) + (uint16(s.regs[reg+1]) << 8)
+}
+
+func (s *PiVoyager) alarm() device.Alarm {
+	r := s.regs[device.REG_ALARM:]
+	return device.Alarm(r[0]) + (device.Alarm(r[1]) << 8) + (device.Alarm(r[2]) << 16) + (device.Alarm(r[3]) << 24)
+}
+
+func (s *PiVoyager) refresh() {
+	s.regs[device.REG_MODE] = 'N'
+	s.regs[device.REG_STAT] = s.status()
+	s.regs[device.REG_PROG] = 0
+
+	weekday := byte(s.rtc.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	r := s.regs[device.REG_TIME : device.REG_TIME+8]
+	r[0] = device.ToBCD(s.rtc.Second())
+	r[1] = device.ToBCD(s.rtc.Minute())
+	r[2] = device.ToBCD(s.rtc.Hour())
+	r[3] = 0
+	r[4] = device.ToBCD(s.rtc.Day())
+	r[5] = device.ToBCD(int(s.rtc.Month())) | (weekday << 5)
+	r[6] = device.ToBCD(s.rtc.Year() % 100)
+	r[7] = 0
+
+	// The firmware reports VBat through a 1/2 divider, and VRef against
+	// the factory calibration value taken at 3.3V.
+	vref := uint16(float64(s.vrefCal) * 3.3 / s.vdd)
+	vbat := uint16(s.vbat / 2 / s.vdd * 4095)
+	if s.noise > 0 {
+		vbat = uint16(int(vbat) + rand.Intn(2*s.noise+1) - s.noise)
+	}
+	s.setUint16(device.REG_VBAT, vbat)
+	s.setUint16(device.REG_VREF, vref)
+	s.setUint16(device.REG_VREF_CAL, s.vrefCal)
+}
+
+func (s *PiVoyager) status() byte {
+	st := s.stat | byte(s.battery&7)
+	if s.usb {
+		st |= device.STAT_5V
+	}
+	return st
+}
+
+func (s *PiVoyager) updateBattery() {
+	switch {
+	case s.usb && s.vbat >= CHARGE_COMPLETE_VOLTAGE:
+		s.battery = device.CHARGER_CHARGE_COMPLETE
+	case s.usb:
+		s.battery = device.CHARGER_CHARGING
+	case s.vbat < LOW_BATTERY_VOLTAGE:
+		s.battery = device.CHARGER_LOW_BATTERY
+	default:
+		s.battery = device.CHARGER_DISCHARGING
+	}
+}
+
+/* Time */
+
+func (s *PiVoyager) now() time.Time {
+	return s.Now().Add(s.offset)
+}
+
+// tick runs the simulation for every whole second elapsed since the
+// previous call.
+func (s *PiVoyager) tick() {
+	now := s.now()
+	for now.Sub(s.last) >= time.Second {
+		s.last = s.last.Add(time.Second)
+		s.second()
+	}
+}
+
+func (s *PiVoyager) second() {
+	conf := s.regs[device.REG_CONF]
+
+	s.rtc = s.rtc.Add(time.Second)
+	if s.alarmArmed && alarmMatches(s.alarm(), s.rtc) {
+		s.stat |= device.STAT_ALARM
+		if !s.powered && (conf&device.CONF_WAKE_ALARM) != 0 {
+			s.powerOn()
+		}
+	}
+
+	if s.powered {
+		if (conf&(device.CONF_I2C_WD|device.CONF_PIN_WD)) != 0 && s.counters.watchdog > 0 {
+			s.counters.watchdog--
+			if s.counters.watchdog == 0 {
+				s.powerCycles++
+				s.regs[device.REG_CONF] &= ^byte(device.CONF_I2C_WD | device.CONF_PIN_WD)
+			}
+		}
+		if (conf&device.CONF_LBO_SHUTDOWN) != 0 && s.battery == device.CHARGER_LOW_BATTERY {
+			if s.counters.lbo > 0 {
+				s.counters.lbo--
+			}
+			if s.counters.lbo == 0 {
+				s.powerOff()
+			}
+		} else {
+			s.counters.lbo = int(s.uint16At(device.REG_LBO_TIMER))
+		}
+	} else if (conf&device.CONF_WAKE_AFTER) != 0 && s.counters.wakeup > 0 {
+		s.counters.wakeup--
+		if s.counters.wakeup == 0 {
+			s.powerOn()
+		}
+	}
+}
+
+func alarmMatches(a device.Alarm, tm time.Time) bool {
+	if (a&(1<<device.AL_SECOND_MASK)) == 0 && byte(a&0x7F) != device.ToBCD(tm.Second()) {
+		return false
+	}
+	if (a&(1<<device.AL_MINUTE_MASK)) == 0 && byte((a>>device.AL_MINUTE)&0x7F) != device.ToBCD(tm.Minute()) {
+		return false
+	}
+	if (a&(1<<device.AL_HOUR_MASK)) == 0 && byte((a>>device.AL_HOUR)&0x3F) != device.ToBCD(tm.Hour()) {
+		return false
+	}
+	if (a & (1 << device.AL_DAY_MASK)) == 0 {
+		if (a & (1 << device.AL_WEEKDAY_SELECT)) != 0 {
+			weekday := int(tm.Weekday())
+			if weekday == 0 {
+				weekday = 7
+			}
+			return int((a>>device.AL_DAY)&0xF) == weekday
+		}
+		return byte((a>>device.AL_DAY)&0x3F) == device.ToBCD(tm.Day())
+	}
+	return true
+}
+
+func (s *PiVoyager) powerOn() {
+	s.powered = true
+	s.counters.watchdog = int(s.uint16At(device.REG_WATCH))
+	s.counters.lbo = int(s.uint16At(device.REG_LBO_TIMER))
+}
+
+func (s *PiVoyager) powerOff() {
+	s.powered = false
+	s.counters.wakeup = int(s.uint16At(device.REG_WAKE))
+}
+
+/* Bootloader */
+
+func (s *PiVoyager) enterBootloader() {
+	s.bootloader = true
+	s.blRegs = [BL_REGISTER_COUNT]byte{}
+	s.blRegs[device.REG_BL_MODE] = 'B'
+	s.blRegs[device.REG_BL_VERSION] = BOOTLOADER_VERSION
+	for i := 0; i < 4; i++ {
+		s.blRegs[device.REG_BL_MCUID+i] = byte(s.mcuid >> (8 * uint(i)))
+	}
+}
+
+func (s *PiVoyager) flashAddress() uint32 {
+	r := s.blRegs[device.REG_BL_ADDR:]
+	return uint32(r[0]) + (uint32(r[1]) << 8) + (uint32(r[2]) << 16) + (uint32(r[3]) << 24)
+}
+
+func (s *PiVoyager) setFlashAddress(addr uint32) {
+	for i := 0; i < 4; i++ {
+		s.blRegs[device.REG_BL_ADDR+i] = byte(addr >> (8 * uint(i)))
+	}
+}
+
+// flashOffset returns the offset in flash of the block of length bytes at
+// the current address, or -1 if it is out of range.
+func (s *PiVoyager) flashOffset(length int) int {
+	addr := s.flashAddress()
+	if addr < device.APP_START_ADDR || addr-device.APP_START_ADDR+uint32(length) > FLASH_SIZE {
+		return -1
+	}
+	return int(addr - device.APP_START_ADDR)
+}
+
+func (s *PiVoyager) writeBootloaderRegister(reg int, b byte) {
+	switch {
+	case reg == device.REG_BL_PROG:
+		s.blRegs[device.REG_BL_ERR] = 0
+		if !s.bootloaderProgram(b) {
+			s.blRegs[device.REG_BL_ERR] = 1
+		}
+		s.blRegs[device.REG_BL_PROG] = 0
+	case reg >= device.REG_BL_ADDR:
+		s.blRegs[reg] = b
+	default:
+		// read-only register: writes are ignored.
+	}
+}
+
+func (s *PiVoyager) bootloaderProgram(prog byte) bool {
+	const block = 64
+
+	switch prog {
+	case device.PROG_BL_NONE:
+		return true
+	case device.PROG_BL_ERASE_PAGE:
+		pos := s.flashOffset(1)
+		if pos < 0 {
+			return false
+		}
+		pos -= pos % FLASH_PAGE_SIZE
+		for i := pos; i < pos+FLASH_PAGE_SIZE; i++ {
+			s.flash[i] = 0xFF
+		}
+	case device.PROG_BL_READ:
+		pos := s.flashOffset(block)
+		if pos < 0 {
+			return false
+		}
+		copy(s.blRegs[device.REG_BL_DATA:], s.flash[pos:pos+block])
+		s.setFlashAddress(s.flashAddress() + block)
+	case device.PROG_BL_WRITE:
+		pos := s.flashOffset(block)
+		if pos < 0 {
+			return false
+		}
+		// Like real flash, programming can only clear bits.
+		for i := 0; i < block; i++ {
+			s.flash[pos+i] &= s.blRegs[device.REG_BL_DATA+i]
+		}
+		s.setFlashAddress(s.flashAddress() + block)
+	case device.PROG_BL_EXIT:
+		s.bootloader = false
+	default:
+		return false
+	}
+	return true
+}
+
+/* Controls */
+
+// FailNext makes the next count transactions fail with errno, to simulate
+// bus glitches.
+func (s *PiVoyager) FailNext(count int, errno syscall.Errno) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = count
+	s.faultErr = errno
+}
+
+// Advance moves the simulated time forward by d, on top of the time
+// reported by Now.
+func (s *PiVoyager) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += d
+	s.tick()
+}
+
+// SetUSBPower connects or disconnects the USB 5V supply.
+func (s *PiVoyager) SetUSBPower(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	s.usb = on
+	s.updateBattery()
+	if on && !s.powered && (s.regs[device.REG_CONF]&device.CONF_WAKE_POWER) != 0 {
+		s.powerOn()
+	}
+}
+
+// SetBatteryVoltage sets the voltage of the simulated battery, updating
+// the charger state accordingly.
+func (s *PiVoyager) SetBatteryVoltage(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	s.vbat = v
+	s.updateBattery()
+}
+
+// SetSupplyVoltage sets the MCU supply voltage, which is what VRef
+// measures.
+func (s *PiVoyager) SetSupplyVoltage(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vdd = v
+}
+
+// SetADCNoise adds a random error of up to counts to each reading of the
+// battery voltage.
+func (s *PiVoyager) SetADCNoise(counts int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noise = counts
+}
+
+// SetBatteryState forces the charger state until the next change of USB
+// power or battery voltage.
+func (s *PiVoyager) SetBatteryState(state device.ChargerState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	s.battery = state & 7
+}
+
+// PressButton simulates a press on the PiVoyager button.
+func (s *PiVoyager) PressButton() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	s.stat |= device.STAT_BUTTON
+	if !s.powered && (s.regs[device.REG_CONF]&device.CONF_WAKE_BUTTON) != 0 {
+		s.powerOn()
+	}
+}
+
+// KickPin simulates a toggle of the GPIO watchdog pin.
+func (s *PiVoyager) KickPin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	if (s.regs[device.REG_CONF] & device.CONF_PIN_WD) != 0 {
+		s.counters.watchdog = int(s.uint16At(device.REG_WATCH))
+	}
+}
+
+type pinLine struct {
+	sim   *PiVoyager
+	value bool
+}
+
+func (l *pinLine) SetValue(high bool) error {
+	if high != l.value {
+		l.sim.KickPin()
+	}
+	l.value = high
+	return nil
+}
+
+func (l *pinLine) Close() error {
+	return nil
+}
+
+// WatchdogPin returns a GPIO line connected to the watchdog pin: each
+// change of its value calls KickPin.
+func (s *PiVoyager) WatchdogPin() gpio.Line {
+	return &pinLine{sim: s}
+}
+
+// PowerOff simulates the PiVoyager cutting power to the Raspberry Pi,
+// which starts the wakeup timer.
+func (s *PiVoyager) PowerOff() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	s.powerOff()
+}
+
+// EnterBootloader simulates powering the device while pressing the button.
+func (s *PiVoyager) EnterBootloader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enterBootloader()
+}
+
+/* Observers */
+
+// Powered reports whether the Raspberry Pi is currently powered.
+func (s *PiVoyager) Powered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	return s.powered
+}
+
+// PowerCycles returns the number of times the watchdog expired.
+func (s *PiVoyager) PowerCycles() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	return s.powerCycles
+}
+
+// RTC returns the current time of the simulated real time clock.
+func (s *PiVoyager) RTC() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tick()
+	return s.rtc
+}
+
+// Bootloader reports whether the simulator is in bootloader mode.
+func (s *PiVoyager) Bootloader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bootloader
+}
+
+// Flash returns a copy of the application flash memory.
+func (s *PiVoyager) Flash() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := make([]byte, FLASH_SIZE)
+	copy(data, s.flash[:])
+	return data
+}
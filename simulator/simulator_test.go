@@ -0,0 +1,244 @@
+package simulator
+
+import (
+	"github.com/omzlo/pivoyager/device"
+	"testing"
+	"time"
+)
+
+// newTest returns a simulator whose time only moves with Advance, and a
+// device using it.
+func newTest(t *testing.T) (*PiVoyager, *device.Device) {
+	t.Helper()
+	s := New()
+	now := time.Now()
+	s.Now = func() time.Time { return now }
+	dev := device.New(s, device.DEVICE_ADDRESS)
+	if err := dev.CheckMode(false); err != nil {
+		t.Fatal(err)
+	}
+	return s, dev
+}
+
+func TestRTCTicks(t *testing.T) {
+	s, dev := newTest(t)
+
+	if err := dev.SetTime(time.Date(2021, 12, 31, 23, 59, 58, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	s.Advance(3 * time.Second)
+	rtc, err := dev.Time()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Date(2022, 1, 1, 0, 0, 1, 0, time.UTC); !rtc.Equal(expected) {
+		t.Errorf("Time() = %s, expected %s", rtc, expected)
+	}
+	status, err := dev.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Decode().Initialized {
+		t.Errorf("setting the time did not set the inits flag")
+	}
+}
+
+func TestAlarmMatches(t *testing.T) {
+	tm := time.Date(2021, 3, 14, 7, 30, 0, 0, time.UTC) // a Sunday
+
+	tests := []struct {
+		alarm   *device.Alarm
+		matches bool
+	}{
+		{device.MewAlarm(), true},
+		{device.MewAlarm().OnHour(7).OnMinute(30).OnSecond(0), true},
+		{device.MewAlarm().OnHour(7).OnMinute(31).OnSecond(0), false},
+		{device.MewAlarm().OnDay(14).OnHour(7), true},
+		{device.MewAlarm().OnDay(15).OnHour(7), false},
+		{device.MewAlarm().OnWeekday(7).OnSecond(0), true},
+		{device.MewAlarm().OnWeekday(1).OnSecond(0), false},
+	}
+	for _, test := range tests {
+		if m := alarmMatches(*test.alarm, tm); m != test.matches {
+			t.Errorf("alarm %s matches %s: %v, expected %v", *test.alarm, tm, m, test.matches)
+		}
+	}
+}
+
+func TestAlarmWakeup(t *testing.T) {
+	s, dev := newTest(t)
+
+	if err := dev.SetTime(time.Date(2021, 3, 14, 7, 29, 50, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetAlarm(*device.MewAlarm().OnHour(7).OnMinute(30).OnSecond(0), device.CONF_WAKE_ALARM); err != nil {
+		t.Fatal(err)
+	}
+	s.PowerOff()
+	s.Advance(9 * time.Second)
+	if s.Powered() {
+		t.Fatalf("the alarm fired early")
+	}
+	s.Advance(2 * time.Second)
+	if !s.Powered() {
+		t.Errorf("the alarm did not wake the Pi up")
+	}
+	status, err := dev.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Decode().AlarmTriggered {
+		t.Errorf("the alarm flag is not set")
+	}
+	if err := dev.Program(device.PROG_CLEAR_ALARM); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := dev.Status(); status.Decode().AlarmTriggered {
+		t.Errorf("the alarm flag was not cleared")
+	}
+}
+
+func TestWatchdogCountdown(t *testing.T) {
+	s, dev := newTest(t)
+
+	if err := dev.SetWatchdog(5, device.CONF_I2C_WD); err != nil {
+		t.Fatal(err)
+	}
+	s.Advance(4 * time.Second)
+	if err := dev.KickWatchdog(5); err != nil {
+		t.Fatal(err)
+	}
+	s.Advance(4 * time.Second)
+	if n := s.PowerCycles(); n != 0 {
+		t.Fatalf("the watchdog expired %d times while kicked", n)
+	}
+	s.Advance(2 * time.Second)
+	if n := s.PowerCycles(); n != 1 {
+		t.Errorf("the watchdog expired %d times, expected 1", n)
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf&device.CONF_I2C_WD != 0 {
+		t.Errorf("the watchdog is still enabled once expired")
+	}
+}
+
+func TestWakeupCountdown(t *testing.T) {
+	s, dev := newTest(t)
+
+	if err := dev.SetWakeup(10, device.CONF_WAKE_AFTER); err != nil {
+		t.Fatal(err)
+	}
+	s.PowerOff()
+	s.Advance(9 * time.Second)
+	if s.Powered() {
+		t.Fatalf("the Pi woke up early")
+	}
+	s.Advance(2 * time.Second)
+	if !s.Powered() {
+		t.Errorf("the Pi did not wake up after 10s")
+	}
+}
+
+func TestLowBatteryShutdown(t *testing.T) {
+	s, dev := newTest(t)
+
+	if err := dev.SetLowBatteryTimer(5, device.CONF_LBO_SHUTDOWN); err != nil {
+		t.Fatal(err)
+	}
+	s.SetUSBPower(false)
+	s.SetBatteryVoltage(LOW_BATTERY_VOLTAGE - 0.1)
+	s.Advance(4 * time.Second)
+	if !s.Powered() {
+		t.Fatalf("power was cut before the low battery timer expired")
+	}
+	s.Advance(2 * time.Second)
+	if s.Powered() {
+		t.Errorf("power was not cut after the low battery timer expired")
+	}
+}
+
+func TestBootloader(t *testing.T) {
+	s, dev := newTest(t)
+	addr := byte(device.DEVICE_ADDRESS)
+
+	if err := dev.Program(device.PROG_BOOTLOADER); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.CheckMode(true); err != nil {
+		t.Fatal(err)
+	}
+	block := make([]byte, 64)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	block[0] = 0x0F
+	program := func(prog byte) byte {
+		t.Helper()
+		if err := s.WriteByte(addr, device.REG_BL_PROG, prog); err != nil {
+			t.Fatal(err)
+		}
+		status, err := s.ReadByte(addr, device.REG_BL_ERR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status
+	}
+	load := func(data []byte) {
+		t.Helper()
+		// The data registers are written 32 bytes at a time.
+		for pos := 0; pos < len(data); pos += 32 {
+			end := pos + 32
+			if end > len(data) {
+				end = len(data)
+			}
+			if err := s.WriteBytes(addr, device.REG_BL_DATA+byte(pos), data[pos:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	page := uint32(device.APP_START_ADDR + FLASH_PAGE_SIZE)
+
+	if err := dev.FlashSetAddress(page + 64); err != nil {
+		t.Fatal(err)
+	}
+	load(block)
+	if program(device.PROG_BL_WRITE) != 0 {
+		t.Fatalf("write failed")
+	}
+	// Programming only clears bits, the page must be erased first.
+	if err := dev.FlashSetAddress(page + 64); err != nil {
+		t.Fatal(err)
+	}
+	load([]byte{0xF0})
+	program(device.PROG_BL_WRITE)
+	if flash := s.Flash(); flash[FLASH_PAGE_SIZE+64] != 0 || flash[FLASH_PAGE_SIZE+65] != 1 {
+		t.Errorf("flash = % x after writing f0 over 0f, expected 00 01", flash[FLASH_PAGE_SIZE+64:FLASH_PAGE_SIZE+66])
+	}
+
+	if err := dev.FlashSetAddress(page + 100); err != nil {
+		t.Fatal(err)
+	}
+	if program(device.PROG_BL_ERASE_PAGE) != 0 {
+		t.Fatalf("erase failed")
+	}
+	flash := s.Flash()
+	for i := FLASH_PAGE_SIZE; i < 2*FLASH_PAGE_SIZE; i++ {
+		if flash[i] != 0xFF {
+			t.Fatalf("byte %d = 0x%02x after erasing its page", i, flash[i])
+		}
+	}
+
+	if err := dev.FlashSetAddress(device.APP_START_ADDR + FLASH_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	if program(device.PROG_BL_READ) == 0 {
+		t.Errorf("reading past the end of the flash did not fail")
+	}
+	program(device.PROG_BL_EXIT)
+	if s.Bootloader() {
+		t.Errorf("the simulator is still in bootloader mode")
+	}
+}
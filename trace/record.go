@@ -0,0 +1,102 @@
+package trace
+
+import (
+	"errors"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/i2c"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Recorder is a device.Bus that forwards transactions to another bus and
+// writes each of them to a trace.
+type Recorder struct {
+	Bus device.Bus
+	// Now is the source of timestamps, time.Now by default.
+	Now func() time.Time
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func NewRecorder(bus device.Bus, w io.Writer) *Recorder {
+	return &Recorder{Bus: bus, Now: time.Now, w: w}
+}
+
+func (r *Recorder) Unwrap() device.Bus {
+	return r.Bus
+}
+
+// Err returns the first error encountered while writing the trace.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(op string, addr byte, reg byte, length int, data []byte, err error) {
+	rec := Record{Time: r.Now(), Op: op, Addr: addr, Reg: reg, Len: length}
+	if op == i2c.OP_WRITE || err == nil {
+		rec.Data = append([]byte(nil), data...)
+	}
+	if err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			rec.Errno = errno
+		}
+		rec.Err = err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, werr := io.WriteString(r.w, rec.String()+"\n"); werr != nil && r.err == nil {
+		r.err = werr
+	}
+}
+
+func (r *Recorder) ReadByte(addr byte, reg byte) (byte, error) {
+	b, err := r.Bus.ReadByte(addr, reg)
+	r.record(i2c.OP_READ, addr, reg, 1, []byte{b}, err)
+	return b, err
+}
+
+func (r *Recorder) ReadBytes(addr byte, reg byte, data []byte) error {
+	err := r.Bus.ReadBytes(addr, reg, data)
+	r.record(i2c.OP_READ, addr, reg, len(data), data, err)
+	return err
+}
+
+func (r *Recorder) WriteByte(addr byte, reg byte, data byte) error {
+	err := r.Bus.WriteByte(addr, reg, data)
+	r.record(i2c.OP_WRITE, addr, reg, 1, []byte{data}, err)
+	return err
+}
+
+func (r *Recorder) WriteBytes(addr byte, reg byte, data []byte) error {
+	err := r.Bus.WriteBytes(addr, reg, data)
+	r.record(i2c.OP_WRITE, addr, reg, len(data), data, err)
+	return err
+}
+
+func (r *Recorder) ModifyByte(addr byte, reg byte, mask byte, data byte) error {
+	v, err := r.ReadByte(addr, reg)
+	if err != nil {
+		return err
+	}
+	return r.WriteByte(addr, reg, (v&(^mask))|(data&mask))
+}
+
+// Close closes the underlying bus, and the trace writer if it is an
+// io.Closer.
+func (r *Recorder) Close() error {
+	err := r.Bus.Close()
+	if c, ok := r.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
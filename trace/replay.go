@@ -0,0 +1,148 @@
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/i2c"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	EndOfTrace = errors.New("End of i2c trace reached")
+)
+
+// MismatchError is returned by a Replayer when a transaction does not match
+// the next record of the trace.
+type MismatchError struct {
+	Line     int
+	Expected Record
+	Got      Record
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("Trace mismatch at line %d: expected '%s', got '%s'", e.Line, e.Expected.Transaction(), e.Got.Transaction())
+}
+
+// Replayer is a device.Bus serving the transactions of a trace back, in
+// order. Each transaction must match the operation, address, register and
+// length of the next record. If Strict is set, written data must match as
+// well.
+type Replayer struct {
+	Strict bool
+
+	mu      sync.Mutex
+	records []Record
+	lines   []int
+	pos     int
+}
+
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	rp := new(Replayer)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		rec, err := ParseRecord(text)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", line, err)
+		}
+		rp.records = append(rp.records, rec)
+		rp.lines = append(rp.lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rp, nil
+}
+
+func LoadReplayer(path string) (*Replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewReplayer(f)
+}
+
+// Remaining returns the number of records not replayed yet.
+func (rp *Replayer) Remaining() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return len(rp.records) - rp.pos
+}
+
+func (rp *Replayer) next(got Record) (Record, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.pos >= len(rp.records) {
+		return Record{}, EndOfTrace
+	}
+	rec := rp.records[rp.pos]
+	if rec.Op != got.Op || rec.Addr != got.Addr || rec.Reg != got.Reg || rec.Len != got.Len ||
+		(rp.Strict && got.Op == i2c.OP_WRITE && !bytes.Equal(rec.Data, got.Data)) {
+		return Record{}, &MismatchError{Line: rp.lines[rp.pos], Expected: rec, Got: got}
+	}
+	rp.pos++
+	return rec, nil
+}
+
+func (rp *Replayer) read(addr byte, reg byte, data []byte) error {
+	rec, err := rp.next(Record{Op: i2c.OP_READ, Addr: addr, Reg: reg, Len: len(data)})
+	if err != nil {
+		return err
+	}
+	if err := rec.Error(); err != nil {
+		return err
+	}
+	copy(data, rec.Data)
+	return nil
+}
+
+func (rp *Replayer) write(addr byte, reg byte, data []byte) error {
+	rec, err := rp.next(Record{Op: i2c.OP_WRITE, Addr: addr, Reg: reg, Len: len(data), Data: data})
+	if err != nil {
+		return err
+	}
+	return rec.Error()
+}
+
+func (rp *Replayer) ReadByte(addr byte, reg byte) (byte, error) {
+	var buf [1]byte
+
+	err := rp.read(addr, reg, buf[:])
+	return buf[0], err
+}
+
+func (rp *Replayer) ReadBytes(addr byte, reg byte, data []byte) error {
+	return rp.read(addr, reg, data)
+}
+
+func (rp *Replayer) WriteByte(addr byte, reg byte, data byte) error {
+	return rp.write(addr, reg, []byte{data})
+}
+
+func (rp *Replayer) WriteBytes(addr byte, reg byte, data []byte) error {
+	return rp.write(addr, reg, data)
+}
+
+func (rp *Replayer) ModifyByte(addr byte, reg byte, mask byte, data byte) error {
+	v, err := rp.ReadByte(addr, reg)
+	if err != nil {
+		return err
+	}
+	return rp.WriteByte(addr, reg, (v&(^mask))|(data&mask))
+}
+
+func (rp *Replayer) Close() error {
+	return nil
+}
@@ -0,0 +1,131 @@
+// Package trace records the i2c transactions issued to a device.Bus and
+// replays them, so that a failure captured on a Raspberry Pi can be
+// reproduced deterministically against device.Device and the pivoyager
+// commands.
+//
+// A trace is a text file with one transaction per line:
+//
+//	<time> <op> <addr> <reg> <len> <data> [! <errno> <message>]
+//
+// where <time> is an RFC3339 timestamp with nanoseconds, <op> is R for a
+// read or W for a write, <addr> and <reg> are hexadecimal bytes such as
+// 0x65, <len> is the decimal number of bytes transferred and <data> is the
+// bytes in hexadecimal, or "-" for a failed read. A failed transaction is
+// followed by "!", the decimal errno returned by the kernel (0 if the error
+// did not come from a system call) and the error message.
+//
+// Empty lines and lines starting with '#' are ignored. ModifyByte is
+// recorded as a read followed by a write.
+package trace
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/i2c"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type Record struct {
+	Time  time.Time
+	Op    string // i2c.OP_READ or i2c.OP_WRITE
+	Addr  byte
+	Reg   byte
+	Len   int
+	Data  []byte
+	Errno syscall.Errno
+	Err   string // empty if the transaction succeeded
+}
+
+func (r Record) String() string {
+	s := r.Time.UTC().Format(time.RFC3339Nano) + " " + r.Transaction()
+	if r.Err != "" {
+		s += fmt.Sprintf(" ! %d %s", uintptr(r.Errno), r.Err)
+	}
+	return s
+}
+
+// Transaction formats the record without its timestamp and error.
+func (r Record) Transaction() string {
+	op := "R"
+	if r.Op == i2c.OP_WRITE {
+		op = "W"
+	}
+	data := "-"
+	if len(r.Data) > 0 {
+		data = hex.EncodeToString(r.Data)
+	}
+	return fmt.Sprintf("%s 0x%02x 0x%02x %d %s", op, r.Addr, r.Reg, r.Len, data)
+}
+
+// Error rebuilds the error reported by the recorded transaction, or nil if
+// it succeeded.
+func (r Record) Error() error {
+	if r.Err == "" {
+		return nil
+	}
+	if r.Errno == 0 {
+		return errors.New(r.Err)
+	}
+	return &i2c.Error{Op: r.Op, Ioctl: "I2C_SMBUS", Addr: r.Addr, Reg: r.Reg, Len: r.Len, Err: r.Errno}
+}
+
+func parseByte(s string) (byte, error) {
+	v, err := strconv.ParseUint(s, 0, 8)
+	return byte(v), err
+}
+
+// ParseRecord parses a line of a trace.
+func ParseRecord(line string) (Record, error) {
+	var r Record
+	var err error
+
+	fields := strings.SplitN(strings.TrimSpace(line), " ", 8)
+	if len(fields) < 6 {
+		return r, fmt.Errorf("Trace record has %d fields, expected at least 6", len(fields))
+	}
+	if r.Time, err = time.Parse(time.RFC3339Nano, fields[0]); err != nil {
+		return r, err
+	}
+	switch fields[1] {
+	case "R":
+		r.Op = i2c.OP_READ
+	case "W":
+		r.Op = i2c.OP_WRITE
+	default:
+		return r, fmt.Errorf("Invalid trace operation '%s'", fields[1])
+	}
+	if r.Addr, err = parseByte(fields[2]); err != nil {
+		return r, fmt.Errorf("Invalid trace address '%s'", fields[2])
+	}
+	if r.Reg, err = parseByte(fields[3]); err != nil {
+		return r, fmt.Errorf("Invalid trace register '%s'", fields[3])
+	}
+	if r.Len, err = strconv.Atoi(fields[4]); err != nil {
+		return r, fmt.Errorf("Invalid trace length '%s'", fields[4])
+	}
+	if fields[5] != "-" {
+		if r.Data, err = hex.DecodeString(fields[5]); err != nil {
+			return r, fmt.Errorf("Invalid trace data '%s'", fields[5])
+		}
+		if len(r.Data) != r.Len {
+			return r, fmt.Errorf("Trace data has %d bytes, expected %d", len(r.Data), r.Len)
+		}
+	}
+	if len(fields) > 6 {
+		if fields[6] != "!" || len(fields) < 8 {
+			return r, fmt.Errorf("Invalid trace error '%s'", strings.Join(fields[6:], " "))
+		}
+		parts := strings.SplitN(fields[7], " ", 2)
+		errno, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || len(parts) < 2 {
+			return r, fmt.Errorf("Invalid trace error '%s'", fields[7])
+		}
+		r.Errno = syscall.Errno(errno)
+		r.Err = parts[1]
+	}
+	return r, nil
+}
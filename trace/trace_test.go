@@ -0,0 +1,163 @@
+package trace
+
+import (
+	"bytes"
+	"errors"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/i2c"
+	"github.com/omzlo/pivoyager/simulator"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRecord(t *testing.T) {
+	tm := time.Date(2021, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	records := []Record{
+		{Time: tm, Op: i2c.OP_READ, Addr: 0x65, Reg: 0x00, Len: 1, Data: []byte{0x0e}},
+		{Time: tm, Op: i2c.OP_WRITE, Addr: 0x65, Reg: 0x03, Len: 2, Data: []byte{0x0a, 0x0b}},
+		{Time: tm, Op: i2c.OP_READ, Addr: 0x65, Reg: 0x10, Len: 4, Errno: syscall.EIO, Err: "I2C read error: input/output error"},
+	}
+	transactions := []string{"R 0x65 0x00 1 0e", "W 0x65 0x03 2 0a0b", "R 0x65 0x10 4 -"}
+
+	for i, rec := range records {
+		if s := rec.Transaction(); s != transactions[i] {
+			t.Errorf("Transaction() = '%s', expected '%s'", s, transactions[i])
+		}
+		parsed, err := ParseRecord(rec.String())
+		if err != nil {
+			t.Errorf("ParseRecord('%s') failed: %s", rec, err)
+			continue
+		}
+		if !parsed.Time.Equal(rec.Time) || parsed.Transaction() != rec.Transaction() || parsed.Errno != rec.Errno || parsed.Err != rec.Err {
+			t.Errorf("ParseRecord('%s') = %+v, expected %+v", rec, parsed, rec)
+		}
+	}
+
+	if err := records[0].Error(); err != nil {
+		t.Errorf("Error() = %s for a successful transaction", err)
+	}
+	if err := records[2].Error(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Error() = %v, expected EIO", err)
+	}
+
+	for _, line := range []string{
+		"2021-03-14T15:09:26Z R 0x65 0x00 1",
+		"2021-03-14T15:09:26Z X 0x65 0x00 1 0e",
+		"2021-03-14T15:09:26Z R 0x65 0x00 2 0e",
+		"2021-03-14T15:09:26Z R 0x65 0x00 1 - ? 5 error",
+	} {
+		if _, err := ParseRecord(line); err == nil {
+			t.Errorf("ParseRecord('%s') succeeded", line)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+
+	sim := simulator.New()
+	rec := NewRecorder(sim, &buf)
+	dev := device.New(rec, device.DEVICE_ADDRESS)
+	sim.SetUSBPower(false)
+	sim.SetBatteryVoltage(3.8)
+	status, err := dev.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.SetWakeup(600, device.CONF_WAKE_AFTER); err != nil {
+		t.Fatal(err)
+	}
+	vbat, vref, err := dev.Voltage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sim.FailNext(1, syscall.EIO)
+	if _, err := dev.Status(); err == nil {
+		t.Fatal("Status() did not fail")
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := NewReplayer(strings.NewReader("# session\n\n" + buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.Strict = true
+	dev = device.New(rp, device.DEVICE_ADDRESS)
+	if s, err := dev.Status(); err != nil || s != status {
+		t.Errorf("Status() = %s, %v, expected %s", s, err, status)
+	}
+	if err := dev.SetWakeup(600, device.CONF_WAKE_AFTER); err != nil {
+		t.Errorf("SetWakeup() failed: %s", err)
+	}
+	if b, r, err := dev.Voltage(); err != nil || b != vbat || r != vref {
+		t.Errorf("Voltage() = %.3f, %.3f, %v, expected %.3f, %.3f", b, r, err, vbat, vref)
+	}
+	if _, err := dev.Status(); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Status() = %v, expected the recorded EIO", err)
+	}
+	if n := rp.Remaining(); n != 0 {
+		t.Errorf("Remaining() = %d after the session", n)
+	}
+	if _, err := dev.Status(); !errors.Is(err, EndOfTrace) {
+		t.Errorf("Status() = %v past the end of the trace", err)
+	}
+}
+
+const mismatchTrace = `# header
+2021-03-14T15:09:26Z R 0x65 0x00 1 0e
+
+2021-03-14T15:09:27Z W 0x65 0x03 1 01
+`
+
+func TestMismatch(t *testing.T) {
+	rp, err := NewReplayer(strings.NewReader(mismatchTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.ReadByte(0x65, 0x00); err != nil {
+		t.Fatal(err)
+	}
+	err = rp.WriteByte(0x65, 0x04, 0x01)
+	var mismatch *MismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("WriteByte() = %v, expected a mismatch", err)
+	}
+	if mismatch.Line != 4 || mismatch.Expected.Reg != 0x03 || mismatch.Got.Reg != 0x04 {
+		t.Errorf("MismatchError = %+v, expected line 4", mismatch)
+	}
+	if n := rp.Remaining(); n != 1 {
+		t.Errorf("Remaining() = %d after a mismatch, expected 1", n)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	rp, err := NewReplayer(strings.NewReader(mismatchTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.ReadByte(0x65, 0x00)
+	if err := rp.WriteByte(0x65, 0x03, 0x02); err != nil {
+		t.Errorf("WriteByte() with different data failed without Strict: %s", err)
+	}
+
+	rp, err = NewReplayer(strings.NewReader(mismatchTrace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp.Strict = true
+	rp.ReadByte(0x65, 0x00)
+	var mismatch *MismatchError
+	if err := rp.WriteByte(0x65, 0x03, 0x02); !errors.As(err, &mismatch) || mismatch.Line != 4 {
+		t.Errorf("WriteByte() with different data = %v, expected a mismatch at line 4", err)
+	}
+	if err := rp.WriteByte(0x65, 0x03, 0x01); err != nil {
+		t.Errorf("WriteByte() with the recorded data failed: %s", err)
+	}
+	if err := rp.WriteByte(0x65, 0x03, 0x01); err != EndOfTrace {
+		t.Errorf("WriteByte() = %v past the end of the trace", err)
+	}
+}
@@ -0,0 +1,121 @@
+package watchdog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Check is a health check. Check returns nil if the system is healthy.
+// String describes the check in log messages.
+type Check interface {
+	Check(ctx context.Context) error
+	String() string
+}
+
+// CommandCheck passes if Command, run through /bin/sh, exits with status 0.
+type CommandCheck struct {
+	Command string
+}
+
+func (c *CommandCheck) Check(ctx context.Context) error {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", c.Command).Run()
+}
+
+func (c *CommandCheck) String() string {
+	return fmt.Sprintf("command %q", c.Command)
+}
+
+// FileCheck passes if the file at Path was modified less than MaxAge ago,
+// e.g. a file touched periodically by the application.
+type FileCheck struct {
+	Path   string
+	MaxAge time.Duration
+}
+
+func (c *FileCheck) Check(ctx context.Context) error {
+	info, err := os.Stat(c.Path)
+	if err != nil {
+		return err
+	}
+	if age := time.Since(info.ModTime()); age > c.MaxAge {
+		return fmt.Errorf("modified %s ago", age.Round(time.Second))
+	}
+	return nil
+}
+
+func (c *FileCheck) String() string {
+	return fmt.Sprintf("file %s", c.Path)
+}
+
+// UnitCheck passes if the systemd unit Unit is active.
+type UnitCheck struct {
+	Unit string
+}
+
+func (c *UnitCheck) Check(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "systemctl", "is-active", c.Unit).Output()
+	if err != nil {
+		if state := strings.TrimSpace(string(out)); state != "" {
+			return fmt.Errorf("unit is %s", state)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *UnitCheck) String() string {
+	return fmt.Sprintf("unit %s", c.Unit)
+}
+
+// MemoryCheck passes if the memory available, as reported by the kernel in
+// /proc/meminfo, is at least MinAvailable bytes.
+type MemoryCheck struct {
+	MinAvailable uint64
+}
+
+func (c *MemoryCheck) Check(ctx context.Context) error {
+	available, err := AvailableMemory()
+	if err != nil {
+		return err
+	}
+	if available < c.MinAvailable {
+		return fmt.Errorf("%d MiB available, need %d MiB", available>>20, c.MinAvailable>>20)
+	}
+	return nil
+}
+
+func (c *MemoryCheck) String() string {
+	return "available memory"
+}
+
+// AvailableMemory returns MemAvailable from /proc/meminfo, in bytes.
+func AvailableMemory() (uint64, error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid MemAvailable in /proc/meminfo: %w", err)
+		}
+		return kb << 10, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("MemAvailable not found in /proc/meminfo")
+}
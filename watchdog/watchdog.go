@@ -0,0 +1,242 @@
+// Package watchdog keeps the PiVoyager watchdog from expiring while the
+// system is healthy. When a health check fails, the watchdog is no longer
+// kicked, so that the PiVoyager power-cycles a hung system.
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/gpio"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_TIMEOUT = 60 * time.Second
+	// WATCHDOG_GPIO is the GPIO line watched by the "gpio-watchdog", i.e.
+	// GPIO 26 on pin 37 of the 40-pin header.
+	WATCHDOG_GPIO = 26
+)
+
+// Mechanisms
+const (
+	MECHANISM_I2C  = "i2c"
+	MECHANISM_GPIO = "gpio"
+)
+
+// Kicker is a watchdog mechanism of the PiVoyager.
+type Kicker interface {
+	// Start arms the watchdog to expire after timeout.
+	Start(timeout time.Duration) error
+	// Kick restarts the watchdog countdown.
+	Kick() error
+	// Stop disarms the watchdog.
+	Stop() error
+}
+
+// I2CKicker uses the "i2c-watchdog": the watchdog register is rewritten on
+// each kick.
+type I2CKicker struct {
+	Device  *device.Device
+	timeout uint16
+}
+
+func NewI2CKicker(dev *device.Device) *I2CKicker {
+	return &I2CKicker{Device: dev}
+}
+
+func (k *I2CKicker) Start(timeout time.Duration) error {
+	secs, err := Seconds(timeout)
+	if err != nil {
+		return err
+	}
+	k.timeout = secs
+	return k.Device.SetWatchdog(secs, device.CONF_I2C_WD)
+}
+
+func (k *I2CKicker) Kick() error {
+	// Only the timer is rewritten, so a kick does not enable a watchdog
+	// disabled by someone else, e.g. before shutting down.
+	return k.Device.KickWatchdog(k.timeout)
+}
+
+func (k *I2CKicker) Stop() error {
+	return k.Device.ModifyConfiguration(device.CONF_I2C_WD, 0)
+}
+
+// GPIOKicker uses the "gpio-watchdog": the GPIO line watched by the
+// PiVoyager is toggled on each kick. Stop releases the line.
+type GPIOKicker struct {
+	Device *device.Device
+	Line   gpio.Line
+	high   bool
+}
+
+func NewGPIOKicker(dev *device.Device, line gpio.Line) *GPIOKicker {
+	return &GPIOKicker{Device: dev, Line: line}
+}
+
+func (k *GPIOKicker) Start(timeout time.Duration) error {
+	secs, err := Seconds(timeout)
+	if err != nil {
+		return err
+	}
+	if err := k.Kick(); err != nil {
+		return err
+	}
+	return k.Device.SetWatchdog(secs, device.CONF_PIN_WD)
+}
+
+func (k *GPIOKicker) Kick() error {
+	k.high = !k.high
+	return k.Line.SetValue(k.high)
+}
+
+func (k *GPIOKicker) Stop() error {
+	err := k.Device.ModifyConfiguration(device.CONF_PIN_WD, 0)
+	if cerr := k.Line.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Seconds converts a watchdog timeout to the number of seconds written in
+// the watchdog register.
+func Seconds(timeout time.Duration) (uint16, error) {
+	if timeout < time.Second || timeout > 0xFFFF*time.Second {
+		return 0, fmt.Errorf("Watchdog timeout must be between 1s and 65535s, got %s", timeout)
+	}
+	return uint16(timeout / time.Second), nil
+}
+
+type Watchdog struct {
+	Kicker Kicker
+	// Timeout after which the PiVoyager power-cycles the Pi if the watchdog
+	// is not kicked.
+	Timeout time.Duration
+	// Interval between two kicks, a quarter of Timeout by default.
+	Interval time.Duration
+	// Checks must all pass for the watchdog to be kicked.
+	Checks []Check
+	// KeepArmed leaves the watchdog armed when Run returns, so that the Pi
+	// is power-cycled unless another process takes over.
+	KeepArmed bool
+	Logger    *log.Logger
+
+	mu       sync.Mutex
+	healthy  bool
+	failure  error
+	released bool
+}
+
+func New(k Kicker, timeout time.Duration) *Watchdog {
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	return &Watchdog{Kicker: k, Timeout: timeout, healthy: true}
+}
+
+func (w *Watchdog) logf(format string, args ...interface{}) {
+	if w.Logger != nil {
+		w.Logger.Printf(format, args...)
+	}
+}
+
+// Healthy reports whether the last health checks passed, and if not, why.
+func (w *Watchdog) Healthy() (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.healthy, w.failure
+}
+
+// check runs all checks, stopping at the first failure.
+func (w *Watchdog) check(ctx context.Context) error {
+	for _, c := range w.Checks {
+		if err := c.Check(ctx); err != nil {
+			return fmt.Errorf("%s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// Tick runs the health checks and kicks the watchdog if they all pass,
+// unless it was released.
+func (w *Watchdog) Tick(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, w.interval())
+	failure := w.check(ctx)
+	cancel()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.released {
+		return nil
+	}
+	wasHealthy := w.healthy
+	w.healthy = failure == nil
+	w.failure = failure
+
+	if failure != nil {
+		if wasHealthy {
+			w.logf("Health check failed, no longer kicking the watchdog: %s", failure)
+		}
+		return nil
+	}
+	if !wasHealthy {
+		w.logf("Health checks pass again, kicking the watchdog")
+	}
+	return w.Kicker.Kick()
+}
+
+// Release stops kicking the watchdog and leaves it armed when Run returns,
+// so that its timer can be taken over, e.g. to power-cycle the Pi after a
+// shutdown. A kick in progress completes before Release returns.
+func (w *Watchdog) Release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.released = true
+}
+
+func (w *Watchdog) interval() time.Duration {
+	if w.Interval > 0 {
+		return w.Interval
+	}
+	return w.Timeout / 4
+}
+
+// Run arms the watchdog and kicks it every Interval while the health checks
+// pass, until ctx is cancelled. The watchdog is then disarmed, unless
+// KeepArmed is set or it was released.
+func (w *Watchdog) Run(ctx context.Context) error {
+	if w.interval() >= w.Timeout {
+		return errors.New("Watchdog interval must be shorter than its timeout")
+	}
+	if err := w.Kicker.Start(w.Timeout); err != nil {
+		return err
+	}
+	w.logf("Watchdog armed for %s, kicking every %s", w.Timeout, w.interval())
+
+	ticker := time.NewTicker(w.interval())
+	defer ticker.Stop()
+
+	for {
+		if err := w.Tick(ctx); err != nil {
+			w.logf("Failed to kick the watchdog: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			w.mu.Lock()
+			released := w.released
+			w.mu.Unlock()
+			if w.KeepArmed || released {
+				w.logf("Leaving the watchdog armed")
+				return nil
+			}
+			w.logf("Disarming the watchdog")
+			return w.Kicker.Stop()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package watchdog
+
+import (
+	"context"
+	"errors"
+	"github.com/omzlo/pivoyager/device"
+	"github.com/omzlo/pivoyager/gpio"
+	"github.com/omzlo/pivoyager/simulator"
+	"testing"
+	"time"
+)
+
+// newSimulator returns a simulator whose time only moves with Advance.
+func newSimulator() (*simulator.PiVoyager, *device.Device) {
+	sim := simulator.New()
+	now := time.Now()
+	sim.Now = func() time.Time { return now }
+	return sim, device.New(sim, device.DEVICE_ADDRESS)
+}
+
+type failingCheck struct {
+	err error
+}
+
+func (c *failingCheck) Check(ctx context.Context) error {
+	return c.err
+}
+
+func (c *failingCheck) String() string {
+	return "test check"
+}
+
+func TestI2CKicker(t *testing.T) {
+	sim, dev := newSimulator()
+	k := NewI2CKicker(dev)
+
+	if err := k.Start(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		sim.Advance(8 * time.Second)
+		if err := k.Kick(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sim.PowerCycles(); n != 0 {
+		t.Fatalf("the watchdog expired %d times while kicked", n)
+	}
+	sim.Advance(11 * time.Second)
+	if n := sim.PowerCycles(); n != 1 {
+		t.Errorf("the watchdog expired %d times once no longer kicked, expected 1", n)
+	}
+}
+
+func TestI2CKickerDisabled(t *testing.T) {
+	_, dev := newSimulator()
+	k := NewI2CKicker(dev)
+
+	if err := k.Start(30 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	// A kick must not enable a watchdog disabled in the meantime.
+	if err := k.Kick(); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf&device.CONF_I2C_WD != 0 {
+		t.Errorf("Kick() enabled the disabled watchdog")
+	}
+	if timer, err := dev.Watchdog(); err != nil || timer != 30 {
+		t.Errorf("Watchdog() = %d, %v after Kick(), expected 30", timer, err)
+	}
+}
+
+// testLine records the values of a GPIO line, forwarding them to the
+// watchdog pin of the simulator.
+type testLine struct {
+	pin    gpio.Line
+	values []bool
+	closed bool
+}
+
+func (l *testLine) SetValue(high bool) error {
+	if l.closed {
+		return errors.New("Line is closed")
+	}
+	l.values = append(l.values, high)
+	return l.pin.SetValue(high)
+}
+
+func (l *testLine) Close() error {
+	l.closed = true
+	return nil
+}
+
+func TestGPIOKicker(t *testing.T) {
+	sim, dev := newSimulator()
+	line := &testLine{pin: sim.WatchdogPin()}
+	k := NewGPIOKicker(dev, line)
+
+	if err := k.Start(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		sim.Advance(8 * time.Second)
+		if err := k.Kick(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := sim.PowerCycles(); n != 0 {
+		t.Fatalf("the watchdog expired %d times while kicked", n)
+	}
+	for i, v := range line.values {
+		if v != (i%2 == 0) {
+			t.Fatalf("line values = %v, expected a toggle on each kick", line.values)
+		}
+	}
+	if len(line.values) != 5 {
+		t.Errorf("line set %d times, expected 5", len(line.values))
+	}
+
+	if err := k.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !line.closed {
+		t.Errorf("Stop() did not release the line")
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf&device.CONF_PIN_WD != 0 {
+		t.Errorf("Stop() left the gpio watchdog enabled")
+	}
+	sim.Advance(20 * time.Second)
+	if n := sim.PowerCycles(); n != 0 {
+		t.Errorf("the watchdog expired %d times once stopped", n)
+	}
+}
+
+func TestTick(t *testing.T) {
+	sim, dev := newSimulator()
+	check := &failingCheck{}
+	w := New(NewI2CKicker(dev), 10*time.Second)
+	w.Checks = []Check{check}
+
+	if err := w.Kicker.Start(w.Timeout); err != nil {
+		t.Fatal(err)
+	}
+	sim.Advance(8 * time.Second)
+	if err := w.Tick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	check.err = errors.New("unhealthy")
+	sim.Advance(8 * time.Second)
+	if err := w.Tick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if healthy, err := w.Healthy(); healthy || err == nil {
+		t.Errorf("Healthy() = %v, %v after a failed check", healthy, err)
+	}
+	sim.Advance(3 * time.Second)
+	if n := sim.PowerCycles(); n != 1 {
+		t.Errorf("the watchdog expired %d times after a failed check, expected 1", n)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	sim, dev := newSimulator()
+	w := New(NewI2CKicker(dev), 10*time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w.Release()
+	if err := w.Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := dev.Configuration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf&device.CONF_I2C_WD == 0 {
+		t.Errorf("Run() disarmed the released watchdog")
+	}
+	sim.Advance(8 * time.Second)
+	if err := w.Tick(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sim.Advance(3 * time.Second)
+	if n := sim.PowerCycles(); n != 1 {
+		t.Errorf("the watchdog expired %d times once released, expected 1", n)
+	}
+}
+
+func TestSeconds(t *testing.T) {
+	if s, err := Seconds(90 * time.Second); err != nil || s != 90 {
+		t.Errorf("Seconds(90s) = %d, %v", s, err)
+	}
+	for _, d := range []time.Duration{500 * time.Millisecond, 0x10000 * time.Second} {
+		if _, err := Seconds(d); err == nil {
+			t.Errorf("Seconds(%s) accepted an out of range timeout", d)
+		}
+	}
+}